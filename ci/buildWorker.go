@@ -4,6 +4,7 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/macports/mpbot-github/ci/logger"
 )
@@ -34,16 +35,17 @@ func (worker *buildWorker) start() {
 			subports, err := ListSubports(port, mpbbTmpDir)
 			if err != nil {
 				returnCode = 1
-				logger.GlobalLogger.LogChan <- &logger.LogText{"port-" + port + "-subports-fail", []byte(err.Error())}
+				logger.GlobalLogger.LogChan <- &logger.LogText{FieldName: "port-" + port + "-subports-fail", Text: []byte(err.Error())}
 				continue
 			}
-			logger.GlobalLogger.LogChan <- &logger.LogText{"port-" + port + "-subports", []byte(strings.Join(subports, "\n"))}
+			logger.GlobalLogger.LogChan <- &logger.LogText{FieldName: "port-" + port + "-subports", Text: []byte(strings.Join(subports, "\n"))}
 			for _, subport := range subports {
 				statusString := "success"
 				portTmpDir := path.Join(worker.session.tmpDir, subport)
 				mpbbToLog("cleanup", "", portTmpDir, "cleanup.log")
 				logFilename := path.Join(worker.session.tmpDir, "port-"+subport+"-dep-install.log")
-				logger.GlobalLogger.LogChan <- &logger.LogText{"port-" + subport + "-dep-install-start", nil}
+				logger.GlobalLogger.LogChan <- &logger.LogText{FieldName: "port-" + subport + "-dep-install-start"}
+				startTime := time.Now()
 				err := mpbbToLog("install-dependencies", subport, portTmpDir, logFilename)
 				if err != nil {
 					if eerr, ok := err.(*exec.ExitError); ok {
@@ -53,6 +55,7 @@ func (worker *buildWorker) start() {
 						}
 					}
 				}
+				worker.session.metrics.observe(subport, "install-dependencies", statusString, time.Since(startTime))
 				logger.GlobalLogger.LogChan <- &logger.LogFile{
 					FieldName: "port-" + subport + "-dep-summary-" + statusString,
 					Filename:  path.Join(portTmpDir, "logs/dependencies-progress.txt"),
@@ -67,7 +70,8 @@ func (worker *buildWorker) start() {
 				}
 
 				logFilename = path.Join(worker.session.tmpDir, "port-"+subport+"-install.log")
-				logger.GlobalLogger.LogChan <- &logger.LogText{"port-" + subport + "-install-start", nil}
+				logger.GlobalLogger.LogChan <- &logger.LogText{FieldName: "port-" + subport + "-install-start"}
+				startTime = time.Now()
 				err = mpbbToLog("install-port", subport, portTmpDir, logFilename, "--source")
 				if err != nil {
 					if eerr, ok := err.(*exec.ExitError); ok {
@@ -77,6 +81,7 @@ func (worker *buildWorker) start() {
 						}
 					}
 				}
+				worker.session.metrics.observe(subport, "install-port", statusString, time.Since(startTime))
 				logger.GlobalLogger.LogChan <- &logger.LogFile{
 					FieldName: "port-" + subport + "-install-summary-" + statusString,
 					Filename:  path.Join(portTmpDir, "logs/ports-progress.txt"),
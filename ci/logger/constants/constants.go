@@ -1,3 +1,9 @@
 package constants
 
 const MIMEBoundary = "9bba227c544541bbafbe7a4fc806bab5489eae04f16d9303cac42e9eff2e"
+
+// Log field with per-port build metrics in the Prometheus text format
+const MetricsFieldName = "metrics"
+
+// Gauge reported in MetricsFieldName, labelled by port, stage and result
+const PortBuildSecondsMetric = "mpbot_ci_port_build_seconds"
@@ -0,0 +1,35 @@
+package ci
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macports/mpbot-github/ci/logger/constants"
+)
+
+// buildMetrics collects the duration and outcome of each build stage of
+// each port. They are sent to the PR bot in the Prometheus text format.
+type buildMetrics struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (metrics *buildMetrics) observe(port, stage, result string, duration time.Duration) {
+	line := constants.PortBuildSecondsMetric +
+		"{port=" + strconv.Quote(port) +
+		",stage=" + strconv.Quote(stage) +
+		",result=" + strconv.Quote(result) + "} " +
+		strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)
+	metrics.lock.Lock()
+	metrics.lines = append(metrics.lines, line)
+	metrics.lock.Unlock()
+}
+
+func (metrics *buildMetrics) text() []byte {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	return []byte("# TYPE " + constants.PortBuildSecondsMetric + " gauge\n" +
+		strings.Join(metrics.lines, "\n") + "\n")
+}
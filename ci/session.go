@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/macports/mpbot-github/ci/logger"
+	"github.com/macports/mpbot-github/ci/logger/constants"
 )
 
 // Session is the public interface of the ci package.
@@ -19,6 +20,7 @@ type Session struct {
 	// TODO: Return error in Run() if build failed
 	// Collects lint and build failure
 	results chan string
+	metrics buildMetrics
 }
 
 func NewSession() (*Session, error) {
@@ -42,7 +44,7 @@ func NewSession() (*Session, error) {
 // Run() blocks until all ports are tested and all logs are printed
 // or queued in the GlobalLogger.
 func (session *Session) Run() error {
-	logger.GlobalLogger.LogChan <- &logger.LogText{"port-list", []byte(strings.Join(session.ports, "\n"))}
+	logger.GlobalLogger.LogChan <- &logger.LogText{FieldName: "port-list", Text: []byte(strings.Join(session.ports, "\n"))}
 	if len(session.ports) == 0 {
 		return nil
 	}
@@ -68,11 +70,12 @@ func (session *Session) Run() error {
 			statusString = "fail"
 			err = errors.New("lint failed")
 		}
-		logger.GlobalLogger.LogChan <- &logger.LogText{"port-lint-output-" + statusString, out}
+		logger.GlobalLogger.LogChan <- &logger.LogText{FieldName: "port-lint-output-" + statusString, Text: out}
 	}
 
 	if bWorker.wait() != 0 {
 		err = errors.New("build failed")
 	}
+	logger.GlobalLogger.LogChan <- &logger.LogText{FieldName: constants.MetricsFieldName, Text: session.metrics.text()}
 	return err
 }
@@ -3,15 +3,17 @@ module github.com/macports/mpbot-github
 go 1.13
 
 require (
-	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/google/go-github/v28 v28.1.1
 	github.com/hashicorp/go-hclog v0.14.1 // indirect
 	github.com/hashicorp/go-retryablehttp v0.6.6
 	github.com/lib/pq v1.7.0
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/common v0.10.0
 	github.com/stretchr/testify v1.4.0
 	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9 // indirect
 	golang.org/x/net v0.0.0-20200602114024-627f9648deb9 // indirect
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	google.golang.org/appengine v1.6.6 // indirect
 	google.golang.org/protobuf v1.24.0 // indirect
+	gopkg.in/yaml.v2 v2.2.5
 )
@@ -0,0 +1,107 @@
+// Package commits checks the commit messages of a PR against the MacPorts
+// conventions, e.g. subjects like "portname: update to 1.2.3".
+package commits
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxSubjectLength is the longest subject that is not truncated in git log
+// and on GitHub.
+const MaxSubjectLength = 72
+
+// Problems found in commits
+var (
+	ProblemMerge          = "merge commit, rebase the branch instead"
+	ProblemWorkInProgress = "work in progress, squash it before merging"
+	ProblemLongSubject    = "subject longer than " + strconv.Itoa(MaxSubjectLength) + " characters"
+)
+
+// ProblemPortPrefix returns the problem of a commit changing port without
+// naming it.
+func ProblemPortPrefix(port string) string {
+	return "subject does not start with the port changed, e.g. `" + port + ": `"
+}
+
+// Commit is a commit of a PR.
+type Commit struct {
+	SHA     string
+	Message string
+	// Number of parents, more than one for merge commits
+	Parents int
+	// Ports whose files the commit changes
+	Ports []string
+}
+
+// Problem is a commit not following the conventions.
+type Problem struct {
+	SHA     string `json:"sha"`
+	Subject string `json:"subject"`
+	Problem string `json:"problem"`
+}
+
+var (
+	workInProgress = regexp.MustCompile(`(?i)^(fixup!|squash!|amend!)|\bwip\b`)
+	// "port: ", "port1, port2: " or "category/port: "
+	portPrefix = regexp.MustCompile(`^([^:\s][^:]*):\s`)
+)
+
+// Subject returns the first line of a commit message.
+func Subject(message string) string {
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		message = message[:i]
+	}
+	return strings.TrimSpace(message)
+}
+
+// Check returns the problems of commits, in order.
+func Check(commits []*Commit) []Problem {
+	var problems []Problem
+	for _, commit := range commits {
+		subject := Subject(commit.Message)
+		add := func(problem string) {
+			problems = append(problems, Problem{SHA: commit.SHA, Subject: subject, Problem: problem})
+		}
+		if commit.Parents > 1 {
+			add(ProblemMerge)
+			// Merges are not expected to follow the conventions otherwise
+			continue
+		}
+		if workInProgress.MatchString(subject) {
+			add(ProblemWorkInProgress)
+		}
+		if utf8.RuneCountInString(subject) > MaxSubjectLength {
+			add(ProblemLongSubject)
+		}
+		if len(commit.Ports) > 0 && !namesAnyPort(subject, commit.Ports) {
+			add(ProblemPortPrefix(commit.Ports[0]))
+		}
+	}
+	return problems
+}
+
+// namesAnyPort reports whether the prefix of subject names one of ports.
+// Commits changing many ports, e.g. revbumps of dependents, need only name
+// one of them.
+func namesAnyPort(subject string, ports []string) bool {
+	match := portPrefix.FindStringSubmatch(subject)
+	if match == nil {
+		return false
+	}
+	for _, name := range strings.FieldsFunc(match[1], func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if i := strings.LastIndexByte(name, '/'); i >= 0 {
+			name = name[i+1:]
+		}
+		for _, port := range ports {
+			if strings.EqualFold(name, port) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package commits
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubject(t *testing.T) {
+	assert.Equal(t, "upx: update to 3.96", Subject("upx: update to 3.96\n\nCloses: https://trac.macports.org/ticket/61234"))
+	assert.Equal(t, "upx: update to 3.96", Subject("upx: update to 3.96 "))
+}
+
+func TestCheck(t *testing.T) {
+	long := "upx: update to 3.96, which fixes a crash when compressing large binaries on arm64"
+	commits := []*Commit{
+		{SHA: "a1", Message: "upx: update to 3.96", Parents: 1, Ports: []string{"upx"}},
+		{SHA: "a2", Message: "Merge branch 'master' into upx", Parents: 2, Ports: []string{"upx"}},
+		{SHA: "a3", Message: "fixup! upx: update to 3.96", Parents: 1, Ports: []string{"upx"}},
+		{SHA: "a4", Message: "[WIP] upx: try arm64", Parents: 1, Ports: []string{"upx"}},
+		{SHA: "a5", Message: "update to 3.96", Parents: 1, Ports: []string{"upx"}},
+		{SHA: "a6", Message: long, Parents: 1, Ports: []string{"upx"}},
+		{SHA: "a7", Message: "archivers/upx: fix build", Parents: 1, Ports: []string{"upx"}},
+		{SHA: "a8", Message: "libfoo, foo-tools: update to 2.0", Parents: 1, Ports: []string{"foo-tools", "libfoo"}},
+		{SHA: "a9", Message: "libfoo: rebuild dependents", Parents: 1, Ports: []string{"bar", "baz"}},
+		{SHA: "a10", Message: "Update README", Parents: 1},
+	}
+	assert.Equal(t, []Problem{
+		{SHA: "a2", Subject: "Merge branch 'master' into upx", Problem: ProblemMerge},
+		{SHA: "a3", Subject: "fixup! upx: update to 3.96", Problem: ProblemWorkInProgress},
+		{SHA: "a4", Subject: "[WIP] upx: try arm64", Problem: ProblemWorkInProgress},
+		{SHA: "a5", Subject: "update to 3.96", Problem: ProblemPortPrefix("upx")},
+		{SHA: "a6", Subject: long, Problem: ProblemLongSubject},
+		{SHA: "a9", Subject: "libfoo: rebuild dependents", Problem: ProblemPortPrefix("bar")},
+	}, Check(commits))
+	assert.Empty(t, Check(commits[:1]))
+}
@@ -0,0 +1,363 @@
+// Package config loads the settings of the PR bot from a YAML file and
+// environment variables.
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	ListenAddr string       `yaml:"listen_addr"`
+	Production bool         `yaml:"production"`
+	GitHub     GitHubConfig `yaml:"github"`
+	// Repositories served by the bot, events from others are ignored
+	Repos []*RepoConfig `yaml:"repos"`
+	DB    DBConfig      `yaml:"db"`
+	Trac  TracConfig    `yaml:"trac"`
+	// Time given to maintainers to respond before a PR times out, unless
+	// overridden for a repository
+	MaintainerTimeout Duration `yaml:"maintainer_timeout"`
+	// How often timed out PRs are checked for
+	CronInterval Duration `yaml:"cron_interval"`
+	// How often the list of org members is reloaded
+	MembersInterval Duration `yaml:"members_interval"`
+	// Time given to events being processed on shutdown before they are
+	// cancelled and left for the next start
+	ShutdownTimeout Duration     `yaml:"shutdown_timeout"`
+	Travis          TravisConfig `yaml:"travis"`
+	Labels          LabelConfig  `yaml:"labels"`
+	// Path of the label rules file, the default rules for Labels are used
+	// if empty
+	LabelRules string       `yaml:"label_rules"`
+	Workers    int          `yaml:"workers"`
+	QueueSize  int          `yaml:"queue_size"`
+	DryRun     DryRunConfig `yaml:"dry_run"`
+}
+
+type GitHubConfig struct {
+	// Login of the bot, without "@"
+	BotName string `yaml:"bot_name"`
+	// Personal access token, not needed when authenticating as a GitHub App
+	Token         string    `yaml:"token"`
+	App           AppConfig `yaml:"app"`
+	WebhookSecret string    `yaml:"webhook_secret"`
+	RequireSHA256 bool      `yaml:"require_sha256"`
+}
+
+// AppConfig identifies a GitHub App the bot authenticates as.
+type AppConfig struct {
+	ID int64 `yaml:"id"`
+	// Looked up for the owner of each repository if 0
+	InstallationID int64  `yaml:"installation_id"`
+	PrivateKeyPath string `yaml:"private_key_path"`
+}
+
+// RepoConfig is the policy of a repository served by the bot.
+type RepoConfig struct {
+	Owner string `yaml:"owner"`
+	Name  string `yaml:"name"`
+	// Whether maintainers of changed ports are notified and labelled
+	PortMaintainers bool `yaml:"port_maintainers"`
+	// Overrides the global maintainer_timeout if set
+	MaintainerTimeout Duration `yaml:"maintainer_timeout"`
+}
+
+// Timeout returns the maintainer timeout of the repository.
+func (cfg *Config) Timeout(repo *RepoConfig) time.Duration {
+	if repo.MaintainerTimeout > 0 {
+		return time.Duration(repo.MaintainerTimeout)
+	}
+	return time.Duration(cfg.MaintainerTimeout)
+}
+
+// Repo returns the policy of a repository, or nil if it is not served.
+func (cfg *Config) Repo(owner, name string) *RepoConfig {
+	for _, repo := range cfg.Repos {
+		if repo.Owner == owner && repo.Name == name {
+			return repo
+		}
+	}
+	return nil
+}
+
+// Owners returns the distinct owners of the served repositories.
+func (cfg *Config) Owners() []string {
+	var owners []string
+	seen := make(map[string]bool)
+	for _, repo := range cfg.Repos {
+		if !seen[repo.Owner] {
+			seen[repo.Owner] = true
+			owners = append(owners, repo.Owner)
+		}
+	}
+	return owners
+}
+
+// DBConfig holds PostgreSQL connection strings.
+type DBConfig struct {
+	Trac string `yaml:"trac"`
+	WWW  string `yaml:"www"`
+	PR   string `yaml:"pr"`
+}
+
+// TracConfig is the Trac instance whose tickets PRs reference. Tickets are
+// only updated if User is set.
+type TracConfig struct {
+	URL      string `yaml:"url"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// DryRunConfig makes the bot log the changes it would make on GitHub instead
+// of making them.
+type DryRunConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Number of recorded changes kept for /dryrun
+	BufferSize int `yaml:"buffer_size"`
+}
+
+type TravisConfig struct {
+	APIURL string `yaml:"api_url"`
+	// Repository owners whose builds are reported
+	Owners []string `yaml:"owners"`
+}
+
+type LabelConfig struct {
+	Maintainer       string `yaml:"maintainer"`
+	NoMaintainer     string `yaml:"nomaintainer"`
+	OpenMaintainer   string `yaml:"openmaintainer"`
+	RequiresApproval string `yaml:"requires_approval"`
+	Timeout          string `yaml:"timeout"`
+	Member           string `yaml:"member"`
+	// Prefix of type labels, followed by e.g. "update"
+	TypePrefix string `yaml:"type_prefix"`
+	// Labels of the default rules for PRs needing attention
+	Duplicate      string `yaml:"duplicate"`
+	Checksum       string `yaml:"checksum"`
+	CommitMessages string `yaml:"commit_messages"`
+	HighImpact     string `yaml:"high_impact"`
+}
+
+// Duration is a time.Duration written like "72h" in the config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the settings used for anything missing in the config file.
+func Default() *Config {
+	return &Config{
+		ListenAddr: "localhost:8081",
+		GitHub: GitHubConfig{
+			BotName: "macportsbot",
+		},
+		Repos: []*RepoConfig{
+			{Owner: "macports", Name: "macports-ports", PortMaintainers: true},
+		},
+		Trac: TracConfig{
+			URL: "https://trac.macports.org",
+		},
+		MaintainerTimeout: Duration(72 * time.Hour),
+		CronInterval:      Duration(6 * time.Hour),
+		MembersInterval:   Duration(24 * time.Hour),
+		ShutdownTimeout:   Duration(30 * time.Second),
+		Travis: TravisConfig{
+			APIURL: "https://api.travis-ci.org",
+			Owners: []string{"macports", "macports-staging"},
+		},
+		Labels: LabelConfig{
+			Maintainer:       "maintainer",
+			NoMaintainer:     "maintainer: none",
+			OpenMaintainer:   "maintainer: open",
+			RequiresApproval: "maintainer: requires approval",
+			Timeout:          "maintainer: timeout",
+			Member:           "by: member",
+			TypePrefix:       "type: ",
+			Duplicate:        "needs review: duplicate",
+			Checksum:         "needs review: checksum",
+			CommitMessages:   "needs: commit message fix",
+			HighImpact:       "impact: high",
+		},
+		Workers:   4,
+		QueueSize: 64,
+		DryRun: DryRunConfig{
+			BufferSize: 1000,
+		},
+	}
+}
+
+// Load reads the config file at path, if any, on top of the defaults and
+// applies environment overrides. Unknown keys in the file are returned as
+// warnings, invalid values as an error.
+func Load(path string) (*Config, []string, error) {
+	cfg := Default()
+	var warnings []string
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		warnings, err = parse(data, cfg)
+		if err != nil {
+			return nil, warnings, err
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, warnings, err
+	}
+
+	return cfg, warnings, cfg.Validate()
+}
+
+func parse(data []byte, cfg *Config) ([]string, error) {
+	var warnings []string
+	err := yaml.UnmarshalStrict(data, cfg)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		var problems []string
+		for _, e := range typeErr.Errors {
+			if strings.Contains(e, " not found in type ") {
+				warnings = append(warnings, "unknown key: "+e)
+			} else {
+				problems = append(problems, e)
+			}
+		}
+		if len(problems) > 0 {
+			return warnings, errors.New("invalid config: " + strings.Join(problems, "; "))
+		}
+		// Only unknown keys, decode the rest
+		err = yaml.Unmarshal(data, cfg)
+	}
+	return warnings, err
+}
+
+// applyEnv overrides settings with the environment variables the bot has
+// always used, so that secrets need not be written to the config file.
+func (cfg *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	settings := map[string]*string{
+		"HUB_WEBHOOK_SECRET": &cfg.GitHub.WebhookSecret,
+		"HUB_BOT_SECRET":     &cfg.GitHub.Token,
+		"HUB_APP_KEY":        &cfg.GitHub.App.PrivateKeyPath,
+		"TRAC_DB":            &cfg.DB.Trac,
+		"WWW_DB":             &cfg.DB.WWW,
+		"PR_DB":              &cfg.DB.PR,
+		"TRAC_USER":          &cfg.Trac.User,
+		"TRAC_PASSWORD":      &cfg.Trac.Password,
+	}
+	for name, setting := range settings {
+		if value, ok := lookupEnv(name); ok {
+			*setting = value
+		}
+	}
+
+	if value, ok := lookupEnv("BOT_ENV"); ok {
+		cfg.Production = value == "production"
+	}
+	if value, ok := lookupEnv("BOT_DRY_RUN"); ok {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("BOT_DRY_RUN: " + err.Error())
+		}
+		cfg.DryRun.Enabled = dryRun
+	}
+	if value, ok := lookupEnv("HUB_REQUIRE_SHA256"); ok {
+		requireSHA256, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("HUB_REQUIRE_SHA256: " + err.Error())
+		}
+		cfg.GitHub.RequireSHA256 = requireSHA256
+	}
+	return nil
+}
+
+// Validate reports the first invalid setting.
+func (cfg *Config) Validate() error {
+	switch {
+	case cfg.ListenAddr == "":
+		return errors.New("listen_addr must be set")
+	case cfg.GitHub.WebhookSecret == "":
+		return errors.New("github.webhook_secret or HUB_WEBHOOK_SECRET must be set")
+	case cfg.GitHub.Token == "" && cfg.GitHub.App.ID == 0:
+		return errors.New("github.token, HUB_BOT_SECRET or github.app must be set")
+	case cfg.GitHub.App.ID != 0 && cfg.GitHub.App.PrivateKeyPath == "":
+		return errors.New("github.app.private_key_path must be set")
+	case len(cfg.Repos) == 0:
+		return errors.New("repos must not be empty")
+	case cfg.GitHub.BotName == "" || strings.ContainsAny(cfg.GitHub.BotName, "@ \t\n"):
+		return errors.New("github.bot_name must be a GitHub login without @")
+	case cfg.MaintainerTimeout <= 0:
+		return errors.New("maintainer_timeout must be positive")
+	case cfg.CronInterval <= 0:
+		return errors.New("cron_interval must be positive")
+	case cfg.MembersInterval <= 0:
+		return errors.New("members_interval must be positive")
+	case cfg.ShutdownTimeout <= 0:
+		return errors.New("shutdown_timeout must be positive")
+	case cfg.Workers < 1:
+		return errors.New("workers must be at least 1")
+	case cfg.QueueSize < 1:
+		return errors.New("queue_size must be at least 1")
+	case cfg.DryRun.Enabled && cfg.DryRun.BufferSize < 1:
+		return errors.New("dry_run.buffer_size must be at least 1")
+	}
+	seen := make(map[string]bool)
+	for _, repo := range cfg.Repos {
+		if repo.Owner == "" || repo.Name == "" {
+			return errors.New("repos: owner and name must be set")
+		}
+		if seen[repo.Owner+"/"+repo.Name] {
+			return errors.New("repos: " + repo.Owner + "/" + repo.Name + " listed twice")
+		}
+		seen[repo.Owner+"/"+repo.Name] = true
+		if repo.MaintainerTimeout < 0 {
+			return errors.New("repos: maintainer_timeout of " + repo.Owner + "/" + repo.Name + " must be positive")
+		}
+	}
+	if u, err := url.Parse(cfg.Travis.APIURL); err != nil || !u.IsAbs() {
+		return errors.New("travis.api_url must be an absolute URL")
+	}
+	if u, err := url.Parse(cfg.Trac.URL); err != nil || !u.IsAbs() {
+		return errors.New("trac.url must be an absolute URL")
+	}
+	labels := map[string]string{
+		"maintainer":        cfg.Labels.Maintainer,
+		"nomaintainer":      cfg.Labels.NoMaintainer,
+		"openmaintainer":    cfg.Labels.OpenMaintainer,
+		"requires_approval": cfg.Labels.RequiresApproval,
+		"timeout":           cfg.Labels.Timeout,
+		"member":            cfg.Labels.Member,
+		"type_prefix":       cfg.Labels.TypePrefix,
+		"duplicate":         cfg.Labels.Duplicate,
+		"checksum":          cfg.Labels.Checksum,
+		"commit_messages":   cfg.Labels.CommitMessages,
+		"high_impact":       cfg.Labels.HighImpact,
+	}
+	for key, label := range labels {
+		if label == "" {
+			return errors.New("labels." + key + " must not be empty")
+		}
+	}
+	if cfg.Production && (cfg.DB.Trac == "" || cfg.DB.WWW == "" || cfg.DB.PR == "") {
+		return errors.New("all databases must be configured in production")
+	}
+	return nil
+}
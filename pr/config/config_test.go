@@ -0,0 +1,146 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExampleConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("../prbot/config.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Default()
+	warnings, err := parse(data, cfg)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestParse(t *testing.T) {
+	cfg := Default()
+	warnings, err := parse([]byte(`
+github:
+  colour: blue
+repos:
+  - owner: macports
+    name: macports-ports
+    port_maintainers: true
+  - owner: macports
+    name: macports-base
+    maintainer_timeout: 168h
+  - owner: macports-staging
+    name: macports-ports
+maintainer_timeout: 24h
+workerz: 2
+`), cfg)
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 2)
+	assert.Equal(t, Duration(24*time.Hour), cfg.MaintainerTimeout)
+	assert.Len(t, cfg.Repos, 3)
+	assert.Equal(t, []string{"macports", "macports-staging"}, cfg.Owners())
+
+	ports := cfg.Repo("macports", "macports-ports")
+	if assert.NotNil(t, ports) {
+		assert.True(t, ports.PortMaintainers)
+		assert.Equal(t, 24*time.Hour, cfg.Timeout(ports))
+	}
+	base := cfg.Repo("macports", "macports-base")
+	if assert.NotNil(t, base) {
+		assert.False(t, base.PortMaintainers)
+		assert.Equal(t, 168*time.Hour, cfg.Timeout(base))
+	}
+	assert.Nil(t, cfg.Repo("macports-staging", "macports-base"))
+
+	_, err = parse([]byte("workers: many\n"), Default())
+	assert.Error(t, err)
+	_, err = parse([]byte("cron_interval: 6 hours\n"), Default())
+	assert.Error(t, err)
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"HUB_WEBHOOK_SECRET": "hook",
+		"HUB_BOT_SECRET":     "token",
+		"PR_DB":              "dbname=pr",
+		"BOT_ENV":            "production",
+		"HUB_REQUIRE_SHA256": "true",
+		"BOT_DRY_RUN":        "1",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	cfg := Default()
+	cfg.DB.Trac = "dbname=trac"
+	assert.NoError(t, cfg.applyEnv(lookupEnv))
+	assert.Equal(t, "hook", cfg.GitHub.WebhookSecret)
+	assert.Equal(t, "token", cfg.GitHub.Token)
+	assert.Equal(t, "dbname=trac", cfg.DB.Trac)
+	assert.Equal(t, "dbname=pr", cfg.DB.PR)
+	assert.True(t, cfg.Production)
+	assert.True(t, cfg.GitHub.RequireSHA256)
+	assert.True(t, cfg.DryRun.Enabled)
+
+	env["HUB_REQUIRE_SHA256"] = "sometimes"
+	assert.Error(t, Default().applyEnv(lookupEnv))
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := Default()
+		cfg.GitHub.WebhookSecret = "hook"
+		cfg.GitHub.Token = "token"
+		return cfg
+	}
+	assert.NoError(t, valid().Validate())
+
+	app := valid()
+	app.GitHub.Token = ""
+	app.GitHub.App = AppConfig{ID: 1, PrivateKeyPath: "app.pem"}
+	assert.NoError(t, app.Validate())
+
+	invalid := []func(*Config){
+		func(cfg *Config) { cfg.GitHub.Token = "" },
+		func(cfg *Config) { cfg.GitHub.App.ID = 1 },
+		func(cfg *Config) { cfg.GitHub.BotName = "@macportsbot" },
+		func(cfg *Config) { cfg.MaintainerTimeout = 0 },
+		func(cfg *Config) { cfg.Workers = 0 },
+		func(cfg *Config) { cfg.ShutdownTimeout = 0 },
+		func(cfg *Config) { cfg.Travis.APIURL = "api.travis-ci.org" },
+		func(cfg *Config) { cfg.Labels.Timeout = "" },
+		func(cfg *Config) { cfg.Production = true },
+		func(cfg *Config) { cfg.DryRun = DryRunConfig{Enabled: true} },
+		func(cfg *Config) { cfg.Repos = nil },
+		func(cfg *Config) { cfg.Repos[0].Name = "" },
+		func(cfg *Config) {
+			cfg.Repos = append(cfg.Repos, &RepoConfig{Owner: "macports", Name: "macports-ports"})
+		},
+	}
+	for i, modify := range invalid {
+		cfg := valid()
+		modify(cfg)
+		assert.Error(t, cfg.Validate(), i)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prbot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "prbot.yml")
+	ioutil.WriteFile(path, []byte("github:\n  token: token\n  webhook_secret: hook\nqueue_size: 0\n"), 0600)
+
+	_, _, err = Load(path)
+	assert.EqualError(t, err, "queue_size must be at least 1")
+
+	_, _, err = Load(filepath.Join(dir, "missing.yml"))
+	assert.Error(t, err)
+}
@@ -1,30 +1,45 @@
 package cron
 
 import (
+	"context"
 	"log"
 	"strconv"
 	"time"
 
+	"github.com/macports/mpbot-github/pr/config"
 	"github.com/macports/mpbot-github/pr/db"
 	"github.com/macports/mpbot-github/pr/githubapi"
+	"github.com/macports/mpbot-github/pr/status"
 )
 
 type Manager struct {
 	DB     db.DBHelper
 	Client githubapi.Client
+	Config *config.Config
 }
 
-func (manager *Manager) Start() {
-	manager.MaintainerTimeout()
+// Start runs the periodic jobs until ctx is cancelled.
+func (manager *Manager) Start(ctx context.Context) {
+	manager.MaintainerTimeout(ctx)
 	for {
 		select {
-		case <-time.After(6 * time.Hour):
-			manager.MaintainerTimeout()
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(manager.Config.CronInterval)):
+			manager.MaintainerTimeout(ctx)
 		}
 	}
 }
 
-func (manager *Manager) MaintainerTimeout() {
+// MaintainerTimeout labels PRs of every served repository whose maintainers
+// did not respond in time.
+func (manager *Manager) MaintainerTimeout(ctx context.Context) {
+	for _, repo := range manager.Config.Repos {
+		manager.repoMaintainerTimeout(ctx, repo)
+	}
+}
+
+func (manager *Manager) repoMaintainerTimeout(ctx context.Context, repoConfig *config.RepoConfig) {
 	//TODO: properly handle nil pointers
 	defer func() {
 		if r := recover(); r != nil {
@@ -32,46 +47,58 @@ func (manager *Manager) MaintainerTimeout() {
 		}
 	}()
 
-	prs, err := manager.DB.GetTimeoutPRs()
+	owner := repoConfig.Owner
+	repo := repoConfig.Name
+	prs, err := manager.DB.GetTimeoutPRs(ctx, owner, repo, manager.Config.Timeout(repoConfig))
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	labelConfig := manager.Config.Labels
 prLoop:
 	for _, pr := range prs {
-		log.Println("maintainer timeout of PR #" + strconv.Itoa(pr.Number) + " detected")
-		prStatus, err := manager.Client.GetPullRequest("macports", "macports-ports", pr.Number)
+		if ctx.Err() != nil {
+			return
+		}
+		prName := owner + "/" + repo + "#" + strconv.Itoa(pr.Number)
+		log.Println("maintainer timeout of PR " + prName + " detected")
+		prStatus, err := manager.Client.GetPullRequest(ctx, owner, repo, pr.Number)
 		if err != nil {
-			log.Println("Failed to get status of PR #" + strconv.Itoa(pr.Number))
+			log.Println("Failed to get status of PR " + prName)
 			continue
 		}
 		if *prStatus.State == "closed" {
-			log.Println("PR #" + strconv.Itoa(pr.Number) + " closed, clear pending_review")
-			manager.DB.SetPRPendingReview(pr.Number, false)
+			log.Println("PR " + prName + " closed, clear pending_review")
+			manager.DB.SetPRPendingReview(ctx, owner, repo, pr.Number, false)
 			continue
 		}
-		//TODO: de-hardcode
-		labels, err := manager.Client.ListLabels("macports", "macports-ports", pr.Number)
+		labels, err := manager.Client.ListLabels(ctx, owner, repo, pr.Number)
 		if err != nil {
 			continue
 		}
 		isApprovalRequired := false
 		for _, label := range labels {
-			if label == "maintainer: requires approval" {
+			if label == labelConfig.RequiresApproval {
 				isApprovalRequired = true
 			}
-			if label == "maintainer: timeout" {
-				manager.DB.SetPRPendingReview(pr.Number, false)
+			if label == labelConfig.Timeout {
+				manager.DB.SetPRPendingReview(ctx, owner, repo, pr.Number, false)
 				continue prLoop
 			}
 		}
 		if !isApprovalRequired {
-			manager.DB.SetPRPendingReview(pr.Number, false)
+			manager.DB.SetPRPendingReview(ctx, owner, repo, pr.Number, false)
 		} else {
-			labels = append(labels, "maintainer: timeout")
-			err = manager.Client.ReplaceLabels("macports", "macports-ports", pr.Number, labels)
+			labels = append(labels, labelConfig.Timeout)
+			err = manager.Client.ReplaceLabels(ctx, owner, repo, pr.Number, labels)
 			if err == nil {
-				manager.DB.SetPRPendingReview(pr.Number, false)
+				manager.DB.SetPRPendingReview(ctx, owner, repo, pr.Number, false)
+				err = status.Update(ctx, manager.Client, manager.Config.GitHub.BotName, owner, repo, pr.Number, func(comment *status.Comment) {
+					comment.Timeout = status.Timeout{State: status.TimeoutExpired, Away: comment.Timeout.Away}
+				})
+				if err != nil {
+					log.Println(err)
+				}
 			}
 		}
 	}
@@ -1,15 +1,17 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"log"
-	"os"
 	"strings"
 	"time"
 
-	// PostgreSQL driver
-	_ "github.com/lib/pq"
+	"github.com/macports/mpbot-github/pr/config"
+	"github.com/macports/mpbot-github/pr/metrics"
+
+	"github.com/lib/pq"
 )
 
 type Maintainer struct {
@@ -25,25 +27,53 @@ type PortMaintainer struct {
 }
 
 type PullRequest struct {
+	Owner         string
+	Repo          string
 	Number        int
 	Processed     bool
 	PendingReview bool
-	Maintainers   []string
+	// When the maintainer timeout clock was last started
+	PendingSince time.Time
+	Maintainers  []string
+	// The maintainer timeout clock is paused while a PR is a draft
+	Draft bool
+	// Zero while the PR is open
+	ClosedAt time.Time
+	// Zero unless the PR was merged
+	MergedAt time.Time
 }
 
 type DBHelper interface {
-	GetGitHubHandle(email string) (string, error)
-	GetPortMaintainer(port string) (*PortMaintainer, error)
-	NewPR(number int, maintainers []string) error
-	GetPR(number int) (*PullRequest, error)
-	GetTimeoutPRs() ([]*PullRequest, error)
-	SetPRProcessed(number int, processed bool) error
-	SetPRPendingReview(number int, pendingReview bool) error
+	GetGitHubHandle(ctx context.Context, email string) (string, error)
+	GetPortMaintainer(ctx context.Context, port string) (*PortMaintainer, error)
+	FindSimilarPorts(ctx context.Context, name string) ([]*Port, error)
+	GetDependents(ctx context.Context, port string) (*Dependents, error)
+	NewPR(ctx context.Context, owner, repo string, number int, maintainers []string) error
+	GetPR(ctx context.Context, owner, repo string, number int) (*PullRequest, error)
+	GetTimeoutPRs(ctx context.Context, owner, repo string, timeout time.Duration) ([]*PullRequest, error)
+	SetPRProcessed(ctx context.Context, owner, repo string, number int, processed bool) error
+	SetPRMaintainers(ctx context.Context, owner, repo string, number int, maintainers []string) error
+	SetPRPendingReview(ctx context.Context, owner, repo string, number int, pendingReview bool) error
+	SetPRClosed(ctx context.Context, owner, repo string, number int, closedAt, mergedAt time.Time) error
+	SetPRDraft(ctx context.Context, owner, repo string, number int, draft bool) error
+	GetPreferences(ctx context.Context, handles []string) (map[string]*Preferences, error)
+	SetPreferences(ctx context.Context, preferences *Preferences) error
+	ReplacePRTickets(ctx context.Context, owner, repo string, number int, tickets []*Ticket) error
+	GetPRTickets(ctx context.Context, owner, repo string, number int) ([]*Ticket, error)
+	SetPRTicket(ctx context.Context, owner, repo string, number int, ticket *Ticket) error
+	CountPendingReviewPRs(ctx context.Context) (int, error)
+	Ping(ctx context.Context) error
+	SaveEvent(ctx context.Context, deliveryID, eventType string, payload []byte) (bool, error)
+	ResetEvent(ctx context.Context, deliveryID string) (*Event, error)
+	ClaimEvent(ctx context.Context, deliveryID string) (*Event, error)
+	GetPendingEvents(ctx context.Context) ([]*Event, error)
+	SetEventDone(ctx context.Context, deliveryID string) error
+	SetEventRetry(ctx context.Context, deliveryID string, attempts int, nextAttempt time.Time, lastError string) error
+	SetEventFailed(ctx context.Context, deliveryID string, attempts int, lastError string) error
 }
 
-func NewDBHelper() (DBHelper, error) {
-	// TODO: move os.Getenv to main
-	tracDB, err := sql.Open("postgres", os.Getenv("TRAC_DB"))
+func NewDBHelper(cfg *config.Config) (DBHelper, error) {
+	tracDB, err := sql.Open("postgres", cfg.DB.Trac)
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +82,7 @@ func NewDBHelper() (DBHelper, error) {
 		return nil, err
 	}
 
-	wwwDB, err := sql.Open("postgres", os.Getenv("WWW_DB"))
+	wwwDB, err := sql.Open("postgres", cfg.DB.WWW)
 	if err != nil {
 		return nil, err
 	}
@@ -61,7 +91,7 @@ func NewDBHelper() (DBHelper, error) {
 		return nil, err
 	}
 
-	prDB, err := sql.Open("postgres", os.Getenv("PR_DB"))
+	prDB, err := sql.Open("postgres", cfg.DB.PR)
 	if err != nil {
 		return nil, err
 	}
@@ -71,15 +101,72 @@ func NewDBHelper() (DBHelper, error) {
 	}
 	_, err = prDB.Exec(`CREATE TABLE IF NOT EXISTS pull_requests
 (
-	number INT PRIMARY KEY,
+	number INT NOT NULL,
 	created TIMESTAMP NOT NULL,
 	processed BOOLEAN NOT NULL,
 	pending_review BOOLEAN NOT NULL,
-	maintainers TEXT NOT NULL
+	maintainers TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	repo TEXT NOT NULL,
+	pending_since TIMESTAMP,
+	closed_at TIMESTAMP,
+	merged_at TIMESTAMP,
+	draft BOOLEAN NOT NULL DEFAULT false,
+	draft_since TIMESTAMP,
+	PRIMARY KEY (owner, repo, number)
+);`)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Repos) > 0 {
+		err = migratePullRequests(prDB, cfg.Repos[0].Owner, cfg.Repos[0].Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Columns added since the table was first created
+	for _, stmt := range []string{
+		"ALTER TABLE pull_requests ADD COLUMN IF NOT EXISTS pending_since TIMESTAMP",
+		"ALTER TABLE pull_requests ADD COLUMN IF NOT EXISTS closed_at TIMESTAMP",
+		"ALTER TABLE pull_requests ADD COLUMN IF NOT EXISTS merged_at TIMESTAMP",
+		"ALTER TABLE pull_requests ADD COLUMN IF NOT EXISTS draft BOOLEAN NOT NULL DEFAULT false",
+		"ALTER TABLE pull_requests ADD COLUMN IF NOT EXISTS draft_since TIMESTAMP",
+		"UPDATE pull_requests SET pending_since = created WHERE pending_since IS NULL",
+	} {
+		if _, err = prDB.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	_, err = prDB.Exec(`CREATE TABLE IF NOT EXISTS webhook_events
+(
+	delivery_id TEXT PRIMARY KEY,
+	event_type TEXT NOT NULL,
+	payload BYTEA NOT NULL,
+	received TIMESTAMP NOT NULL,
+	status TEXT NOT NULL,
+	attempts INT NOT NULL,
+	next_attempt TIMESTAMP NOT NULL,
+	last_error TEXT NOT NULL
 );`)
 	if err != nil {
 		return nil, err
 	}
+	// Deliveries claimed by a previous run that did not finish them
+	_, err = prDB.Exec("UPDATE webhook_events SET status = $1 WHERE status = $2", EventPending, EventRunning)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = prDB.Exec(createPreferencesTable); err != nil {
+		return nil, err
+	}
+	for _, stmt := range alterPreferencesTable {
+		if _, err = prDB.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = prDB.Exec(createTicketsTable); err != nil {
+		return nil, err
+	}
 
 	return &sqlDBHelper{
 		tracDB: tracDB,
@@ -88,13 +175,59 @@ func NewDBHelper() (DBHelper, error) {
 	}, nil
 }
 
+// migratePullRequests adds the owner and repo columns to a pull_requests
+// table created when the bot only served one repository, assigning its rows
+// to owner/repo.
+func migratePullRequests(prDB *sql.DB, owner, repo string) error {
+	hasOwner := false
+	err := prDB.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.columns " +
+		"WHERE table_name = 'pull_requests' AND column_name = 'owner')").Scan(&hasOwner)
+	if err != nil || hasOwner {
+		return err
+	}
+	log.Println("Migrating pull_requests to " + owner + "/" + repo)
+	tx, err := prDB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"ALTER TABLE pull_requests ADD COLUMN owner TEXT NOT NULL DEFAULT " + pq.QuoteLiteral(owner),
+		"ALTER TABLE pull_requests ADD COLUMN repo TEXT NOT NULL DEFAULT " + pq.QuoteLiteral(repo),
+		"ALTER TABLE pull_requests ALTER COLUMN owner DROP DEFAULT",
+		"ALTER TABLE pull_requests ALTER COLUMN repo DROP DEFAULT",
+		"ALTER TABLE pull_requests DROP CONSTRAINT pull_requests_pkey",
+		"ALTER TABLE pull_requests ADD PRIMARY KEY (owner, repo, number)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 type sqlDBHelper struct {
 	tracDB, wwwDB, prDB *sql.DB
 }
 
-func (sqlDB *sqlDBHelper) GetGitHubHandle(email string) (string, error) {
+// Ping checks that the Trac, PortIndex and PR databases are reachable.
+func (sqlDB *sqlDBHelper) Ping(ctx context.Context) error {
+	if err := sqlDB.tracDB.PingContext(ctx); err != nil {
+		return errors.New("TRAC_DB: " + err.Error())
+	}
+	if err := sqlDB.wwwDB.PingContext(ctx); err != nil {
+		return errors.New("WWW_DB: " + err.Error())
+	}
+	if err := sqlDB.prDB.PingContext(ctx); err != nil {
+		return errors.New("PR_DB: " + err.Error())
+	}
+	return nil
+}
+
+func (sqlDB *sqlDBHelper) GetGitHubHandle(ctx context.Context, email string) (string, error) {
+	defer metrics.ObserveDBQuery("GetGitHubHandle", time.Now())
 	sid := ""
-	err := sqlDB.tracDB.QueryRow("SELECT sid "+
+	err := sqlDB.tracDB.QueryRowContext(ctx, "SELECT sid "+
 		"FROM trac_macports.session_attribute "+
 		"WHERE value = $1 "+
 		"AND name = 'email' "+
@@ -108,8 +241,9 @@ func (sqlDB *sqlDBHelper) GetGitHubHandle(email string) (string, error) {
 }
 
 // GetPortMaintainer returns the maintainers of a port
-func (sqlDB *sqlDBHelper) GetPortMaintainer(port string) (*PortMaintainer, error) {
-	rows, err := sqlDB.wwwDB.Query("SELECT maintainer, is_primary "+
+func (sqlDB *sqlDBHelper) GetPortMaintainer(ctx context.Context, port string) (*PortMaintainer, error) {
+	defer metrics.ObserveDBQuery("GetPortMaintainer", time.Now())
+	rows, err := sqlDB.wwwDB.QueryContext(ctx, "SELECT maintainer, is_primary "+
 		"FROM public.maintainers "+
 		"WHERE portfile = $1", port)
 	if err != nil {
@@ -136,9 +270,9 @@ func (sqlDB *sqlDBHelper) GetPortMaintainer(port string) (*PortMaintainer, error
 			continue
 		}
 		if isPrimary {
-			maintainer.Primary = sqlDB.parseMaintainer(maintainerCursor)
+			maintainer.Primary = sqlDB.parseMaintainer(ctx, maintainerCursor)
 		} else {
-			maintainer.Others = append(maintainer.Others, sqlDB.parseMaintainer(maintainerCursor))
+			maintainer.Others = append(maintainer.Others, sqlDB.parseMaintainer(ctx, maintainerCursor))
 		}
 	}
 
@@ -159,42 +293,70 @@ func (sqlDB *sqlDBHelper) GetPortMaintainer(port string) (*PortMaintainer, error
 	return maintainer, nil
 }
 
-func (sqlDB *sqlDBHelper) NewPR(number int, maintainers []string) error {
-	_, err := sqlDB.prDB.Exec("INSERT INTO pull_requests VALUES ($1, $2, $3, $4, $5)",
-		number, time.Now(), false, false, strings.Join(maintainers, " "))
+func (sqlDB *sqlDBHelper) NewPR(ctx context.Context, owner, repo string, number int, maintainers []string) error {
+	defer metrics.ObserveDBQuery("NewPR", time.Now())
+	now := time.Now()
+	_, err := sqlDB.prDB.ExecContext(ctx, "INSERT INTO pull_requests "+
+		"(owner, repo, number, created, processed, pending_review, pending_since, maintainers) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		owner, repo, number, now, false, false, now, strings.Join(maintainers, " "))
 	return err
 }
 
-func (sqlDB *sqlDBHelper) GetPR(number int) (*PullRequest, error) {
+const pullRequestColumns = "owner, repo, number, processed, pending_review, pending_since, maintainers, draft, closed_at, merged_at"
+
+// scanPullRequest scans a row of pullRequestColumns.
+func scanPullRequest(row interface{ Scan(...interface{}) error }) (*PullRequest, error) {
 	pr := new(PullRequest)
 	var maintainerString string
-	err := sqlDB.prDB.QueryRow(
-		"SELECT number, processed, pending_review, maintainers FROM pull_requests WHERE number = $1", number).
-		Scan(&pr.Number, &pr.Processed, &pr.PendingReview, &maintainerString)
+	var pendingSince, closedAt, mergedAt sql.NullTime
+	err := row.Scan(&pr.Owner, &pr.Repo, &pr.Number, &pr.Processed, &pr.PendingReview, &pendingSince,
+		&maintainerString, &pr.Draft, &closedAt, &mergedAt)
 	if err != nil {
 		return nil, err
 	}
-	pr.Maintainers = strings.Split(maintainerString, " ")
+	pr.PendingSince = pendingSince.Time
+	pr.ClosedAt = closedAt.Time
+	pr.MergedAt = mergedAt.Time
+	pr.Maintainers = strings.Fields(maintainerString)
 	return pr, nil
 }
 
-func (sqlDB *sqlDBHelper) GetTimeoutPRs() ([]*PullRequest, error) {
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (sqlDB *sqlDBHelper) GetPR(ctx context.Context, owner, repo string, number int) (*PullRequest, error) {
+	defer metrics.ObserveDBQuery("GetPR", time.Now())
+	return scanPullRequest(sqlDB.prDB.QueryRowContext(ctx,
+		"SELECT "+pullRequestColumns+" FROM pull_requests "+
+			"WHERE owner = $1 AND repo = $2 AND number = $3", owner, repo, number))
+}
+
+// GetTimeoutPRs returns the open PRs waiting for their maintainers for longer
+// than timeout, or whose maintainers are all away.
+func (sqlDB *sqlDBHelper) GetTimeoutPRs(ctx context.Context, owner, repo string, timeout time.Duration) ([]*PullRequest, error) {
+	defer metrics.ObserveDBQuery("GetTimeoutPRs", time.Now())
 	var prs []*PullRequest
-	rows, err := sqlDB.prDB.Query("SELECT number, processed, pending_review, maintainers "+
+	now := time.Now()
+	rows, err := sqlDB.prDB.QueryContext(ctx, "SELECT "+pullRequestColumns+" "+
 		"FROM pull_requests "+
-		"WHERE created <= $1 AND pending_review = true", time.Now().AddDate(0, 0, -3))
+		"WHERE owner = $2 AND repo = $3 AND pending_review = true AND NOT draft AND closed_at IS NULL "+
+		"AND (pending_since <= $4 OR (maintainers <> '' AND NOT EXISTS ("+
+		"SELECT 1 FROM unnest(string_to_array(maintainers, ' ')) AS m(handle) "+
+		"WHERE m.handle NOT IN ("+awayHandles+"))))",
+		now, owner, repo, now.Add(-timeout))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		pr := new(PullRequest)
-		var maintainerString string
-		if err := rows.Scan(&pr.Number, &pr.Processed, &pr.PendingReview, &maintainerString); err != nil {
+		pr, err := scanPullRequest(rows)
+		if err != nil {
 			return nil, err
 		}
-		pr.Maintainers = strings.Split(maintainerString, " ")
 		prs = append(prs, pr)
 	}
 
@@ -206,20 +368,77 @@ func (sqlDB *sqlDBHelper) GetTimeoutPRs() ([]*PullRequest, error) {
 	return prs, nil
 }
 
-func (sqlDB *sqlDBHelper) SetPRProcessed(number int, processed bool) error {
-	_, err := sqlDB.prDB.Exec("UPDATE pull_requests SET processed = $1 WHERE number = $2", processed, number)
+func (sqlDB *sqlDBHelper) SetPRProcessed(ctx context.Context, owner, repo string, number int, processed bool) error {
+	defer metrics.ObserveDBQuery("SetPRProcessed", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "UPDATE pull_requests SET processed = $1 "+
+		"WHERE owner = $2 AND repo = $3 AND number = $4", processed, owner, repo, number)
+	return err
+}
+
+// SetPRMaintainers replaces the maintainers notified about a PR.
+func (sqlDB *sqlDBHelper) SetPRMaintainers(ctx context.Context, owner, repo string, number int, maintainers []string) error {
+	defer metrics.ObserveDBQuery("SetPRMaintainers", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "UPDATE pull_requests SET maintainers = $1 "+
+		"WHERE owner = $2 AND repo = $3 AND number = $4", strings.Join(maintainers, " "), owner, repo, number)
 	return err
 }
 
-func (sqlDB *sqlDBHelper) SetPRPendingReview(number int, pendingReview bool) error {
-	_, err := sqlDB.prDB.Exec("UPDATE pull_requests SET pending_review = $1 WHERE number = $2", pendingReview, number)
+// SetPRPendingReview starts or stops waiting for a maintainer. Starting
+// restarts the maintainer timeout clock.
+func (sqlDB *sqlDBHelper) SetPRPendingReview(ctx context.Context, owner, repo string, number int, pendingReview bool) error {
+	defer metrics.ObserveDBQuery("SetPRPendingReview", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "UPDATE pull_requests SET pending_review = $1, "+
+		"pending_since = CASE WHEN $1::boolean THEN $2 ELSE pending_since END "+
+		"WHERE owner = $3 AND repo = $4 AND number = $5", pendingReview, time.Now(), owner, repo, number)
 	return err
 }
 
-func (sqlDB *sqlDBHelper) parseMaintainer(maintainerFullString string) *Maintainer {
+// SetPRClosed records when a PR was closed and merged, zero times meaning it
+// is open again. Closed PRs no longer wait for a maintainer.
+func (sqlDB *sqlDBHelper) SetPRClosed(ctx context.Context, owner, repo string, number int, closedAt, mergedAt time.Time) error {
+	defer metrics.ObserveDBQuery("SetPRClosed", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "UPDATE pull_requests SET closed_at = $1, merged_at = $2, "+
+		"pending_review = pending_review AND $1::timestamp IS NULL "+
+		"WHERE owner = $3 AND repo = $4 AND number = $5", nullTime(closedAt), nullTime(mergedAt), owner, repo, number)
+	return err
+}
+
+// SetPRDraft pauses the maintainer timeout clock of a PR converted to a draft,
+// or resumes it where it stopped. It returns sql.ErrNoRows if the PR is not
+// tracked.
+func (sqlDB *sqlDBHelper) SetPRDraft(ctx context.Context, owner, repo string, number int, draft bool) error {
+	defer metrics.ObserveDBQuery("SetPRDraft", time.Now())
+	var result sql.Result
+	var err error
+	if draft {
+		result, err = sqlDB.prDB.ExecContext(ctx, "UPDATE pull_requests SET draft = true, "+
+			"draft_since = CASE WHEN draft THEN draft_since ELSE $1 END "+
+			"WHERE owner = $2 AND repo = $3 AND number = $4", time.Now(), owner, repo, number)
+	} else {
+		result, err = sqlDB.prDB.ExecContext(ctx, "UPDATE pull_requests SET draft = false, "+
+			"pending_since = CASE WHEN draft THEN pending_since + ($1::timestamp - draft_since) ELSE pending_since END "+
+			"WHERE owner = $2 AND repo = $3 AND number = $4", time.Now(), owner, repo, number)
+	}
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (sqlDB *sqlDBHelper) CountPendingReviewPRs(ctx context.Context) (int, error) {
+	defer metrics.ObserveDBQuery("CountPendingReviewPRs", time.Now())
+	count := 0
+	err := sqlDB.prDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM pull_requests WHERE pending_review = true").Scan(&count)
+	return count, err
+}
+
+func (sqlDB *sqlDBHelper) parseMaintainer(ctx context.Context, maintainerFullString string) *Maintainer {
 	maintainer := parseMaintainerString(maintainerFullString)
 	if maintainer.GithubHandle == "" && maintainer.Email != "" {
-		if handle, err := sqlDB.GetGitHubHandle(maintainer.Email); err == nil {
+		if handle, err := sqlDB.GetGitHubHandle(ctx, maintainer.Email); err == nil {
 			maintainer.GithubHandle = handle
 		}
 	}
@@ -1,6 +1,9 @@
 package db
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestParseMaintainerString(t *testing.T) {
 	l2dy := parseMaintainerString("l2dy @l2dy")
@@ -15,3 +18,30 @@ func TestParseMaintainerString(t *testing.T) {
 		t.Error("Expected deobfuscated email, got", jverne.Email)
 	}
 }
+
+func TestSimilarName(t *testing.T) {
+	for _, name := range []string{"upx", "UPX", "upx-devel", "py-upx", "py39-upx", "py39-Upx-devel"} {
+		if similarName(name) != "upx" {
+			t.Error("Expected upx, got", similarName(name), "for", name)
+		}
+	}
+	if similarName("upx-develop") != "upx-develop" {
+		t.Error("Expected only the -devel suffix to be ignored")
+	}
+}
+
+func TestPreferencesAway(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 11, d, 0, 0, 0, 0, time.UTC) }
+	p := DefaultPreferences("l2dy")
+	if p.Away(day(1)) {
+		t.Error("Expected not away by default")
+	}
+	p.AwayUntil = day(15)
+	if !p.Away(day(1)) || p.Away(day(15)) {
+		t.Error("Expected away until", p.AwayUntil)
+	}
+	p.AwayFrom = day(5)
+	if p.Away(day(1)) || !p.Away(day(5)) {
+		t.Error("Expected away from", p.AwayFrom)
+	}
+}
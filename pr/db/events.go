@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/macports/mpbot-github/pr/metrics"
+)
+
+// Status of a webhook delivery stored in webhook_events
+const (
+	EventPending = "pending"
+	EventRunning = "running"
+	EventDone    = "done"
+	EventFailed  = "failed"
+)
+
+// Event is a verified webhook delivery waiting to be (or already) processed.
+type Event struct {
+	DeliveryID string
+	Type       string
+	Payload    []byte
+	Attempts   int
+}
+
+// SaveEvent stores a delivery as pending so it survives restarts.
+// It returns false if the delivery was already stored.
+func (sqlDB *sqlDBHelper) SaveEvent(ctx context.Context, deliveryID, eventType string, payload []byte) (bool, error) {
+	defer metrics.ObserveDBQuery("SaveEvent", time.Now())
+	now := time.Now()
+	result, err := sqlDB.prDB.ExecContext(ctx, "INSERT INTO webhook_events VALUES ($1, $2, $3, $4, $5, $6, $7, $8) "+
+		"ON CONFLICT (delivery_id) DO NOTHING",
+		deliveryID, eventType, payload, now, EventPending, 0, now, "")
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return inserted > 0, nil
+}
+
+// ResetEvent marks a stored delivery as pending again regardless of its
+// status, so that it is processed once more.
+func (sqlDB *sqlDBHelper) ResetEvent(ctx context.Context, deliveryID string) (*Event, error) {
+	defer metrics.ObserveDBQuery("ResetEvent", time.Now())
+	event := new(Event)
+	err := sqlDB.prDB.QueryRowContext(ctx, "UPDATE webhook_events "+
+		"SET status = $1, attempts = 0, next_attempt = $2, last_error = '' "+
+		"WHERE delivery_id = $3 "+
+		"RETURNING delivery_id, event_type, payload, attempts", EventPending, time.Now(), deliveryID).
+		Scan(&event.DeliveryID, &event.Type, &event.Payload, &event.Attempts)
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// ClaimEvent marks a pending delivery that is due as running and returns it
+// as stored, so that it is processed only once however often it is
+// dispatched. It returns sql.ErrNoRows if the delivery is not pending, e.g.
+// because it was processed meanwhile.
+func (sqlDB *sqlDBHelper) ClaimEvent(ctx context.Context, deliveryID string) (*Event, error) {
+	defer metrics.ObserveDBQuery("ClaimEvent", time.Now())
+	event := new(Event)
+	err := sqlDB.prDB.QueryRowContext(ctx, "UPDATE webhook_events "+
+		"SET status = $1 "+
+		"WHERE delivery_id = $2 AND status = $3 AND next_attempt <= $4 "+
+		"RETURNING delivery_id, event_type, payload, attempts", EventRunning, deliveryID, EventPending, time.Now()).
+		Scan(&event.DeliveryID, &event.Type, &event.Payload, &event.Attempts)
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// GetPendingEvents returns pending deliveries that are due, oldest first.
+func (sqlDB *sqlDBHelper) GetPendingEvents(ctx context.Context) ([]*Event, error) {
+	defer metrics.ObserveDBQuery("GetPendingEvents", time.Now())
+	var events []*Event
+	rows, err := sqlDB.prDB.QueryContext(ctx, "SELECT delivery_id, event_type, payload, attempts "+
+		"FROM webhook_events "+
+		"WHERE status = $1 AND next_attempt <= $2 "+
+		"ORDER BY received", EventPending, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := new(Event)
+		if err := rows.Scan(&event.DeliveryID, &event.Type, &event.Payload, &event.Attempts); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return events, nil
+}
+
+func (sqlDB *sqlDBHelper) SetEventDone(ctx context.Context, deliveryID string) error {
+	defer metrics.ObserveDBQuery("SetEventDone", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "UPDATE webhook_events SET status = $1 WHERE delivery_id = $2", EventDone, deliveryID)
+	return err
+}
+
+func (sqlDB *sqlDBHelper) SetEventRetry(ctx context.Context, deliveryID string, attempts int, nextAttempt time.Time, lastError string) error {
+	defer metrics.ObserveDBQuery("SetEventRetry", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "UPDATE webhook_events SET status = $1, attempts = $2, next_attempt = $3, last_error = $4 WHERE delivery_id = $5",
+		EventPending, attempts, nextAttempt, lastError, deliveryID)
+	return err
+}
+
+func (sqlDB *sqlDBHelper) SetEventFailed(ctx context.Context, deliveryID string, attempts int, lastError string) error {
+	defer metrics.ObserveDBQuery("SetEventFailed", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "UPDATE webhook_events SET status = $1, attempts = $2, last_error = $3 WHERE delivery_id = $4",
+		EventFailed, attempts, lastError, deliveryID)
+	return err
+}
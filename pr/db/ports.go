@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/macports/mpbot-github/pr/metrics"
+
+	"github.com/lib/pq"
+)
+
+// Port is a port of the PortIndex DB.
+type Port struct {
+	Name string
+	// Directory of the Portfile in the ports tree, e.g. "archivers/upx"
+	Path string
+}
+
+var (
+	pythonPrefix = regexp.MustCompile(`^py[0-9]*-`)
+	develSuffix  = regexp.MustCompile(`-devel$`)
+)
+
+// similarName is the part of a port name compared to find duplicates, which
+// ignores case, a py*- prefix and a -devel suffix.
+func similarName(name string) string {
+	name = pythonPrefix.ReplaceAllString(strings.ToLower(name), "")
+	return develSuffix.ReplaceAllString(name, "")
+}
+
+// FindSimilarPorts returns the ports whose name is the same as name but for
+// case, a py*- prefix or a -devel suffix, sorted by name.
+func (sqlDB *sqlDBHelper) FindSimilarPorts(ctx context.Context, name string) ([]*Port, error) {
+	defer metrics.ObserveDBQuery("FindSimilarPorts", time.Now())
+	rows, err := sqlDB.wwwDB.QueryContext(ctx, "SELECT name, path "+
+		"FROM public.portfiles "+
+		"WHERE regexp_replace(regexp_replace(lower(name), '^py[0-9]*-', ''), '-devel$', '') = $1 "+
+		"ORDER BY name", similarName(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ports []*Port
+	for rows.Next() {
+		port := new(Port)
+		if err := rows.Scan(&port.Name, &port.Path); err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, rows.Err()
+}
+
+// Dependents are the ports depending on a Portfile in the PortIndex DB.
+type Dependents struct {
+	// Ports of the Portfile, i.e. the port and its subports, sorted
+	Subports []string
+	// Ports depending on one of them directly, sorted
+	Direct []string
+	// Ports depending on one of them directly or through other ports,
+	// sorted
+	Transitive []string
+}
+
+// GetDependents returns the ports depending on port or on one of its
+// subports, of any dependency type.
+func (sqlDB *sqlDBHelper) GetDependents(ctx context.Context, port string) (*Dependents, error) {
+	defer metrics.ObserveDBQuery("GetDependents", time.Now())
+	dependents := new(Dependents)
+	rows, err := sqlDB.wwwDB.QueryContext(ctx, "SELECT name FROM public.portfiles "+
+		"WHERE path = (SELECT path FROM public.portfiles WHERE name = $1) "+
+		"ORDER BY name", port)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		dependents.Subports = append(dependents.Subports, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(dependents.Subports) == 0 {
+		dependents.Subports = []string{port}
+	}
+
+	// The port of each dependency, the last part of e.g. "port:zlib" or
+	// "lib:libz:zlib", is computed once in deps, which is materialized as it
+	// is referenced twice, instead of in every step. Direct dependents are
+	// flagged in the first step. UNION drops rows found again, which ends
+	// the recursion on cycles.
+	rows, err = sqlDB.wwwDB.QueryContext(ctx, "WITH RECURSIVE "+
+		"deps AS ("+
+		"SELECT portfile, regexp_replace(library, '^.*:', '') AS port FROM public.dependencies"+
+		"), "+
+		"dependents(name, direct) AS ("+
+		"SELECT portfile, true FROM deps WHERE port = ANY($1) "+
+		"UNION "+
+		"SELECT deps.portfile, false FROM deps JOIN dependents ON deps.port = dependents.name"+
+		") "+
+		"SELECT name, bool_or(direct) FROM dependents WHERE NOT name = ANY($1) "+
+		"GROUP BY name ORDER BY name", pq.Array(dependents.Subports))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var direct bool
+		if err := rows.Scan(&name, &direct); err != nil {
+			return nil, err
+		}
+		if direct {
+			dependents.Direct = append(dependents.Direct, name)
+		}
+		dependents.Transitive = append(dependents.Transitive, name)
+	}
+	return dependents, rows.Err()
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/macports/mpbot-github/pr/metrics"
+)
+
+// Preferences of a maintainer for being notified of PRs, stored in
+// maintainer_preferences.
+type Preferences struct {
+	Handle string
+	// Assign the maintainer to PRs in addition to mentioning them
+	Assign bool
+	// Notify the maintainer of PRs changing their openmaintainer ports
+	OpenMaintainer bool
+	// Mention the number of ports instead of listing them if a PR changes
+	// more than this many of them, 0 to always list them
+	GroupAbove int
+	// Period during which the maintainer is away, zero times if not set.
+	// AwayFrom is optional.
+	AwayFrom  time.Time
+	AwayUntil time.Time
+}
+
+// Away reports whether the maintainer is away at t.
+func (p *Preferences) Away(t time.Time) bool {
+	return t.Before(p.AwayUntil) && !t.Before(p.AwayFrom)
+}
+
+// DefaultPreferences returns the preferences of a maintainer who did not
+// set any.
+func DefaultPreferences(handle string) *Preferences {
+	return &Preferences{
+		Handle:         handle,
+		Assign:         true,
+		OpenMaintainer: true,
+	}
+}
+
+const createPreferencesTable = `CREATE TABLE IF NOT EXISTS maintainer_preferences
+(
+	handle TEXT PRIMARY KEY,
+	assign BOOLEAN NOT NULL,
+	openmaintainer BOOLEAN NOT NULL,
+	group_above INT NOT NULL,
+	updated TIMESTAMP NOT NULL,
+	away_from TIMESTAMP,
+	away_until TIMESTAMP
+);`
+
+// Columns added since the table was first created
+var alterPreferencesTable = []string{
+	"ALTER TABLE maintainer_preferences ADD COLUMN IF NOT EXISTS away_from TIMESTAMP",
+	"ALTER TABLE maintainer_preferences ADD COLUMN IF NOT EXISTS away_until TIMESTAMP",
+}
+
+// awayHandles selects the handles of maintainers away at $1.
+const awayHandles = "SELECT handle FROM maintainer_preferences " +
+	"WHERE away_until > $1 AND (away_from IS NULL OR away_from <= $1)"
+
+// GetPreferences returns the preferences of each of handles, the default
+// ones for maintainers who did not set any.
+func (sqlDB *sqlDBHelper) GetPreferences(ctx context.Context, handles []string) (map[string]*Preferences, error) {
+	defer metrics.ObserveDBQuery("GetPreferences", time.Now())
+	preferences := make(map[string]*Preferences, len(handles))
+	for _, handle := range handles {
+		preferences[handle] = DefaultPreferences(handle)
+	}
+	if len(handles) == 0 {
+		return preferences, nil
+	}
+	rows, err := sqlDB.prDB.QueryContext(ctx, "SELECT handle, assign, openmaintainer, group_above, away_from, away_until "+
+		"FROM maintainer_preferences "+
+		"WHERE handle = ANY($1)", pq.Array(handles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := new(Preferences)
+		var awayFrom, awayUntil sql.NullTime
+		if err := rows.Scan(&p.Handle, &p.Assign, &p.OpenMaintainer, &p.GroupAbove, &awayFrom, &awayUntil); err != nil {
+			return nil, err
+		}
+		p.AwayFrom = awayFrom.Time
+		p.AwayUntil = awayUntil.Time
+		preferences[p.Handle] = p
+	}
+	return preferences, rows.Err()
+}
+
+// SetPreferences stores the preferences of a maintainer.
+func (sqlDB *sqlDBHelper) SetPreferences(ctx context.Context, preferences *Preferences) error {
+	defer metrics.ObserveDBQuery("SetPreferences", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "INSERT INTO maintainer_preferences "+
+		"(handle, assign, openmaintainer, group_above, updated, away_from, away_until) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7) "+
+		"ON CONFLICT (handle) DO UPDATE "+
+		"SET assign = $2, openmaintainer = $3, group_above = $4, updated = $5, away_from = $6, away_until = $7",
+		preferences.Handle, preferences.Assign, preferences.OpenMaintainer, preferences.GroupAbove, time.Now(),
+		nullTime(preferences.AwayFrom), nullTime(preferences.AwayUntil))
+	return err
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/macports/mpbot-github/pr/metrics"
+
+	"github.com/lib/pq"
+)
+
+// Ticket is a Trac ticket referenced by a PR, stored in pr_tickets.
+type Ticket struct {
+	Number int
+	// Whether the PR fixes the ticket
+	Close bool
+	// Whether the ticket links back to the PR
+	Linked bool
+	// Whether the ticket was updated for the merge of the PR
+	Merged bool
+}
+
+const createTicketsTable = `CREATE TABLE IF NOT EXISTS pr_tickets
+(
+	owner TEXT NOT NULL,
+	repo TEXT NOT NULL,
+	number INT NOT NULL,
+	ticket INT NOT NULL,
+	close BOOLEAN NOT NULL,
+	linked BOOLEAN NOT NULL DEFAULT false,
+	merged BOOLEAN NOT NULL DEFAULT false,
+	PRIMARY KEY (owner, repo, number, ticket)
+);`
+
+// ReplacePRTickets records the tickets currently referenced by a PR,
+// forgetting those no longer referenced. Tickets already recorded keep
+// whether they were updated, but take whether the PR closes them from
+// tickets.
+func (sqlDB *sqlDBHelper) ReplacePRTickets(ctx context.Context, owner, repo string, number int, tickets []*Ticket) error {
+	defer metrics.ObserveDBQuery("ReplacePRTickets", time.Now())
+	tx, err := sqlDB.prDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	numbers := make([]int64, 0, len(tickets))
+	for _, ticket := range tickets {
+		numbers = append(numbers, int64(ticket.Number))
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM pr_tickets "+
+		"WHERE owner = $1 AND repo = $2 AND number = $3 AND NOT ticket = ANY($4)",
+		owner, repo, number, pq.Array(numbers))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, ticket := range tickets {
+		_, err := tx.ExecContext(ctx, "INSERT INTO pr_tickets "+
+			"(owner, repo, number, ticket, close) "+
+			"VALUES ($1, $2, $3, $4, $5) "+
+			"ON CONFLICT (owner, repo, number, ticket) DO UPDATE "+
+			"SET close = excluded.close",
+			owner, repo, number, ticket.Number, ticket.Close)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPRTickets returns the tickets referenced by a PR, sorted by number.
+func (sqlDB *sqlDBHelper) GetPRTickets(ctx context.Context, owner, repo string, number int) ([]*Ticket, error) {
+	defer metrics.ObserveDBQuery("GetPRTickets", time.Now())
+	rows, err := sqlDB.prDB.QueryContext(ctx, "SELECT ticket, close, linked, merged "+
+		"FROM pr_tickets "+
+		"WHERE owner = $1 AND repo = $2 AND number = $3 "+
+		"ORDER BY ticket",
+		owner, repo, number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tickets []*Ticket
+	for rows.Next() {
+		ticket := new(Ticket)
+		if err := rows.Scan(&ticket.Number, &ticket.Close, &ticket.Linked, &ticket.Merged); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, rows.Err()
+}
+
+// SetPRTicket stores whether a ticket was updated for a PR.
+func (sqlDB *sqlDBHelper) SetPRTicket(ctx context.Context, owner, repo string, number int, ticket *Ticket) error {
+	defer metrics.ObserveDBQuery("SetPRTicket", time.Now())
+	_, err := sqlDB.prDB.ExecContext(ctx, "UPDATE pr_tickets "+
+		"SET linked = $5, merged = $6 "+
+		"WHERE owner = $1 AND repo = $2 AND number = $3 AND ticket = $4",
+		owner, repo, number, ticket.Number, ticket.Linked, ticket.Merged)
+	return err
+}
@@ -0,0 +1,259 @@
+package githubapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// GitHub accepts app JWTs valid for at most 10 minutes
+	appJWTLifetime = 9 * time.Minute
+	// Installation tokens are replaced this long before they expire
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// appAuth authenticates as a GitHub App and hands out installation tokens.
+type appAuth struct {
+	appID int64
+	key   *rsa.PrivateKey
+	// Client authenticated with app JWTs
+	apps *github.Client
+	ctx  context.Context
+
+	tokenSources     map[int64]oauth2.TokenSource
+	tokenSourcesLock sync.Mutex
+}
+
+func newAppAuth(appID int64, privateKeyPEM []byte, baseURL *url.URL) (*appAuth, error) {
+	key, err := parsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	auth := &appAuth{
+		appID:        appID,
+		key:          key,
+		ctx:          context.Background(),
+		tokenSources: make(map[int64]oauth2.TokenSource),
+	}
+	auth.apps = github.NewClient(&http.Client{Transport: &appTransport{auth: auth}})
+	if baseURL != nil {
+		auth.apps.BaseURL = baseURL
+	}
+	return auth, nil
+}
+
+func parsePrivateKey(privateKeyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("app private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("app private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// jwt returns a new RS256 signed JWT identifying the app.
+func (auth *appAuth) jwt() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{
+		// Allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": auth.appID,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, auth.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// tokenSource returns a cached source of tokens for an installation of the
+// app, which are refreshed before they expire.
+func (auth *appAuth) tokenSource(installationID int64) oauth2.TokenSource {
+	auth.tokenSourcesLock.Lock()
+	defer auth.tokenSourcesLock.Unlock()
+	ts, ok := auth.tokenSources[installationID]
+	if !ok {
+		ts = oauth2.ReuseTokenSource(nil, &installationTokenSource{auth: auth, installationID: installationID})
+		auth.tokenSources[installationID] = ts
+	}
+	return ts
+}
+
+// installationID looks up the installation of the app on an org.
+func (auth *appAuth) installationID(org string) (int64, error) {
+	installation, _, err := auth.apps.Apps.FindOrganizationInstallation(auth.ctx, org)
+	if err != nil {
+		return 0, err
+	}
+	return installation.GetID(), nil
+}
+
+type installationTokenSource struct {
+	auth           *appAuth
+	installationID int64
+}
+
+func (ts *installationTokenSource) Token() (*oauth2.Token, error) {
+	token, _, err := ts.auth.apps.Apps.CreateInstallationToken(ts.auth.ctx, ts.installationID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "token",
+		Expiry:      token.GetExpiresAt().Add(-tokenRefreshMargin),
+	}, nil
+}
+
+// appTransport authenticates requests with a fresh app JWT.
+type appTransport struct {
+	auth *appAuth
+}
+
+func (t *appTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	jwt, err := t.auth.jwt()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// NewAppClient returns a Client authenticated as an installation of a GitHub
+// App instead of with a personal access token. If installationID is 0, the
+// installation on each of owners is looked up and used for calls concerning
+// that owner.
+func NewAppClient(appID, installationID int64, privateKeyPEM []byte, owners []string) (Client, error) {
+	return newAppClient(appID, installationID, privateKeyPEM, owners, nil)
+}
+
+func newAppClient(appID, installationID int64, privateKeyPEM []byte, owners []string, baseURL *url.URL) (Client, error) {
+	auth, err := newAppAuth(appID, privateKeyPEM, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if installationID != 0 {
+		return auth.installationClient(installationID, baseURL), nil
+	}
+	if len(owners) == 0 {
+		return nil, errors.New("no installation ID or owner to look it up")
+	}
+
+	router := &installationRouter{clients: make(map[string]Client)}
+	for _, owner := range owners {
+		installationID, err := auth.installationID(owner)
+		if err != nil {
+			return nil, errors.New("finding installation on " + owner + ": " + err.Error())
+		}
+		client := auth.installationClient(installationID, baseURL)
+		router.clients[owner] = client
+		if router.fallback == nil {
+			router.fallback = client
+		}
+	}
+	return router, nil
+}
+
+func (auth *appAuth) installationClient(installationID int64, baseURL *url.URL) Client {
+	ctx := context.Background()
+	client := github.NewClient(oauth2.NewClient(ctx, auth.tokenSource(installationID)))
+	if baseURL != nil {
+		client.BaseURL = baseURL
+	}
+	return &instrumentedClient{&githubClient{
+		Client: client,
+	}}
+}
+
+// installationRouter sends each call to the client of the app installation
+// on the owner it concerns.
+type installationRouter struct {
+	clients map[string]Client
+	// Used for calls not tied to an owner
+	fallback Client
+}
+
+func (router *installationRouter) client(owner string) Client {
+	if client, ok := router.clients[owner]; ok {
+		return client
+	}
+	return router.fallback
+}
+
+func (router *installationRouter) GetPullRequest(ctx context.Context, owner, repo string, number int) (*github.PullRequest, error) {
+	return router.client(owner).GetPullRequest(ctx, owner, repo, number)
+}
+
+func (router *installationRouter) ListChangedPortsAndFiles(ctx context.Context, owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error) {
+	return router.client(owner).ListChangedPortsAndFiles(ctx, owner, repo, number)
+}
+
+func (router *installationRouter) CreateComment(ctx context.Context, owner, repo string, number int, body *string) error {
+	return router.client(owner).CreateComment(ctx, owner, repo, number, body)
+}
+
+func (router *installationRouter) FindComment(ctx context.Context, owner, repo string, number int, author, marker string) (*github.IssueComment, error) {
+	return router.client(owner).FindComment(ctx, owner, repo, number, author, marker)
+}
+
+func (router *installationRouter) EditComment(ctx context.Context, owner, repo string, id int64, body *string) error {
+	return router.client(owner).EditComment(ctx, owner, repo, id, body)
+}
+
+func (router *installationRouter) AddAssignees(ctx context.Context, owner, repo string, number int, assignees []string) error {
+	return router.client(owner).AddAssignees(ctx, owner, repo, number, assignees)
+}
+
+func (router *installationRouter) ReplaceLabels(ctx context.Context, owner, repo string, number int, labels []string) error {
+	return router.client(owner).ReplaceLabels(ctx, owner, repo, number, labels)
+}
+
+func (router *installationRouter) ListCommits(ctx context.Context, owner, repo string, number int) ([]*github.RepositoryCommit, error) {
+	return router.client(owner).ListCommits(ctx, owner, repo, number)
+}
+
+func (router *installationRouter) ListCommitFiles(ctx context.Context, owner, repo, sha string) ([]string, error) {
+	return router.client(owner).ListCommitFiles(ctx, owner, repo, sha)
+}
+
+func (router *installationRouter) ListLabels(ctx context.Context, owner, repo string, number int) ([]string, error) {
+	return router.client(owner).ListLabels(ctx, owner, repo, number)
+}
+
+func (router *installationRouter) ListOrgMembers(ctx context.Context, org string) ([]*github.User, error) {
+	return router.client(org).ListOrgMembers(ctx, org)
+}
+
+func (router *installationRouter) GetRateLimit(ctx context.Context) (*github.Rate, error) {
+	return router.fallback.GetRateLimit(ctx)
+}
@@ -0,0 +1,103 @@
+package githubapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// verifyJWT checks an app JWT and returns its claims.
+func verifyJWT(t *testing.T, key *rsa.PublicKey, jwt string) map[string]int64 {
+	parts := strings.Split(jwt, ".")
+	if !assert.Len(t, parts, 3) {
+		return nil
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.NoError(t, err)
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.NoError(t, rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig))
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.NoError(t, err)
+	var claims map[string]int64
+	assert.NoError(t, json.Unmarshal(claimsJSON, &claims))
+	return claims
+}
+
+func TestAppClient(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	ctx := context.Background()
+	tokenLifetime := time.Hour
+	exchanges := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/macports/installation", func(w http.ResponseWriter, r *http.Request) {
+		claims := verifyJWT(t, &key.PublicKey, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		assert.Equal(t, int64(7), claims["iss"])
+		w.Write([]byte(`{"id": 42}`))
+	})
+	mux.HandleFunc("/app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		claims := verifyJWT(t, &key.PublicKey, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		assert.Equal(t, int64(7), claims["iss"])
+		assert.True(t, claims["exp"]-claims["iat"] <= int64(10*time.Minute/time.Second))
+		exchanges++
+		expires := time.Now().Add(tokenLifetime).UTC().Format(time.RFC3339)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "installation-token", "expires_at": "` + expires + `"}`))
+	})
+	mux.HandleFunc("/repos/macports/macports-ports/pulls/1", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token installation-token", r.Header.Get("Authorization"))
+		w.Write([]byte(`{"number": 1}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL, _ := url.Parse(server.URL + "/")
+
+	client, err := newAppClient(7, 0, keyPEM, []string{"macports"}, baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached until close to expiry
+	for i := 0; i < 3; i++ {
+		pr, err := client.GetPullRequest(ctx, "macports", "macports-ports", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, pr.GetNumber())
+	}
+	assert.Equal(t, 1, exchanges)
+
+	// Tokens expiring within the refresh margin are replaced
+	tokenLifetime = tokenRefreshMargin / 2
+	client, err = newAppClient(7, 42, keyPEM, nil, baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := client.GetPullRequest(ctx, "macports", "macports-ports", 1)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, exchanges)
+
+	_, err = NewAppClient(7, 42, []byte("not a key"), nil)
+	assert.Error(t, err)
+	_, err = newAppClient(7, 0, keyPEM, []string{"macports-staging"}, baseURL)
+	assert.Error(t, err)
+}
@@ -8,18 +8,27 @@ import (
 )
 
 type Client interface {
-	GetPullRequest(owner, repo string, number int) (*github.PullRequest, error)
-	ListChangedPortsAndFiles(owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error)
-	CreateComment(owner, repo string, number int, body *string) error
-	AddAssignees(owner, repo string, number int, assignees []string) error
-	ReplaceLabels(owner, repo string, number int, labels []string) error
-	ListLabels(owner, repo string, number int) ([]string, error)
-	ListOrgMembers(org string) ([]*github.User, error)
+	GetPullRequest(ctx context.Context, owner, repo string, number int) (*github.PullRequest, error)
+	ListChangedPortsAndFiles(ctx context.Context, owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error)
+	// ListCommits returns the commits of a PR, oldest first, without their
+	// files.
+	ListCommits(ctx context.Context, owner, repo string, number int) ([]*github.RepositoryCommit, error)
+	// ListCommitFiles returns the paths of the files a commit changes.
+	ListCommitFiles(ctx context.Context, owner, repo, sha string) ([]string, error)
+	CreateComment(ctx context.Context, owner, repo string, number int, body *string) error
+	// FindComment returns the first comment by author of an issue or PR
+	// containing marker, or nil if there is none. See IsLogin for author.
+	FindComment(ctx context.Context, owner, repo string, number int, author, marker string) (*github.IssueComment, error)
+	EditComment(ctx context.Context, owner, repo string, id int64, body *string) error
+	AddAssignees(ctx context.Context, owner, repo string, number int, assignees []string) error
+	ReplaceLabels(ctx context.Context, owner, repo string, number int, labels []string) error
+	ListLabels(ctx context.Context, owner, repo string, number int) ([]string, error)
+	ListOrgMembers(ctx context.Context, org string) ([]*github.User, error)
+	GetRateLimit(ctx context.Context) (*github.Rate, error)
 }
 
 type githubClient struct {
 	*github.Client
-	ctx context.Context
 }
 
 func NewClient(botSecret string) Client {
@@ -29,8 +38,17 @@ func NewClient(botSecret string) Client {
 	)
 	tc := oauth2.NewClient(ctx, ts)
 
-	return &githubClient{
+	return &instrumentedClient{&githubClient{
 		Client: github.NewClient(tc),
-		ctx:    ctx,
+	}}
+}
+
+// GetRateLimit returns the core API rate limit of the token. It fails if the
+// token is invalid and does not count against the limit itself.
+func (client *githubClient) GetRateLimit(ctx context.Context) (*github.Rate, error) {
+	limits, _, err := client.RateLimits(ctx)
+	if err != nil {
+		return nil, err
 	}
+	return limits.GetCore(), nil
 }
@@ -0,0 +1,123 @@
+package githubapi
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+)
+
+// SideEffect is a mutating call a DryRunClient recorded instead of making.
+type SideEffect struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Owner     string    `json:"owner"`
+	Repo      string    `json:"repo"`
+	Number    int       `json:"number"`
+	CommentID int64     `json:"comment_id,omitempty"`
+	Body      string    `json:"body,omitempty"`
+	Assignees []string  `json:"assignees,omitempty"`
+	Labels    []string  `json:"labels,omitempty"`
+}
+
+// DryRunClient passes read calls to the Client it wraps and only logs the
+// calls that would modify GitHub. The latest side effects are kept in a ring
+// buffer.
+type DryRunClient struct {
+	client Client
+
+	effects     []SideEffect
+	next        int
+	full        bool
+	effectsLock sync.Mutex
+}
+
+// NewDryRunClient wraps client, keeping the last size side effects.
+func NewDryRunClient(client Client, size int) *DryRunClient {
+	return &DryRunClient{
+		client:  client,
+		effects: make([]SideEffect, size),
+	}
+}
+
+func (c *DryRunClient) record(effect SideEffect) {
+	effect.Time = time.Now()
+	if line, err := json.Marshal(effect); err == nil {
+		log.Println("dry run: " + string(line))
+	}
+
+	c.effectsLock.Lock()
+	defer c.effectsLock.Unlock()
+	c.effects[c.next] = effect
+	c.next = (c.next + 1) % len(c.effects)
+	if c.next == 0 {
+		c.full = true
+	}
+}
+
+// SideEffects returns the recorded side effects, oldest first.
+func (c *DryRunClient) SideEffects() []SideEffect {
+	c.effectsLock.Lock()
+	defer c.effectsLock.Unlock()
+	if !c.full {
+		return append([]SideEffect(nil), c.effects[:c.next]...)
+	}
+	return append(append([]SideEffect(nil), c.effects[c.next:]...), c.effects[:c.next]...)
+}
+
+func (c *DryRunClient) GetPullRequest(ctx context.Context, owner, repo string, number int) (*github.PullRequest, error) {
+	return c.client.GetPullRequest(ctx, owner, repo, number)
+}
+
+func (c *DryRunClient) ListChangedPortsAndFiles(ctx context.Context, owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error) {
+	return c.client.ListChangedPortsAndFiles(ctx, owner, repo, number)
+}
+
+func (c *DryRunClient) CreateComment(ctx context.Context, owner, repo string, number int, body *string) error {
+	c.record(SideEffect{Method: "CreateComment", Owner: owner, Repo: repo, Number: number, Body: *body})
+	return nil
+}
+
+func (c *DryRunClient) FindComment(ctx context.Context, owner, repo string, number int, author, marker string) (*github.IssueComment, error) {
+	return c.client.FindComment(ctx, owner, repo, number, author, marker)
+}
+
+// EditComment records the comment edited, which cannot be mapped back to its
+// PR without another call.
+func (c *DryRunClient) EditComment(ctx context.Context, owner, repo string, id int64, body *string) error {
+	c.record(SideEffect{Method: "EditComment", Owner: owner, Repo: repo, CommentID: id, Body: *body})
+	return nil
+}
+
+func (c *DryRunClient) AddAssignees(ctx context.Context, owner, repo string, number int, assignees []string) error {
+	c.record(SideEffect{Method: "AddAssignees", Owner: owner, Repo: repo, Number: number, Assignees: append([]string(nil), assignees...)})
+	return nil
+}
+
+func (c *DryRunClient) ReplaceLabels(ctx context.Context, owner, repo string, number int, labels []string) error {
+	c.record(SideEffect{Method: "ReplaceLabels", Owner: owner, Repo: repo, Number: number, Labels: append([]string(nil), labels...)})
+	return nil
+}
+
+func (c *DryRunClient) ListCommits(ctx context.Context, owner, repo string, number int) ([]*github.RepositoryCommit, error) {
+	return c.client.ListCommits(ctx, owner, repo, number)
+}
+
+func (c *DryRunClient) ListCommitFiles(ctx context.Context, owner, repo, sha string) ([]string, error) {
+	return c.client.ListCommitFiles(ctx, owner, repo, sha)
+}
+
+func (c *DryRunClient) ListLabels(ctx context.Context, owner, repo string, number int) ([]string, error) {
+	return c.client.ListLabels(ctx, owner, repo, number)
+}
+
+func (c *DryRunClient) ListOrgMembers(ctx context.Context, org string) ([]*github.User, error) {
+	return c.client.ListOrgMembers(ctx, org)
+}
+
+func (c *DryRunClient) GetRateLimit(ctx context.Context) (*github.Rate, error) {
+	return c.client.GetRateLimit(ctx)
+}
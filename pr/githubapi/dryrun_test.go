@@ -0,0 +1,42 @@
+package githubapi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunClient(t *testing.T) {
+	// Mutating calls must not reach the wrapped client
+	ctx := context.Background()
+	client := NewDryRunClient(nil, 3)
+	assert.Empty(t, client.SideEffects())
+
+	body := "Notifying maintainers"
+	assert.NoError(t, client.CreateComment(ctx, "macports", "macports-ports", 1, &body))
+	assert.NoError(t, client.AddAssignees(ctx, "macports", "macports-ports", 1, []string{"l2dy"}))
+	effects := client.SideEffects()
+	if assert.Len(t, effects, 2) {
+		assert.Equal(t, "CreateComment", effects[0].Method)
+		assert.Equal(t, body, effects[0].Body)
+		assert.Equal(t, []string{"l2dy"}, effects[1].Assignees)
+	}
+
+	// The oldest side effects are dropped
+	for number := 2; number <= 4; number++ {
+		assert.NoError(t, client.ReplaceLabels(ctx, "macports", "macports-ports", number, []string{"type: update"}))
+	}
+	effects = client.SideEffects()
+	if assert.Len(t, effects, 3) {
+		for i, effect := range effects {
+			assert.Equal(t, "ReplaceLabels", effect.Method)
+			assert.Equal(t, i+2, effect.Number)
+		}
+	}
+
+	assert.NoError(t, client.EditComment(ctx, "macports", "macports-ports", 42, &body))
+	effects = client.SideEffects()
+	assert.Equal(t, "EditComment", effects[2].Method)
+	assert.Equal(t, int64(42), effects[2].CommentID)
+}
@@ -0,0 +1,84 @@
+package githubapi
+
+import (
+	"context"
+	"github.com/google/go-github/v28/github"
+	"github.com/macports/mpbot-github/pr/metrics"
+)
+
+// instrumentedClient counts calls and errors of the Client it wraps.
+type instrumentedClient struct {
+	client Client
+}
+
+func (c *instrumentedClient) GetPullRequest(ctx context.Context, owner, repo string, number int) (*github.PullRequest, error) {
+	pr, err := c.client.GetPullRequest(ctx, owner, repo, number)
+	metrics.ObserveGitHubCall("GetPullRequest", err)
+	return pr, err
+}
+
+func (c *instrumentedClient) ListChangedPortsAndFiles(ctx context.Context, owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error) {
+	ports, commitFiles, err = c.client.ListChangedPortsAndFiles(ctx, owner, repo, number)
+	metrics.ObserveGitHubCall("ListChangedPortsAndFiles", err)
+	return
+}
+
+func (c *instrumentedClient) CreateComment(ctx context.Context, owner, repo string, number int, body *string) error {
+	err := c.client.CreateComment(ctx, owner, repo, number, body)
+	metrics.ObserveGitHubCall("CreateComment", err)
+	return err
+}
+
+func (c *instrumentedClient) FindComment(ctx context.Context, owner, repo string, number int, author, marker string) (*github.IssueComment, error) {
+	comment, err := c.client.FindComment(ctx, owner, repo, number, author, marker)
+	metrics.ObserveGitHubCall("FindComment", err)
+	return comment, err
+}
+
+func (c *instrumentedClient) EditComment(ctx context.Context, owner, repo string, id int64, body *string) error {
+	err := c.client.EditComment(ctx, owner, repo, id, body)
+	metrics.ObserveGitHubCall("EditComment", err)
+	return err
+}
+
+func (c *instrumentedClient) AddAssignees(ctx context.Context, owner, repo string, number int, assignees []string) error {
+	err := c.client.AddAssignees(ctx, owner, repo, number, assignees)
+	metrics.ObserveGitHubCall("AddAssignees", err)
+	return err
+}
+
+func (c *instrumentedClient) ReplaceLabels(ctx context.Context, owner, repo string, number int, labels []string) error {
+	err := c.client.ReplaceLabels(ctx, owner, repo, number, labels)
+	metrics.ObserveGitHubCall("ReplaceLabels", err)
+	return err
+}
+
+func (c *instrumentedClient) ListCommits(ctx context.Context, owner, repo string, number int) ([]*github.RepositoryCommit, error) {
+	commits, err := c.client.ListCommits(ctx, owner, repo, number)
+	metrics.ObserveGitHubCall("ListCommits", err)
+	return commits, err
+}
+
+func (c *instrumentedClient) ListCommitFiles(ctx context.Context, owner, repo, sha string) ([]string, error) {
+	files, err := c.client.ListCommitFiles(ctx, owner, repo, sha)
+	metrics.ObserveGitHubCall("ListCommitFiles", err)
+	return files, err
+}
+
+func (c *instrumentedClient) ListLabels(ctx context.Context, owner, repo string, number int) ([]string, error) {
+	labels, err := c.client.ListLabels(ctx, owner, repo, number)
+	metrics.ObserveGitHubCall("ListLabels", err)
+	return labels, err
+}
+
+func (c *instrumentedClient) ListOrgMembers(ctx context.Context, org string) ([]*github.User, error) {
+	users, err := c.client.ListOrgMembers(ctx, org)
+	metrics.ObserveGitHubCall("ListOrgMembers", err)
+	return users, err
+}
+
+func (c *instrumentedClient) GetRateLimit(ctx context.Context) (*github.Rate, error) {
+	rate, err := c.client.GetRateLimit(ctx)
+	metrics.ObserveGitHubCall("GetRateLimit", err)
+	return rate, err
+}
@@ -1,12 +1,16 @@
 package githubapi
 
-import "github.com/google/go-github/v28/github"
+import (
+	"context"
 
-func (client *githubClient) ListOrgMembers(org string) ([]*github.User, error) {
+	"github.com/google/go-github/v28/github"
+)
+
+func (client *githubClient) ListOrgMembers(ctx context.Context, org string) ([]*github.User, error) {
 	var allMembers []*github.User
 	opt := &github.ListMembersOptions{ListOptions: github.ListOptions{PerPage: 30}}
 	for {
-		users, resp, err := client.Organizations.ListMembers(client.ctx, org, opt)
+		users, resp, err := client.Organizations.ListMembers(ctx, org, opt)
 		if err != nil {
 			return nil, err
 		}
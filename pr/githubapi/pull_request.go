@@ -3,21 +3,39 @@ package githubapi
 import (
 	"context"
 	"regexp"
+	"strings"
 
 	"github.com/google/go-github/v28/github"
 )
 
-func (client *githubClient) GetPullRequest(owner, repo string, number int) (*github.PullRequest, error) {
-	pr, _, err := client.PullRequests.Get(context.Background(), owner, repo, number)
+func (client *githubClient) GetPullRequest(ctx context.Context, owner, repo string, number int) (*github.PullRequest, error) {
+	pr, _, err := client.PullRequests.Get(ctx, owner, repo, number)
 	return pr, err
 }
 
-func (client *githubClient) ListChangedPortsAndFiles(owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error) {
+var portGrep = regexp.MustCompile(`[^\._/][^/]*/([^/]+)/(Portfile|files/)`) // Ignore hidden and _* top directories
+
+// PortOfPath returns the port a file belongs to, or "" if it is not in a
+// port directory.
+func PortOfPath(path string) string {
+	if match := portGrep.FindStringSubmatch(path); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// IsLogin reports whether login is name's, as a user or as a GitHub App,
+// whose comments are by "name[bot]".
+func IsLogin(login, name string) bool {
+	return strings.EqualFold(login, name) || strings.EqualFold(login, name+"[bot]")
+}
+
+func (client *githubClient) ListChangedPortsAndFiles(ctx context.Context, owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error) {
 	var allFiles []*github.CommitFile
 	opt := &github.ListOptions{PerPage: 30}
 	for {
 		files, resp, err := client.PullRequests.ListFiles(
-			context.Background(),
+			ctx,
 			owner,
 			repo,
 			number,
@@ -33,8 +51,6 @@ func (client *githubClient) ListChangedPortsAndFiles(owner, repo string, number
 		opt.Page = resp.NextPage
 	}
 
-	portGrep := regexp.MustCompile(`[^\._/][^/]*/([^/]+)/(Portfile|files/)`) // Ignore hidden and _* top directories
-
 	portsFound := make(map[string]int)
 	for _, file := range allFiles {
 		fileName := *file.Filename
@@ -58,9 +74,38 @@ func (client *githubClient) ListChangedPortsAndFiles(owner, repo string, number
 	return
 }
 
-func (client *githubClient) CreateComment(owner, repo string, number int, body *string) error {
+func (client *githubClient) ListCommits(ctx context.Context, owner, repo string, number int) ([]*github.RepositoryCommit, error) {
+	var allCommits []*github.RepositoryCommit
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		commits, resp, err := client.PullRequests.ListCommits(ctx, owner, repo, number, opt)
+		if err != nil {
+			return nil, err
+		}
+		allCommits = append(allCommits, commits...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return allCommits, nil
+}
+
+func (client *githubClient) ListCommitFiles(ctx context.Context, owner, repo, sha string) ([]string, error) {
+	commit, _, err := client.Repositories.GetCommit(ctx, owner, repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(commit.Files))
+	for _, file := range commit.Files {
+		files = append(files, file.GetFilename())
+	}
+	return files, nil
+}
+
+func (client *githubClient) CreateComment(ctx context.Context, owner, repo string, number int, body *string) error {
 	_, _, err := client.Issues.CreateComment(
-		client.ctx,
+		ctx,
 		owner,
 		repo,
 		number,
@@ -69,9 +114,39 @@ func (client *githubClient) CreateComment(owner, repo string, number int, body *
 	return err
 }
 
-func (client *githubClient) AddAssignees(owner, repo string, number int, assignees []string) error {
+func (client *githubClient) FindComment(ctx context.Context, owner, repo string, number int, author, marker string) (*github.IssueComment, error) {
+	opt := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		comments, resp, err := client.Issues.ListComments(ctx, owner, repo, number, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, comment := range comments {
+			if IsLogin(comment.GetUser().GetLogin(), author) && strings.Contains(comment.GetBody(), marker) {
+				return comment, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (client *githubClient) EditComment(ctx context.Context, owner, repo string, id int64, body *string) error {
+	_, _, err := client.Issues.EditComment(
+		ctx,
+		owner,
+		repo,
+		id,
+		&github.IssueComment{Body: body},
+	)
+	return err
+}
+
+func (client *githubClient) AddAssignees(ctx context.Context, owner, repo string, number int, assignees []string) error {
 	_, _, err := client.Issues.AddAssignees(
-		client.ctx,
+		ctx,
 		owner,
 		repo,
 		number,
@@ -80,9 +155,9 @@ func (client *githubClient) AddAssignees(owner, repo string, number int, assigne
 	return err
 }
 
-func (client *githubClient) ReplaceLabels(owner, repo string, number int, labels []string) error {
+func (client *githubClient) ReplaceLabels(ctx context.Context, owner, repo string, number int, labels []string) error {
 	_, _, err := client.Issues.ReplaceLabelsForIssue(
-		client.ctx,
+		ctx,
 		owner,
 		repo,
 		number,
@@ -91,9 +166,9 @@ func (client *githubClient) ReplaceLabels(owner, repo string, number int, labels
 	return err
 }
 
-func (client *githubClient) ListLabels(owner, repo string, number int) ([]string, error) {
+func (client *githubClient) ListLabels(ctx context.Context, owner, repo string, number int) ([]string, error) {
 	labels, _, err := client.Issues.ListLabelsByIssue(
-		client.ctx,
+		ctx,
 		owner,
 		repo,
 		number,
@@ -0,0 +1,73 @@
+// Package metrics holds the Prometheus collectors of the PR bot.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// EventUnknown is the event label of deliveries that are not signed or whose
+// event type is not handled, as the X-GitHub-Event header would otherwise
+// let anyone add label values.
+const EventUnknown = "unknown"
+
+var (
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prbot_webhook_deliveries_total",
+		Help: "Webhook deliveries received, by event type and result.",
+	}, []string{"event", "result"})
+
+	SignatureFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "prbot_webhook_signature_failures_total",
+		Help: "Webhook deliveries rejected because of a missing or invalid signature.",
+	})
+
+	EventProcessingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prbot_event_processing_seconds",
+		Help:    "Time taken to process a webhook event, by event type and result.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"event", "result"})
+
+	GitHubAPICalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prbot_github_api_calls_total",
+		Help: "GitHub API calls, by githubapi.Client method.",
+	}, []string{"method"})
+
+	GitHubAPIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prbot_github_api_errors_total",
+		Help: "Failed GitHub API calls, by githubapi.Client method.",
+	}, []string{"method"})
+
+	DBQuerySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prbot_db_query_seconds",
+		Help:    "Database query latency, by DBHelper method.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"method"})
+
+	CIPortBuilds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prbot_ci_port_builds_total",
+		Help: "Port builds reported by the CI runner, by stage and result.",
+	}, []string{"stage", "result"})
+
+	CIPortBuildSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prbot_ci_port_build_seconds",
+		Help:    "Port build durations reported by the CI runner, by stage and result.",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 10),
+	}, []string{"stage", "result"})
+)
+
+// ObserveDBQuery records the latency of a DBHelper method started at start.
+// Use it as `defer metrics.ObserveDBQuery("GetPR", time.Now())`.
+func ObserveDBQuery(method string, start time.Time) {
+	DBQuerySeconds.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// ObserveGitHubCall counts a call to a githubapi.Client method and whether it failed.
+func ObserveGitHubCall(method string, err error) {
+	GitHubAPICalls.WithLabelValues(method).Inc()
+	if err != nil {
+		GitHubAPIErrors.WithLabelValues(method).Inc()
+	}
+}
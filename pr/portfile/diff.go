@@ -0,0 +1,309 @@
+// Package portfile extracts the version, revision, epoch and checksums
+// changed by a Portfile diff.
+package portfile
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of Portfile changes
+const (
+	// The version or epoch changes
+	KindUpdate = "update"
+	// Only the revision changes
+	KindRevbump = "revbump"
+	// The checksums change but not the version, epoch or revision, e.g. if
+	// upstream replaced a distfile
+	KindChecksum = "checksum"
+	// Anything else, e.g. replacing the port with an obsolete stub
+	KindOther = "other"
+)
+
+// Kinds lists the kinds of Portfile changes.
+var Kinds = []string{KindUpdate, KindRevbump, KindChecksum, KindOther}
+
+// Change is the old and new value of a Portfile option, empty if the diff
+// adds or removes it.
+type Change struct {
+	Old string
+	New string
+}
+
+// Changed reports whether the diff changes the option.
+func (change *Change) Changed() bool {
+	return change.Old != change.New
+}
+
+// Changes are the options changed in the main part of a Portfile or in a
+// subport block.
+type Changes struct {
+	Version   Change
+	Revision  Change
+	Epoch     Change
+	Checksums Change
+}
+
+// Diff is a parsed Portfile diff.
+type Diff struct {
+	// Changes by subport, "" for the main part of the Portfile. Only parts
+	// with changed options are present.
+	Subports map[string]*Changes
+	// Whether lines other than these options and comments changed
+	Other bool
+	// Port set by a replaced_by line the diff adds, e.g. in the stub left
+	// by a rename
+	ReplacedBy string
+	// Whether the diff adds the obsolete PortGroup
+	Obsolete bool
+	// Options set in the lines shown, changed or not, by subport
+	set map[string]map[string]bool
+}
+
+var (
+	hunkHeader   = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+\d+(?:,\d+)? @@ ?(.*)$`)
+	subportStart = regexp.MustCompile(`^subport\s+(\S+)\s*\{`)
+	// Options written as "option value"
+	optionLine = regexp.MustCompile(`^(version|revision|epoch|checksums)(?:\s+(.*))?$`)
+	// PortGroups setting the version, e.g. "github.setup owner project version"
+	setupLine = regexp.MustCompile(`^(?:github|gitlab|bitbucket)\.setup\s+\S+\s+\S+\s+(\S+)`)
+	// Lines of obsolete stubs, which are significant other changes
+	replacedByLine    = regexp.MustCompile(`^\s*replaced_by\s+(\S+)`)
+	obsoleteGroupLine = regexp.MustCompile(`^\s*PortGroup\s+obsolete\s`)
+)
+
+// side is the old or new content of the lines shown by a hunk.
+type side struct {
+	subport string
+	// Statement being continued with a trailing backslash
+	continued *statement
+	values    map[string]map[string]*statement
+}
+
+type statement struct {
+	option  string
+	value   string
+	changed bool
+}
+
+// ParseDiff parses the unified diff of a Portfile, as in the patch of a
+// changed file of a PR.
+func ParseDiff(patch string) *Diff {
+	diff := &Diff{Subports: make(map[string]*Changes), set: make(map[string]map[string]bool)}
+	var before, after *side
+	flush := func() {
+		if before != nil {
+			diff.add(before, after)
+		}
+	}
+	for _, line := range strings.Split(patch, "\n") {
+		if match := hunkHeader.FindStringSubmatch(line); match != nil {
+			flush()
+			before, after = newSide(match[1]), newSide(match[1])
+			continue
+		}
+		if before == nil || line == "" || strings.HasPrefix(line, `\`) {
+			continue
+		}
+		content := line[1:]
+		switch line[0] {
+		case ' ':
+			before.read(content, false)
+			after.read(content, false)
+		case '-':
+			if !before.read(content, true) && significant(content) {
+				diff.Other = true
+			}
+		case '+':
+			if match := replacedByLine.FindStringSubmatch(content); match != nil {
+				diff.ReplacedBy = match[1]
+			}
+			if obsoleteGroupLine.MatchString(content) {
+				diff.Obsolete = true
+			}
+			if !after.read(content, true) && significant(content) {
+				diff.Other = true
+			}
+		}
+	}
+	flush()
+	return diff
+}
+
+// newSide starts a side of a hunk, with the line git shows in the header as
+// the enclosing block, if any.
+func newSide(header string) *side {
+	s := &side{values: make(map[string]map[string]*statement)}
+	if match := subportStart.FindStringSubmatch(header); match != nil {
+		s.subport = match[1]
+	}
+	return s
+}
+
+// read reads a line, and reports whether it is part of an option parsed.
+func (s *side) read(line string, changed bool) bool {
+	trimmed := strings.TrimSpace(line)
+	if st := s.continued; st != nil {
+		st.value += " " + strings.TrimSpace(strings.TrimSuffix(trimmed, `\`))
+		st.changed = st.changed || changed
+		if !strings.HasSuffix(trimmed, `\`) {
+			s.continued = nil
+		}
+		return true
+	}
+	if match := subportStart.FindStringSubmatch(trimmed); match != nil {
+		s.subport = match[1]
+		return false
+	}
+	if line == "}" {
+		s.subport = ""
+		return false
+	}
+	var st *statement
+	if match := optionLine.FindStringSubmatch(trimmed); match != nil {
+		st = &statement{option: match[1], value: strings.TrimSpace(strings.TrimSuffix(match[2], `\`))}
+	} else if match := setupLine.FindStringSubmatch(trimmed); match != nil {
+		st = &statement{option: "version", value: match[1]}
+	} else {
+		return false
+	}
+	st.changed = changed
+	if s.values[s.subport] == nil {
+		s.values[s.subport] = make(map[string]*statement)
+	}
+	s.values[s.subport][st.option] = st
+	if strings.HasSuffix(trimmed, `\`) {
+		s.continued = st
+	}
+	return true
+}
+
+// add records the options changed by a hunk.
+func (diff *Diff) add(before, after *side) {
+	subports := make(map[string]bool)
+	for subport := range before.values {
+		subports[subport] = true
+	}
+	for subport := range after.values {
+		subports[subport] = true
+	}
+	for subport := range subports {
+		for _, option := range []string{"version", "revision", "epoch", "checksums"} {
+			o, n := before.values[subport][option], after.values[subport][option]
+			if o != nil || n != nil {
+				if diff.set[subport] == nil {
+					diff.set[subport] = make(map[string]bool)
+				}
+				diff.set[subport][option] = true
+			}
+			if (o == nil || !o.changed) && (n == nil || !n.changed) {
+				continue
+			}
+			changes := diff.Subports[subport]
+			if changes == nil {
+				changes = &Changes{}
+				diff.Subports[subport] = changes
+			}
+			change := changes.option(option)
+			if o != nil {
+				change.Old = strings.Join(strings.Fields(o.value), " ")
+			}
+			if n != nil {
+				change.New = strings.Join(strings.Fields(n.value), " ")
+			}
+		}
+	}
+}
+
+func (changes *Changes) option(name string) *Change {
+	switch name {
+	case "version":
+		return &changes.Version
+	case "revision":
+		return &changes.Revision
+	case "epoch":
+		return &changes.Epoch
+	default:
+		return &changes.Checksums
+	}
+}
+
+// significant reports whether a line changed is more than whitespace or a
+// comment.
+func significant(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed != "" && !strings.HasPrefix(trimmed, "#")
+}
+
+// Kind returns the kind of the change, see KindUpdate. Each subport is
+// evaluated on its own, and the change is a checksum change if the checksums
+// of any of them change without its version, epoch or revision.
+func (diff *Diff) Kind() string {
+	if diff.ReplacedBy != "" || diff.Obsolete {
+		return KindOther
+	}
+	var update, revision, checksums, checksumOnly bool
+	for subport, changes := range diff.Subports {
+		subportUpdate := diff.changed(subport, "version") || diff.changed(subport, "epoch")
+		subportRevision := diff.changed(subport, "revision")
+		update = update || subportUpdate
+		revision = revision || subportRevision
+		checksums = checksums || changes.Checksums.Changed()
+		checksumOnly = checksumOnly || (changes.Checksums.Changed() && !subportUpdate && !subportRevision)
+	}
+	switch {
+	case checksumOnly:
+		return KindChecksum
+	case update:
+		return KindUpdate
+	case revision && !checksums && !diff.Other:
+		return KindRevbump
+	}
+	return KindOther
+}
+
+// changed reports whether option changes for subport, in its block or in
+// the main part of the Portfile if the block does not set it.
+func (diff *Diff) changed(subport, option string) bool {
+	if changes := diff.Subports[subport]; changes != nil && changes.option(option).Changed() {
+		return true
+	}
+	if subport == "" || diff.set[subport][option] {
+		return false
+	}
+	main := diff.Subports[""]
+	return main != nil && main.option(option).Changed()
+}
+
+// Describe lists the options changed, e.g. "version 1.0 → 1.1, checksums".
+func (changes *Changes) Describe() string {
+	var parts []string
+	for _, option := range []string{"epoch", "version", "revision"} {
+		if change := changes.option(option); change.Changed() {
+			parts = append(parts, option+" "+orNone(change.Old)+" → "+orNone(change.New))
+		}
+	}
+	if changes.Checksums.Changed() {
+		parts = append(parts, "checksums")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// SubportNames returns the keys of Subports sorted, with the main part of
+// the Portfile first.
+func (diff *Diff) SubportNames() []string {
+	names := make([]string, 0, len(diff.Subports))
+	for subport := range diff.Subports {
+		names = append(names, subport)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
@@ -0,0 +1,93 @@
+package portfile
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseFixture(t *testing.T, name string) *Diff {
+	patch, err := ioutil.ReadFile(filepath.Join("testdata", name+".diff"))
+	require.NoError(t, err)
+	return ParseDiff(string(patch))
+}
+
+func TestParseDiff(t *testing.T) {
+	diff := parseFixture(t, "update")
+	assert.Equal(t, KindUpdate, diff.Kind())
+	assert.False(t, diff.Other)
+	assert.Equal(t, []string{""}, diff.SubportNames())
+	changes := diff.Subports[""]
+	assert.Equal(t, Change{Old: "3.95", New: "3.96"}, changes.Version)
+	assert.Equal(t, Change{Old: "1"}, changes.Revision)
+	assert.False(t, changes.Epoch.Changed())
+	assert.Contains(t, changes.Checksums.Old, "size 1240520")
+	assert.Contains(t, changes.Checksums.New, "size 1258592")
+	assert.Equal(t, "version 3.95 → 3.96, revision 1 → (none), checksums", changes.Describe())
+
+	diff = parseFixture(t, "revbump")
+	assert.Equal(t, KindRevbump, diff.Kind())
+	assert.Equal(t, "revision 2 → 3", diff.Subports[""].Describe())
+
+	diff = parseFixture(t, "subport")
+	assert.Equal(t, KindUpdate, diff.Kind())
+	assert.Equal(t, []string{"${name}-devel", "${name}-docs"}, diff.SubportNames())
+	assert.Equal(t, "revision 0 → 1", diff.Subports["${name}-devel"].Describe())
+	assert.Equal(t, "version 1.70.0 → 1.71.0", diff.Subports["${name}-docs"].Describe())
+
+	diff = parseFixture(t, "other")
+	assert.Equal(t, KindOther, diff.Kind())
+	assert.True(t, diff.Other)
+	assert.Empty(t, diff.Subports)
+}
+
+func TestKind(t *testing.T) {
+	fixtures := map[string]string{
+		"update":   KindUpdate,
+		"subport":  KindUpdate,
+		"revbump":  KindRevbump,
+		"checksum": KindChecksum,
+		// Only the checksums of the subport change
+		"checksum_subport": KindChecksum,
+		// The subport keeps its version while the main part is updated
+		"checksum_update_subport": KindChecksum,
+		// The subport is updated along with the main part
+		"update_subport": KindUpdate,
+		// A revbump may come with new distfiles, e.g. after a port fix
+		"checksum_revbump": KindOther,
+		"other":            KindOther,
+	}
+	for name, kind := range fixtures {
+		assert.Equal(t, kind, parseFixture(t, name).Kind(), name)
+	}
+
+	diff := parseFixture(t, "checksum")
+	assert.Equal(t, "checksums", diff.Subports[""].Describe())
+	assert.Equal(t, "rmd160 2a8bbcd6b5e9b5dcd9b2ba1e7fa1e8dd10c0f1b9 sha256 4c0a0b8c6b2e8e7f0f5b3d27a8e6b4b5a9c1de0e6fd87c3a5c8bd4e9e2f7a6c1 size 9823405", diff.Subports[""].Checksums.New)
+	assert.Equal(t, []string{"${name}-devel"}, parseFixture(t, "checksum_subport").SubportNames())
+}
+
+func TestParseDiffComments(t *testing.T) {
+	diff := ParseDiff("@@ -1,3 +1,4 @@\n version 1.0\n-revision 0\n+revision 1\n+# Rebuild for libfoo\n")
+	assert.Equal(t, KindRevbump, diff.Kind())
+
+	// Options set in a context line are not changes
+	diff = ParseDiff("@@ -1,3 +1,3 @@\n version 1.0\n-depends_lib port:a\n+depends_lib port:b\n")
+	assert.Equal(t, KindOther, diff.Kind())
+	assert.Empty(t, diff.Subports)
+}
+
+func TestParseDiffStub(t *testing.T) {
+	diff := parseFixture(t, "stub")
+	assert.Equal(t, "upx", diff.ReplacedBy)
+	assert.True(t, diff.Obsolete)
+	// Not an update, although the version is set anew
+	assert.Equal(t, KindOther, diff.Kind())
+
+	diff = parseFixture(t, "update")
+	assert.Empty(t, diff.ReplacedBy)
+	assert.False(t, diff.Obsolete)
+}
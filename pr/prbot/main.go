@@ -1,64 +1,116 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/macports/mpbot-github/pr/config"
 	"github.com/macports/mpbot-github/pr/cron"
 	"github.com/macports/mpbot-github/pr/db"
 	"github.com/macports/mpbot-github/pr/githubapi"
+	"github.com/macports/mpbot-github/pr/rules"
+	"github.com/macports/mpbot-github/pr/trac"
 	"github.com/macports/mpbot-github/pr/webhook"
 )
 
 // Entry point of the PR bot
 func main() {
-	webhookAddr := flag.String("l", "localhost:8081", "listen address for webhook events")
+	configPath := flag.String("c", "", "path to the YAML config file")
+	webhookAddr := flag.String("l", "", "listen address for webhook events, overrides listen_addr")
 	flag.Parse()
-	hookSecret := []byte(os.Getenv("HUB_WEBHOOK_SECRET"))
-	if len(hookSecret) == 0 {
-		log.Fatal("HUB_WEBHOOK_SECRET not found")
+
+	cfg, warnings, err := config.Load(*configPath)
+	for _, warning := range warnings {
+		log.Println("config:", warning)
+	}
+	if err != nil {
+		log.Fatal("config: ", err)
 	}
-	botSecret := os.Getenv("HUB_BOT_SECRET")
-	if botSecret == "" {
-		log.Fatal("HUB_BOT_SECRET not found")
+	if *webhookAddr != "" {
+		cfg.ListenAddr = *webhookAddr
 	}
 
-	prodFlag := false
-	if os.Getenv("BOT_ENV") == "production" {
-		prodFlag = true
+	githubClient, err := newGitHubClient(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.DryRun.Enabled {
+		log.Println("Dry run, changes to GitHub are only logged and listed at /dryrun")
+		githubClient = githubapi.NewDryRunClient(githubClient, cfg.DryRun.BufferSize)
 	}
 
-	dbHelper, err := db.NewDBHelper()
+	dbHelper, err := db.NewDBHelper(cfg)
 	if err != nil {
-		if prodFlag {
+		if cfg.Production {
 			log.Fatal(err)
 		} else {
 			log.Println(err)
+			log.Println("Running without database, /readyz will report not ready")
 		}
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	cronManager := cron.Manager{
 		DB:     dbHelper,
-		Client: githubapi.NewClient(botSecret),
+		Client: githubClient,
+		Config: cfg,
+	}
+	cronCtx, cancelCron := context.WithCancel(ctx)
+	cronDone := make(chan struct{})
+	go func() {
+		defer close(cronDone)
+		cronManager.Start(cronCtx)
+	}()
+
+	labelRules, err := rules.NewSource(cfg.LabelRules, cfg.Labels)
+	if err != nil {
+		log.Fatal("label rules: ", err)
+	}
+
+	var tracClient trac.Client
+	if cfg.DryRun.Enabled {
+		tracClient = trac.DryRunClient{}
+	} else if cfg.Trac.User != "" {
+		tracClient = trac.NewClient(cfg.Trac.URL, cfg.Trac.User, cfg.Trac.Password)
 	}
-	go cronManager.Start()
 
-	receiver := webhook.NewReceiver(*webhookAddr, hookSecret, botSecret, prodFlag, dbHelper)
+	receiver := webhook.NewReceiver(ctx, cfg, githubClient, dbHelper, labelRules, tracClient)
 	go receiver.Start()
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	// TODO: SIGTERM cancels PR processing.
 sigLoop:
 	for sig := range sigChan {
 		switch sig {
 		case syscall.SIGINT, syscall.SIGTERM:
 			signal.Stop(sigChan)
-			receiver.Shutdown()
+			log.Println("Shutting down")
+			cancelCron()
+			receiver.Shutdown(time.Duration(cfg.ShutdownTimeout))
+			<-cronDone
 			break sigLoop
 		}
 	}
 }
+
+// newGitHubClient authenticates as a GitHub App if one is configured, and
+// with the personal access token otherwise.
+func newGitHubClient(cfg *config.Config) (githubapi.Client, error) {
+	app := cfg.GitHub.App
+	if app.ID == 0 {
+		return githubapi.NewClient(cfg.GitHub.Token), nil
+	}
+	privateKey, err := ioutil.ReadFile(app.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return githubapi.NewAppClient(app.ID, app.InstallationID, privateKey, cfg.Owners())
+}
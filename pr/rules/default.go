@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"regexp"
+
+	"github.com/macports/mpbot-github/pr/config"
+	"github.com/macports/mpbot-github/pr/portfile"
+)
+
+var (
+	// Actions on which the ports changed may have changed
+	portActions = []string{"opened", "synchronize", "reopened", "ready_for_review"}
+	// Actions on which the title or body may have changed
+	textActions = []string{"opened", "edited"}
+)
+
+// Default returns the rules used without a rules file, which label PRs with
+// the configured labels.
+func Default(labels config.LabelConfig) *RuleSet {
+	yes := true
+	highImpact := 100
+	set := &RuleSet{
+		MinorChangeLines: 2,
+		Rules: []*Rule{
+			{
+				Name:   "submission",
+				Reason: "adds a new port",
+				On:     []string{"opened"},
+				When:   Conditions{Submission: &yes},
+				Add:    []string{labels.TypePrefix + "submission"},
+			},
+			{
+				Name:            "duplicate",
+				Reason:          "a new port is similar to an existing one",
+				On:              portActions,
+				When:            Conditions{Duplicate: &yes},
+				Add:             []string{labels.Duplicate},
+				RemoveUnmatched: true,
+			},
+			{
+				Name:   "update",
+				Reason: "the title mentions an update",
+				On:     textActions,
+				When:   Conditions{Title: mustRegexp(`(?i)(: update|^update)`)},
+				Add:    []string{labels.TypePrefix + "update"},
+			},
+			{
+				Name:   "version update",
+				Reason: "a Portfile changes the version",
+				On:     portActions,
+				When:   Conditions{Portfile: []string{portfile.KindUpdate}},
+				Add:    []string{labels.TypePrefix + "update"},
+			},
+			{
+				Name:            "revbump",
+				Reason:          "the Portfiles only change the revision",
+				On:              portActions,
+				When:            Conditions{Portfile: []string{portfile.KindRevbump}},
+				Add:             []string{labels.TypePrefix + "revbump"},
+				RemoveUnmatched: true,
+			},
+			{
+				Name:            "removal",
+				Reason:          "a port is removed",
+				On:              portActions,
+				When:            Conditions{Removal: &yes},
+				Add:             []string{labels.TypePrefix + "removal"},
+				RemoveUnmatched: true,
+			},
+			{
+				Name:            "rename",
+				Reason:          "a port is renamed or moved",
+				On:              portActions,
+				When:            Conditions{Rename: &yes},
+				Add:             []string{labels.TypePrefix + "rename"},
+				RemoveUnmatched: true,
+			},
+			{
+				Name:            "checksum",
+				Reason:          "the checksums change without the version or revision",
+				On:              portActions,
+				When:            Conditions{Portfile: []string{portfile.KindChecksum}},
+				Add:             []string{labels.Checksum},
+				RemoveUnmatched: true,
+			},
+			{
+				Name:            "commit messages",
+				Reason:          "commit messages do not follow the conventions",
+				On:              portActions,
+				When:            Conditions{CommitProblems: &yes},
+				Add:             []string{labels.CommitMessages},
+				RemoveUnmatched: true,
+			},
+			{
+				Name:            "impact",
+				Reason:          "many ports depend on a port changed",
+				On:              portActions,
+				When:            Conditions{MinDependents: &highImpact},
+				Add:             []string{labels.HighImpact},
+				RemoveUnmatched: true,
+			},
+			{
+				Name:   "cve",
+				Reason: "mentions a CVE",
+				On:     textActions,
+				When:   Conditions{Text: mustRegexp(`CVE-\d{4}-\d+`)},
+				Add:    []string{labels.TypePrefix + "security fix"},
+			},
+		},
+	}
+	for _, t := range []string{"bugfix", "enhancement", "security fix", "update"} {
+		set.Rules = append(set.Rules, &Rule{
+			Name:   "checkbox " + t,
+			Reason: "checked in the description",
+			On:     textActions,
+			When:   Conditions{Body: mustRegexp(regexp.QuoteMeta("[x] " + t))},
+			Add:    []string{labels.TypePrefix + t},
+		})
+	}
+	maintainerLabels := []struct {
+		status, label, reason string
+	}{
+		{StatusMaintainer, labels.Maintainer, "the sender maintains the ports changed"},
+		{StatusNoMaintainer, labels.NoMaintainer, "the ports changed have no maintainer"},
+		{StatusOpenMaintainer, labels.OpenMaintainer, "the ports changed are openmaintainer"},
+		{StatusRequiresApproval, labels.RequiresApproval, "maintainers of the ports changed have to approve"},
+	}
+	for _, m := range maintainerLabels {
+		set.Rules = append(set.Rules, &Rule{
+			Name:            m.status,
+			Reason:          m.reason,
+			On:              portActions,
+			When:            Conditions{Maintainer: []string{m.status}},
+			Add:             []string{m.label},
+			RemoveUnmatched: true,
+		})
+	}
+	set.Rules = append(set.Rules, &Rule{
+		Name:   "member",
+		Reason: "the sender is a member of the org",
+		On:     []string{"opened"},
+		When:   Conditions{Member: &yes},
+		Add:    []string{labels.Member},
+	})
+	return set
+}
@@ -0,0 +1,332 @@
+// Package rules computes the labels of a PR from a declarative set of rules,
+// which can be loaded from a YAML file.
+package rules
+
+import (
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/macports/mpbot-github/pr/portfile"
+)
+
+// Maintainer statuses of the ports changed by a PR, see Facts.
+const (
+	// The sender maintains all ports changed, except minor changes
+	StatusMaintainer = "maintainer"
+	// None of the ports changed has a maintainer
+	StatusNoMaintainer = "nomaintainer"
+	// All ports changed are openmaintainer or have no maintainer
+	StatusOpenMaintainer = "openmaintainer"
+	// Maintainers of the ports changed have to approve
+	StatusRequiresApproval = "requires_approval"
+)
+
+var statuses = map[string]bool{
+	StatusMaintainer:       true,
+	StatusNoMaintainer:     true,
+	StatusOpenMaintainer:   true,
+	StatusRequiresApproval: true,
+}
+
+// actions are the pull_request actions the rules are applied on.
+var actions = map[string]bool{
+	"opened":           true,
+	"edited":           true,
+	"synchronize":      true,
+	"reopened":         true,
+	"ready_for_review": true,
+}
+
+// Facts describes a PR for matching rules against it.
+type Facts struct {
+	// Action of the pull_request event, e.g. "opened"
+	Action string
+	Title  string
+	Body   string
+	// Files changed of each port, its Portfile if changed
+	Paths []string
+	// Categories of the ports changed
+	Categories []string
+	// Whether the sender is a member of the org owning the repository
+	Member bool
+	// Maintainer statuses that apply, see StatusMaintainer
+	MaintainerStatuses []string
+	// Whether a new port is added
+	Submission bool
+	// Whether a new port is similar to an existing one
+	Duplicate bool
+	// Whether a port is removed, or replaced by an obsolete stub whose
+	// replacement the PR does not add
+	Removal bool
+	// Whether a port is renamed or moved to another category
+	Rename bool
+	// Lines changed in Paths
+	Changes int
+	// Kinds of the Portfile changes, see portfile.KindUpdate
+	PortfileKinds []string
+	// Whether a commit message does not follow the conventions
+	CommitProblems bool
+	// Most ports depending on one of the ports changed, directly or not
+	Dependents int
+}
+
+// RuleSet is the content of a rules file.
+type RuleSet struct {
+	// Ports whose Portfile changes by at most this many lines do not count
+	// for StatusMaintainer, e.g. revision bumps of dependents, if the diff
+	// of the Portfile is not available to tell
+	MinorChangeLines int     `yaml:"minor_change_lines"`
+	Rules            []*Rule `yaml:"rules"`
+}
+
+// Rule adds and removes labels of PRs matching all its conditions.
+type Rule struct {
+	Name string `yaml:"name"`
+	// Why the labels are added, shown in the status comment of the PR
+	Reason string `yaml:"reason"`
+	// Actions the rule is evaluated on
+	On     []string   `yaml:"on"`
+	When   Conditions `yaml:"when"`
+	Add    []string   `yaml:"add"`
+	Remove []string   `yaml:"remove"`
+	// Remove the labels in Add when the rule does not match
+	RemoveUnmatched bool `yaml:"remove_unmatched"`
+}
+
+// Conditions of a rule, unset ones match any PR.
+type Conditions struct {
+	Title *Regexp `yaml:"title"`
+	Body  *Regexp `yaml:"body"`
+	// Matched against both the title and the body
+	Text *Regexp `yaml:"text"`
+	// Matches if any of Facts.Paths matches
+	Paths *Regexp `yaml:"paths"`
+	// Matches if any of the ports changed is in one of the categories
+	Categories []string `yaml:"categories"`
+	Member     *bool    `yaml:"member"`
+	// Matches if any of the statuses applies
+	Maintainer []string `yaml:"maintainer"`
+	Submission *bool    `yaml:"submission"`
+	Duplicate  *bool    `yaml:"duplicate"`
+	Removal    *bool    `yaml:"removal"`
+	Rename     *bool    `yaml:"rename"`
+	MinChanges *int     `yaml:"min_changes"`
+	MaxChanges *int     `yaml:"max_changes"`
+	// Matches if any of the Portfiles changed is of one of the kinds
+	Portfile       []string `yaml:"portfile"`
+	CommitProblems *bool    `yaml:"commit_problems"`
+	// Matches if one of the ports changed has at least this many
+	// dependents, see Facts.Dependents
+	MinDependents *int `yaml:"min_dependents"`
+}
+
+// Regexp is a regular expression written as a string in the rules file.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (r *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	compiled, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	r.Regexp = compiled
+	return nil
+}
+
+func (r *Regexp) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+func mustRegexp(s string) *Regexp {
+	return &Regexp{regexp.MustCompile(s)}
+}
+
+// Parse reads a rules file.
+func Parse(data []byte) (*RuleSet, error) {
+	set := &RuleSet{MinorChangeLines: 2}
+	if err := yaml.UnmarshalStrict(data, set); err != nil {
+		return nil, err
+	}
+	return set, set.validate()
+}
+
+// Load reads the rules file at path.
+func Load(path string) (*RuleSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func (set *RuleSet) validate() error {
+	if set.MinorChangeLines < 0 {
+		return errors.New("minor_change_lines must not be negative")
+	}
+	for i, rule := range set.Rules {
+		name := rule.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i+1)
+		}
+		if len(rule.On) == 0 {
+			return errors.New("rule " + name + ": on must list at least one action")
+		}
+		for _, action := range rule.On {
+			if !actions[action] {
+				return errors.New("rule " + name + ": unknown action " + action)
+			}
+		}
+		if len(rule.Add) == 0 && len(rule.Remove) == 0 {
+			return errors.New("rule " + name + ": add or remove must be set")
+		}
+		for _, status := range rule.When.Maintainer {
+			if !statuses[status] {
+				return errors.New("rule " + name + ": unknown maintainer status " + status)
+			}
+		}
+		for _, kind := range rule.When.Portfile {
+			if !contains(portfile.Kinds, kind) {
+				return errors.New("rule " + name + ": unknown Portfile change " + kind)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply returns labels with the rules for facts.Action applied in order.
+func (set *RuleSet) Apply(labels []string, facts *Facts) []string {
+	result := append([]string(nil), labels...)
+	for _, rule := range set.Rules {
+		if !contains(rule.On, facts.Action) {
+			continue
+		}
+		if rule.When.match(facts) {
+			result = without(result, rule.Remove)
+			for _, label := range rule.Add {
+				if !contains(result, label) {
+					result = append(result, label)
+				}
+			}
+		} else if rule.RemoveUnmatched {
+			result = without(result, rule.Add)
+		}
+	}
+	return result
+}
+
+// Explain returns the reason of each label added by the rules for
+// facts.Action, which is the name of the rule unless it has a reason.
+func (set *RuleSet) Explain(facts *Facts) map[string]string {
+	reasons := make(map[string]string)
+	for _, rule := range set.Rules {
+		if !contains(rule.On, facts.Action) || !rule.When.match(facts) {
+			continue
+		}
+		reason := rule.Reason
+		if reason == "" {
+			reason = "rule " + rule.Name
+		}
+		for _, label := range rule.Add {
+			reasons[label] = reason
+		}
+	}
+	return reasons
+}
+
+func (when *Conditions) match(facts *Facts) bool {
+	if when.Title != nil && !when.Title.MatchString(facts.Title) {
+		return false
+	}
+	if when.Body != nil && !when.Body.MatchString(facts.Body) {
+		return false
+	}
+	if when.Text != nil && !when.Text.MatchString(facts.Title) && !when.Text.MatchString(facts.Body) {
+		return false
+	}
+	if when.Paths != nil {
+		matched := false
+		for _, path := range facts.Paths {
+			if when.Paths.MatchString(path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(when.Categories) > 0 && !containsAny(when.Categories, facts.Categories) {
+		return false
+	}
+	if when.Member != nil && *when.Member != facts.Member {
+		return false
+	}
+	if len(when.Maintainer) > 0 && !containsAny(when.Maintainer, facts.MaintainerStatuses) {
+		return false
+	}
+	if when.Submission != nil && *when.Submission != facts.Submission {
+		return false
+	}
+	if when.Duplicate != nil && *when.Duplicate != facts.Duplicate {
+		return false
+	}
+	if when.Removal != nil && *when.Removal != facts.Removal {
+		return false
+	}
+	if when.Rename != nil && *when.Rename != facts.Rename {
+		return false
+	}
+	if when.MinChanges != nil && facts.Changes < *when.MinChanges {
+		return false
+	}
+	if when.MaxChanges != nil && facts.Changes > *when.MaxChanges {
+		return false
+	}
+	if len(when.Portfile) > 0 && !containsAny(when.Portfile, facts.PortfileKinds) {
+		return false
+	}
+	if when.CommitProblems != nil && *when.CommitProblems != facts.CommitProblems {
+		return false
+	}
+	if when.MinDependents != nil && facts.Dependents < *when.MinDependents {
+		return false
+	}
+	return true
+}
+
+func contains(slice []string, elem string) bool {
+	for _, e := range slice {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(slice, elems []string) bool {
+	for _, elem := range elems {
+		if contains(slice, elem) {
+			return true
+		}
+	}
+	return false
+}
+
+func without(slice, elems []string) []string {
+	result := slice[:0:0]
+	for _, e := range slice {
+		if !contains(elems, e) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package rules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+
+	"github.com/macports/mpbot-github/pr/config"
+)
+
+func TestExampleRules(t *testing.T) {
+	set, err := Load("../prbot/label_rules.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compiled regexps are compared by their source
+	example, _ := yaml.Marshal(set)
+	defaults, _ := yaml.Marshal(Default(config.Default().Labels))
+	assert.Equal(t, string(defaults), string(example))
+}
+
+func TestCVERegexp(t *testing.T) {
+	set := Default(config.Default().Labels)
+	var cve *Regexp
+	for _, rule := range set.Rules {
+		if rule.Name == "cve" {
+			cve = rule.When.Text
+		}
+	}
+	assert.Equal(t, "CVE-2017-0001", cve.FindString("Fixes CVE-2017-0001."))
+	assert.Equal(t, "", cve.FindString("CVE-pending."))
+}
+
+func TestDefault(t *testing.T) {
+	set := Default(config.Default().Labels)
+	tests := []struct {
+		facts  Facts
+		labels []string
+		want   []string
+	}{
+		{Facts{Action: "opened", Title: "z: update to 1.1", Member: true, MaintainerStatuses: []string{StatusNoMaintainer}},
+			nil, []string{"type: update", "maintainer: none", "by: member"}},
+		{Facts{Action: "opened", Title: "Update z", Body: "[x] enhancement"},
+			nil, []string{"type: update", "type: enhancement"}},
+		{Facts{Action: "opened", Title: "z: fix build", Body: "Fixes CVE-0000-0."},
+			nil, []string{"type: security fix"}},
+		{Facts{Action: "opened", Title: "upx-devel: new port", Submission: true},
+			nil, []string{"type: submission"}},
+		{Facts{Action: "opened", Title: "upx: update to 1.1", MaintainerStatuses: []string{StatusMaintainer, StatusOpenMaintainer}},
+			[]string{"maintainer: requires approval", "help wanted"}, []string{"help wanted", "type: update", "maintainer", "maintainer: open"}},
+		// Type labels are left alone on pushes, maintainer labels replaced
+		{Facts{Action: "synchronize", Title: "upx: update to 1.1", MaintainerStatuses: []string{StatusRequiresApproval}},
+			[]string{"maintainer: open", "type: bugfix"}, []string{"type: bugfix", "maintainer: requires approval"}},
+		// Edits only add type labels
+		{Facts{Action: "edited", Title: "upx: update to 1.1", Member: true},
+			[]string{"maintainer: open"}, []string{"maintainer: open", "type: update"}},
+		// Commit message problems are labelled until a push fixes them
+		{Facts{Action: "opened", Title: "Update upx", CommitProblems: true},
+			nil, []string{"type: update", "needs: commit message fix"}},
+		{Facts{Action: "synchronize", Title: "upx: update to 1.1"},
+			[]string{"needs: commit message fix", "type: update"}, []string{"type: update"}},
+		{Facts{Action: "synchronize", Title: "zlib: update to 1.3", Dependents: 100},
+			nil, []string{"impact: high"}},
+		{Facts{Action: "synchronize", Title: "zlib: update to 1.3", Dependents: 99},
+			[]string{"impact: high"}, []string{}},
+		{Facts{Action: "opened", Title: "upx-ucl: remove", Removal: true, MaintainerStatuses: []string{StatusRequiresApproval}},
+			nil, []string{"type: removal", "maintainer: requires approval"}},
+		{Facts{Action: "synchronize", Title: "upx-ucl: rename to upx", Rename: true},
+			[]string{"type: removal"}, []string{"type: rename"}},
+		{Facts{Action: "closed", Title: "upx: update to 1.1"},
+			[]string{"maintainer: open"}, []string{"maintainer: open"}},
+	}
+	for _, test := range tests {
+		facts := test.facts
+		assert.Equal(t, test.want, set.Apply(test.labels, &facts), facts.Title)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	set := Default(config.Default().Labels)
+	facts := &Facts{Action: "opened", Title: "upx: update to 1.1", MaintainerStatuses: []string{StatusOpenMaintainer}}
+	assert.Equal(t, map[string]string{
+		"type: update":     "the title mentions an update",
+		"maintainer: open": "the ports changed are openmaintainer",
+	}, set.Explain(facts))
+
+	set, err := Parse([]byte("rules:\n  - name: any\n    on: [opened]\n    add: [x]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"x": "rule any"}, set.Explain(facts))
+}
+
+func TestParse(t *testing.T) {
+	set, err := Parse([]byte(`
+rules:
+  - name: python
+    on: [opened]
+    when:
+      categories: [python]
+      paths: '^python/py-'
+      max_changes: 10
+      member: false
+    add: ["python"]
+    remove: ["needs triage"]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, set.MinorChangeLines)
+
+	facts := &Facts{Action: "opened", Paths: []string{"python/py-six/Portfile"}, Categories: []string{"python"}, Changes: 4}
+	assert.Equal(t, []string{"python"}, set.Apply([]string{"needs triage"}, facts))
+	facts.Changes = 11
+	assert.Equal(t, []string{"needs triage"}, set.Apply([]string{"needs triage"}, facts))
+	facts.Changes = 4
+	facts.Member = true
+	assert.Equal(t, []string{"needs triage"}, set.Apply([]string{"needs triage"}, facts))
+	facts.Member = false
+	facts.Action = "synchronize"
+	assert.Equal(t, []string{"needs triage"}, set.Apply([]string{"needs triage"}, facts))
+
+	invalid := []string{
+		"rules:\n  - name: a\n    add: [x]\n",
+		"rules:\n  - name: a\n    on: [opened]\n",
+		"rules:\n  - name: a\n    on: [synchronise]\n    add: [x]\n",
+		"rules:\n  - on: [opened]\n    when:\n      maintainer: [nobody]\n    add: [x]\n",
+		"rules:\n  - on: [opened]\n    when:\n      title: '('\n    add: [x]\n",
+		"rules:\n  - on: [opened]\n    when:\n      colour: blue\n    add: [x]\n",
+		"minor_change_lines: -1\n",
+	}
+	for _, data := range invalid {
+		_, err := Parse([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestSource(t *testing.T) {
+	labels := config.Default().Labels
+	source, err := NewSource("", labels)
+	assert.NoError(t, err)
+	assert.Len(t, source.RuleSet().Rules, len(Default(labels).Rules))
+
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.yml")
+
+	_, err = NewSource(path, labels)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("rules: []\n"), 0644))
+	source, err = NewSource(path, labels)
+	assert.NoError(t, err)
+	assert.Empty(t, source.RuleSet().Rules)
+
+	// Modified files are reloaded, invalid ones ignored
+	write := func(data string, modTime time.Time) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	write("rules:\n  - on: [opened]\n    add: [x]\n", time.Now().Add(time.Minute))
+	assert.Len(t, source.RuleSet().Rules, 1)
+	write("rules: [", time.Now().Add(2*time.Minute))
+	assert.Len(t, source.RuleSet().Rules, 1)
+	write("rules:\n  - on: [synchronise]\n    add: [x]\n  - on: [opened]\n    add: [y]\n", time.Now().Add(3*time.Minute))
+	assert.Len(t, source.RuleSet().Rules, 1)
+}
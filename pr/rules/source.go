@@ -0,0 +1,66 @@
+package rules
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/macports/mpbot-github/pr/config"
+)
+
+// Source provides the current rules, reloading the rules file when it is
+// modified so that labelling can be tuned without restarting the bot.
+type Source struct {
+	path    string
+	lock    sync.Mutex
+	modTime time.Time
+	set     *RuleSet
+}
+
+// NewSource loads the rules file at path, or uses the default rules for
+// labels if path is empty.
+func NewSource(path string, labels config.LabelConfig) (*Source, error) {
+	source := &Source{path: path, set: Default(labels)}
+	if path == "" {
+		return source, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	set, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	source.modTime = info.ModTime()
+	source.set = set
+	return source, nil
+}
+
+// RuleSet returns the current rules. An invalid rules file is logged and
+// the previous rules are kept.
+func (source *Source) RuleSet() *RuleSet {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if source.path == "" {
+		return source.set
+	}
+	info, err := os.Stat(source.path)
+	if err != nil {
+		log.Println("label rules: " + err.Error())
+		return source.set
+	}
+	if info.ModTime().Equal(source.modTime) {
+		return source.set
+	}
+	source.modTime = info.ModTime()
+	set, err := Load(source.path)
+	if err != nil {
+		log.Println("label rules: " + err.Error() + ", keeping previous rules")
+		return source.set
+	}
+	log.Println("label rules: reloaded " + source.path)
+	source.set = set
+	return source.set
+}
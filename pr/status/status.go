@@ -0,0 +1,511 @@
+// Package status maintains a single comment per PR summarizing what the bot
+// did, which is edited in place instead of adding a comment each time.
+package status
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macports/mpbot-github/pr/commits"
+	"github.com/macports/mpbot-github/pr/githubapi"
+)
+
+// Marker identifies the status comment. The state of the comment follows it
+// base64 encoded, so that sections can be updated independently.
+const Marker = "<!-- mpbot-status"
+
+// Timeout states
+const (
+	// Not waiting for maintainers
+	TimeoutNone = ""
+	// Waiting for maintainers until the deadline
+	TimeoutWaiting = "waiting"
+	// Waiting paused while the PR is a draft
+	TimeoutPaused = "paused"
+	// A maintainer responded in time
+	TimeoutResponded = "responded"
+	// Maintainers did not respond in time
+	TimeoutExpired = "expired"
+)
+
+// Topics of questions to the sender about ports, which are only asked once
+// per port
+const (
+	// Checksums changed without the version or revision
+	AskedChecksum = "checksum"
+	// New port similar to an existing one
+	AskedDuplicate = "duplicate"
+)
+
+// Kinds of PortOperation
+const (
+	OperationRemoval = "removal"
+	OperationRename  = "rename"
+	OperationMove    = "move"
+)
+
+// maxCommentLength is the longest comment GitHub accepts.
+const maxCommentLength = 65536
+
+// maxLintLength limits lint output kept per job. Lint output of all jobs is
+// further truncated to fit in the comment, see fit.
+const maxLintLength = 8000
+
+const truncated = "\n[truncated]\n"
+
+// Comment is the content of the status comment of a PR.
+type Comment struct {
+	// "@" or "@_" to avoid notifying maintainers outside production
+	MentionSymbol string `json:"mention_symbol,omitempty"`
+	// Notified maintainers and the ports they were notified for
+	Maintainers map[string][]string `json:"maintainers,omitempty"`
+	// Maintainers whose ports are counted instead of listed above this
+	// many ports
+	GroupAbove map[string]int `json:"group_above,omitempty"`
+	// Notified maintainers who were away, and until when
+	Away map[string]time.Time `json:"away,omitempty"`
+	// Whether the PR asked not to notify maintainers
+	NotificationSkipped bool `json:"notification_skipped,omitempty"`
+	// Changes parsed from the Portfile diffs
+	Ports []PortChange `json:"ports,omitempty"`
+	// All ports changed by the PR as of the last update, to tell which ports
+	// a push adds
+	ChangedPorts []string `json:"changed_ports,omitempty"`
+	// Ports depending on the ports changed
+	Dependents []PortDependents `json:"dependents,omitempty"`
+	// Ports removed, renamed or moved
+	Operations []PortOperation `json:"operations,omitempty"`
+	// Commits not following the commit message conventions
+	Commits []commits.Problem `json:"commits,omitempty"`
+	// Ports the sender was asked about, by topic, see AskedChecksum
+	Asked map[string][]string `json:"asked,omitempty"`
+	// Labels set by the bot and why
+	Labels  []Label `json:"labels,omitempty"`
+	CI      *Build  `json:"ci,omitempty"`
+	Timeout Timeout `json:"timeout"`
+}
+
+// PortChange describes the changes of a Portfile, or of a subport block in
+// it.
+type PortChange struct {
+	Port    string `json:"port"`
+	Subport string `json:"subport,omitempty"`
+	// See portfile.KindUpdate
+	Kind string `json:"kind"`
+	// Options changed, e.g. "version 1.0 → 1.1, checksums"
+	Changes string `json:"changes"`
+}
+
+// PortDependents counts the ports depending on a port.
+type PortDependents struct {
+	Port   string `json:"port"`
+	Direct int    `json:"direct"`
+	// Ports depending on it directly or through other ports
+	Transitive int `json:"transitive"`
+	// The first ports depending on it directly
+	Examples []string `json:"examples,omitempty"`
+}
+
+// PortOperation is a port removed, renamed or moved.
+type PortOperation struct {
+	Port string `json:"port"`
+	// See OperationRemoval
+	Kind string `json:"kind"`
+	// New name of a renamed port, new category of a moved one, or the port
+	// replacing a removed one
+	To string `json:"to,omitempty"`
+	// Previous category of a moved port
+	From string `json:"from,omitempty"`
+	// Whether a renamed port leaves an obsolete stub behind
+	Stub bool `json:"stub,omitempty"`
+	// Ports still depending on a removed port, and the first of them
+	DependentCount int      `json:"dependent_count,omitempty"`
+	Dependents     []string `json:"dependents,omitempty"`
+}
+
+// Label is a label set by the bot.
+type Label struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Build is the latest CI build of a PR.
+type Build struct {
+	Number string `json:"number"`
+	URL    string `json:"url"`
+	Result string `json:"result"`
+	Jobs   []*Job `json:"jobs,omitempty"`
+}
+
+// Job is a job of a CI build.
+type Job struct {
+	Number string `json:"number"`
+	Image  string `json:"image"`
+	State  string `json:"state"`
+	// Result of each port built, in Markdown
+	Ports    []string `json:"ports,omitempty"`
+	Lint     string   `json:"lint,omitempty"`
+	TimedOut bool     `json:"timed_out,omitempty"`
+}
+
+// Timeout is the state of the maintainer timeout of a PR.
+type Timeout struct {
+	State    string    `json:"state,omitempty"`
+	Deadline time.Time `json:"deadline,omitempty"`
+	// Maintainer who responded
+	Responder string `json:"responder,omitempty"`
+	// Whether all maintainers waited for are away
+	Away bool `json:"away,omitempty"`
+}
+
+// AddMaintainers records notified maintainers.
+func (comment *Comment) AddMaintainers(handles map[string][]string) {
+	if comment.Maintainers == nil {
+		comment.Maintainers = make(map[string][]string)
+	}
+	for handle, ports := range handles {
+		for _, port := range ports {
+			if !contains(comment.Maintainers[handle], port) {
+				comment.Maintainers[handle] = append(comment.Maintainers[handle], port)
+			}
+		}
+	}
+}
+
+// AddAsked records ports the sender is asked about, and returns those not
+// asked about before.
+func (comment *Comment) AddAsked(topic string, ports []string) []string {
+	var added []string
+	for _, port := range ports {
+		if !contains(comment.Asked[topic], port) {
+			if comment.Asked == nil {
+				comment.Asked = make(map[string][]string)
+			}
+			comment.Asked[topic] = append(comment.Asked[topic], port)
+			added = append(added, port)
+		}
+	}
+	return added
+}
+
+// SetLabels records the labels of the PR set by the bot. Labels without a
+// reason keep their previous one, or are left out if they have none.
+func (comment *Comment) SetLabels(labels []string, reasons map[string]string) {
+	previous := make(map[string]string, len(comment.Labels))
+	for _, label := range comment.Labels {
+		previous[label.Name] = label.Reason
+	}
+	comment.Labels = nil
+	for _, label := range labels {
+		reason, ok := reasons[label]
+		if !ok {
+			reason, ok = previous[label]
+		}
+		if ok {
+			comment.Labels = append(comment.Labels, Label{Name: label, Reason: reason})
+		}
+	}
+}
+
+// Parse returns the state of a status comment body, or nil if body is not
+// one.
+func Parse(body string) *Comment {
+	i := strings.Index(body, Marker)
+	if i < 0 {
+		return nil
+	}
+	encoded := body[i+len(Marker):]
+	if end := strings.Index(encoded, "-->"); end >= 0 {
+		encoded = encoded[:end]
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil
+	}
+	comment := &Comment{}
+	if err := json.Unmarshal(data, comment); err != nil {
+		return nil
+	}
+	return comment
+}
+
+// Render returns the body of the status comment.
+func (comment *Comment) Render() string {
+	data, _ := json.Marshal(comment)
+	body := Marker + " " + base64.StdEncoding.EncodeToString(data) + " -->\n"
+
+	body += "#### Maintainers\n"
+	switch {
+	case comment.NotificationSkipped:
+		body += "Not notified, as requested.\n"
+	case len(comment.Maintainers) == 0:
+		body += "No maintainers to notify.\n"
+	default:
+		body += "Notifying maintainers:\n" + comment.Mentions()
+	}
+
+	if len(comment.Ports) > 0 {
+		body += "\n#### Portfiles\n"
+	}
+	for _, port := range comment.Ports {
+		name := port.Port
+		if port.Subport != "" {
+			name += " (subport " + port.Subport + ")"
+		}
+		body += "- " + name + ", " + port.Kind + ": " + port.Changes + "\n"
+	}
+
+	if len(comment.Dependents) > 0 {
+		body += "\n#### Dependents\n"
+	}
+	for _, dependents := range comment.Dependents {
+		body += "- " + dependents.Port + ": " + strconv.Itoa(dependents.Direct) + " direct, " +
+			strconv.Itoa(dependents.Transitive) + " in total"
+		if len(dependents.Examples) > 0 {
+			body += ", e.g. " + strings.Join(dependents.Examples, ", ")
+			if len(dependents.Examples) < dependents.Direct {
+				body += ", …"
+			}
+		}
+		body += "\n"
+	}
+
+	if len(comment.Operations) > 0 {
+		body += "\n#### Removals and renames\n"
+	}
+	for _, operation := range comment.Operations {
+		body += "- " + operation.Port + ": " + operation.describe() + "\n"
+	}
+
+	if len(comment.Commits) > 0 {
+		body += "\n#### Commit messages\n"
+		body += "Please use subjects like `port: update to 1.2.3` and rewrite these commits:\n"
+	}
+	for _, problem := range comment.Commits {
+		sha := problem.SHA
+		if len(sha) > 7 {
+			sha = sha[:7]
+		}
+		body += "- " + sha + " `" + strings.Replace(problem.Subject, "`", "'", -1) + "`: " + problem.Problem + "\n"
+	}
+
+	body += "\n#### Labels\n"
+	if len(comment.Labels) == 0 {
+		body += "None.\n"
+	}
+	for _, label := range comment.Labels {
+		body += "- `" + label.Name + "`: " + label.Reason + "\n"
+	}
+
+	body += "\n#### CI\n"
+	if comment.CI == nil {
+		body += "No results yet.\n"
+	} else {
+		build := comment.CI
+		body += "[Travis Build #" + build.Number + "](" + build.URL + ") " + build.Result + ".\n"
+		for _, job := range build.Jobs {
+			body += "\nJob " + job.Number + " on " + job.Image + ": " + job.State + "\n"
+			for _, port := range job.Ports {
+				body += "- " + port + "\n"
+			}
+			if job.Lint != "" {
+				body += "<details><summary>Lint results</summary>\n\n```\n" + job.Lint + "```\n</details>\n"
+			}
+			if job.TimedOut {
+				body += "\nThe job timed out.\n"
+			}
+		}
+	}
+
+	body += "\n#### Maintainer timeout\n"
+	timeout := comment.Timeout
+	switch timeout.State {
+	case TimeoutWaiting:
+		if timeout.Away {
+			body += "All maintainers are away, so the maintainer timeout applies at the next check.\n"
+			break
+		}
+		body += "Waiting for maintainers to respond until " + timeout.Deadline.UTC().Format("2006-01-02 15:04 MST") + ".\n"
+	case TimeoutPaused:
+		body += "Paused while the PR is a draft.\n"
+	case TimeoutResponded:
+		body += "Maintainer " + timeout.Responder + " responded.\n"
+	case TimeoutExpired:
+		if timeout.Away {
+			body += "Maintainers are away, so the PR timed out.\n"
+			break
+		}
+		body += "Maintainers did not respond in time.\n"
+	default:
+		body += "Not waiting for maintainers.\n"
+	}
+	return body
+}
+
+// Mentions returns a line mentioning each maintainer with their ports, in
+// handle order.
+func (comment *Comment) Mentions() string {
+	handles := make([]string, 0, len(comment.Maintainers))
+	for handle := range comment.Maintainers {
+		handles = append(handles, handle)
+	}
+	sort.Strings(handles)
+	var body string
+	for _, handle := range handles {
+		ports := comment.Maintainers[handle]
+		away := ""
+		if until, ok := comment.Away[handle]; ok {
+			away = " (away until " + until.UTC().Format("2006-01-02") + ")"
+		}
+		if groupAbove := comment.GroupAbove[handle]; groupAbove > 0 && len(ports) > groupAbove {
+			body += comment.MentionSymbol + handle + " for " + strconv.Itoa(len(ports)) + " ports" + away + ".\n"
+		} else {
+			body += comment.MentionSymbol + handle + " for port " + strings.Join(ports, ", ") + away + ".\n"
+		}
+	}
+	return body
+}
+
+// describe explains the operation in the status comment.
+func (operation *PortOperation) describe() string {
+	switch operation.Kind {
+	case OperationRemoval:
+		removed := "removed"
+		if operation.To != "" {
+			removed += " in favour of " + operation.To
+		}
+		if operation.DependentCount == 0 {
+			return removed + ", no remaining ports depend on it."
+		}
+		dependents := strings.Join(operation.Dependents, ", ")
+		if len(operation.Dependents) < operation.DependentCount {
+			dependents += " and " + strconv.Itoa(operation.DependentCount-len(operation.Dependents)) + " more"
+		}
+		return removed + ", but " + dependents + " still depend on it."
+	case OperationRename:
+		if operation.Stub {
+			return "renamed to " + operation.To + ", leaving an obsolete stub."
+		}
+		return "renamed to " + operation.To + " without a stub, please leave one with `PortGroup obsolete 1.0` and `replaced_by " + operation.To + "`."
+	default:
+		return "moved from " + operation.From + " to " + operation.To + "."
+	}
+}
+
+// SetLint records lint output of a job, truncated if too long.
+func (job *Job) SetLint(lint string) {
+	job.Lint = lint
+	job.truncateLint(maxLintLength)
+}
+
+// truncateLint keeps the first length bytes of the lint output of job.
+func (job *Job) truncateLint(length int) {
+	lint := strings.TrimSuffix(job.Lint, truncated)
+	if len(lint) <= length {
+		return
+	}
+	if length < 0 {
+		length = 0
+	}
+	job.Lint = lint[:length] + truncated
+}
+
+// fit truncates the lint output of the CI jobs to a common length, the
+// longest for which the comment is short enough for GitHub, and returns its
+// body. Lint output is stored once more in the state, where JSON escaping
+// and base64 make its size hard to predict, so the length is bisected.
+func (comment *Comment) fit() string {
+	body := comment.Render()
+	if len(body) <= maxCommentLength || comment.CI == nil {
+		return body
+	}
+	lints := make([]string, len(comment.CI.Jobs))
+	low, high := 0, 0
+	for i, job := range comment.CI.Jobs {
+		lints[i] = job.Lint
+		if len(job.Lint) > high {
+			high = len(job.Lint)
+		}
+	}
+	truncate := func(length int) string {
+		for i, job := range comment.CI.Jobs {
+			job.Lint = lints[i]
+			job.truncateLint(length)
+		}
+		return comment.Render()
+	}
+	for low < high {
+		mid := (low + high + 1) / 2
+		if len(truncate(mid)) <= maxCommentLength {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return truncate(low)
+}
+
+// locks serializes updates of status comments, which happen from webhook
+// events, CI results and the cron. PRs share a lock by hash.
+var locks [64]sync.Mutex
+
+func lock(owner, repo string, number int) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(owner + "/" + repo + "#" + strconv.Itoa(number)))
+	return &locks[h.Sum32()%uint32(len(locks))]
+}
+
+// Get returns the state of the status comment by bot of a PR, or nil if it
+// has none.
+func Get(ctx context.Context, client githubapi.Client, bot, owner, repo string, number int) (*Comment, error) {
+	existing, err := client.FindComment(ctx, owner, repo, number, bot, Marker)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	return Parse(existing.GetBody()), nil
+}
+
+// Update applies change to the status comment of a PR, creating it if it
+// does not exist yet. Only a comment by bot is taken as the status comment.
+// The comment is only edited if its body changed.
+func Update(ctx context.Context, client githubapi.Client, bot, owner, repo string, number int, change func(*Comment)) error {
+	l := lock(owner, repo, number)
+	l.Lock()
+	defer l.Unlock()
+
+	existing, err := client.FindComment(ctx, owner, repo, number, bot, Marker)
+	if err != nil {
+		return err
+	}
+	comment := &Comment{}
+	if existing != nil {
+		if parsed := Parse(existing.GetBody()); parsed != nil {
+			comment = parsed
+		}
+	}
+	change(comment)
+	body := comment.fit()
+	if existing == nil {
+		return client.CreateComment(ctx, owner, repo, number, &body)
+	}
+	if body == existing.GetBody() {
+		return nil
+	}
+	return client.EditComment(ctx, owner, repo, existing.GetID(), &body)
+}
+
+func contains(slice []string, elem string) bool {
+	for _, e := range slice {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
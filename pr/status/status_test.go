@@ -0,0 +1,191 @@
+package status
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/macports/mpbot-github/pr/commits"
+	"github.com/macports/mpbot-github/pr/githubapi"
+)
+
+// stubClient keeps the comments of a single PR.
+type stubClient struct {
+	githubapi.Client
+	comments []*github.IssueComment
+	edits    int
+}
+
+func (stub *stubClient) FindComment(ctx context.Context, owner, repo string, number int, author, marker string) (*github.IssueComment, error) {
+	for _, comment := range stub.comments {
+		if githubapi.IsLogin(comment.GetUser().GetLogin(), author) && strings.Contains(comment.GetBody(), marker) {
+			return comment, nil
+		}
+	}
+	return nil, nil
+}
+
+func (stub *stubClient) CreateComment(ctx context.Context, owner, repo string, number int, body *string) error {
+	stub.comments = append(stub.comments, &github.IssueComment{
+		ID:   github.Int64(int64(len(stub.comments) + 1)),
+		Body: github.String(*body),
+		User: &github.User{Login: github.String("macportsbot[bot]")},
+	})
+	return nil
+}
+
+func (stub *stubClient) EditComment(ctx context.Context, owner, repo string, id int64, body *string) error {
+	stub.comments[id-1].Body = github.String(*body)
+	stub.edits++
+	return nil
+}
+
+func TestRender(t *testing.T) {
+	comment := &Comment{
+		MentionSymbol: "@_",
+		Maintainers:   map[string][]string{"l2dy": {"upx"}, "jverne": {"z", "zlib"}},
+		Labels:        []Label{{Name: "type: update", Reason: "the title mentions an update"}},
+		CI: &Build{Number: "12", URL: "https://travis-ci.org/b/12", Result: "Passed", Jobs: []*Job{
+			{Number: "12.1", Image: "xcode11", State: "passed", Ports: []string{"Port upx success. [Log](https://paste/1)"}},
+		}},
+		Timeout: Timeout{State: TimeoutWaiting, Deadline: time.Date(2020, 5, 4, 12, 0, 0, 0, time.UTC)},
+	}
+	body := comment.Render()
+	assert.True(t, strings.HasPrefix(body, Marker))
+	assert.Contains(t, body, "Notifying maintainers:\n@_jverne for port z, zlib.\n@_l2dy for port upx.\n")
+	assert.Contains(t, body, "- `type: update`: the title mentions an update\n")
+	assert.Contains(t, body, "[Travis Build #12](https://travis-ci.org/b/12) Passed.\n")
+	assert.Contains(t, body, "Job 12.1 on xcode11: passed\n- Port upx success. [Log](https://paste/1)\n")
+	assert.Contains(t, body, "Waiting for maintainers to respond until 2020-05-04 12:00 UTC.\n")
+
+	assert.Equal(t, comment, Parse(body))
+
+	// Maintainers may prefer their ports counted
+	grouped := &Comment{MentionSymbol: "@", Maintainers: comment.Maintainers, GroupAbove: map[string]int{"jverne": 1}}
+	assert.Contains(t, grouped.Render(), "@jverne for 2 ports.\n@l2dy for port upx.\n")
+	problems := &Comment{Commits: []commits.Problem{{SHA: "0123456789abcdef", Subject: "update `upx`", Problem: commits.ProblemPortPrefix("upx")}}}
+	assert.Contains(t, problems.Render(), "#### Commit messages\n")
+	assert.Contains(t, problems.Render(), "- 0123456 `update 'upx'`: "+commits.ProblemPortPrefix("upx")+"\n")
+	assert.NotContains(t, grouped.Render(), "#### Commit messages")
+
+	dependents := &Comment{Dependents: []PortDependents{
+		{Port: "zlib", Direct: 3, Transitive: 7, Examples: []string{"curl", "libpng"}},
+		{Port: "libpng", Direct: 1, Transitive: 1, Examples: []string{"gd2"}},
+	}}
+	assert.Contains(t, dependents.Render(), "#### Dependents\n- zlib: 3 direct, 7 in total, e.g. curl, libpng, …\n- libpng: 1 direct, 1 in total, e.g. gd2\n")
+
+	operations := (&Comment{Operations: []PortOperation{
+		{Port: "upx-ucl", Kind: OperationRemoval, DependentCount: 3, Dependents: []string{"a", "b"}},
+		{Port: "upx-nrv", Kind: OperationRemoval, To: "upx"},
+		{Port: "upx-old", Kind: OperationRemoval},
+		{Port: "upx-devel", Kind: OperationRename, To: "upx-next", Stub: true},
+		{Port: "upx-beta", Kind: OperationRename, To: "upx-next"},
+		{Port: "upx", Kind: OperationMove, From: "archivers", To: "sysutils"},
+	}}).Render()
+	assert.Contains(t, operations, "#### Removals and renames\n"+
+		"- upx-ucl: removed, but a, b and 1 more still depend on it.\n"+
+		"- upx-nrv: removed in favour of upx, no remaining ports depend on it.\n"+
+		"- upx-old: removed, no remaining ports depend on it.\n"+
+		"- upx-devel: renamed to upx-next, leaving an obsolete stub.\n"+
+		"- upx-beta: renamed to upx-next without a stub, please leave one with `PortGroup obsolete 1.0` and `replaced_by upx-next`.\n"+
+		"- upx: moved from archivers to sysutils.\n")
+	assert.Nil(t, Parse("Notifying maintainers:\n"))
+	assert.Nil(t, Parse(Marker+" garbage -->"))
+
+	// Lint output containing the end of an HTML comment does not break the state
+	comment.CI.Jobs[0].SetLint("--> " + strings.Repeat("x", maxLintLength))
+	parsed := Parse(comment.Render())
+	if assert.NotNil(t, parsed) {
+		assert.True(t, strings.HasSuffix(parsed.CI.Jobs[0].Lint, "[truncated]\n"))
+	}
+}
+
+func TestFit(t *testing.T) {
+	comment := &Comment{CI: &Build{Number: "1", URL: "https://travis-ci.org/", Result: "failed"}}
+	for i := 0; i < 10; i++ {
+		job := &Job{Number: strconv.Itoa(i), Image: "xcode10.1", State: "failed"}
+		// Characters escaped in JSON take more room in the state
+		job.SetLint(strings.Repeat("<x>\n", maxLintLength/4))
+		comment.CI.Jobs = append(comment.CI.Jobs, job)
+	}
+	body := comment.fit()
+	assert.True(t, len(body) <= maxCommentLength)
+	assert.True(t, len(body) > maxCommentLength*3/4)
+	parsed := Parse(body)
+	if assert.NotNil(t, parsed) {
+		for _, job := range parsed.CI.Jobs {
+			assert.True(t, strings.HasSuffix(job.Lint, "[truncated]\n"))
+		}
+	}
+
+	// Short comments are left as they are
+	short := &Comment{CI: &Build{Jobs: []*Job{{Number: "1"}}}}
+	short.CI.Jobs[0].SetLint("ok\n")
+	assert.Equal(t, short.Render(), short.fit())
+}
+
+func TestAddAsked(t *testing.T) {
+	comment := &Comment{}
+	assert.Equal(t, []string{"upx", "z"}, comment.AddAsked(AskedDuplicate, []string{"upx", "z"}))
+	assert.Equal(t, []string{"zstd"}, comment.AddAsked(AskedDuplicate, []string{"z", "zstd"}))
+	// Topics are asked about separately
+	assert.Equal(t, []string{"upx"}, comment.AddAsked(AskedChecksum, []string{"upx"}))
+	assert.Nil(t, comment.AddAsked(AskedChecksum, []string{"upx"}))
+
+	parsed := Parse(comment.Render())
+	assert.Equal(t, comment.Asked, parsed.Asked)
+}
+
+func TestSetLabels(t *testing.T) {
+	comment := &Comment{}
+	comment.SetLabels([]string{"type: update", "maintainer: open"}, map[string]string{
+		"type: update":     "the title mentions an update",
+		"maintainer: open": "the ports changed are openmaintainer",
+	})
+	// Labels keep their reason when not explained again, others are dropped
+	comment.SetLabels([]string{"type: update", "help wanted", "maintainer"}, map[string]string{
+		"maintainer": "the sender maintains the ports changed",
+	})
+	assert.Equal(t, []Label{
+		{Name: "type: update", Reason: "the title mentions an update"},
+		{Name: "maintainer", Reason: "the sender maintains the ports changed"},
+	}, comment.Labels)
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	client := &stubClient{}
+	client.CreateComment(ctx, "macports", "macports-ports", 1, github.String("LGTM"))
+	// Comments by others are not taken as the status comment
+	client.comments = append(client.comments, &github.IssueComment{
+		ID:   github.Int64(2),
+		Body: github.String(Marker + " e30= -->\n"),
+		User: &github.User{Login: github.String("l2dy")},
+	})
+
+	assert.NoError(t, Update(ctx, client, "macportsbot", "macports", "macports-ports", 1, func(comment *Comment) {
+		comment.AddMaintainers(map[string][]string{"l2dy": {"upx"}})
+	}))
+	assert.Len(t, client.comments, 3)
+
+	// Sections are updated in place
+	assert.NoError(t, Update(ctx, client, "macportsbot", "macports", "macports-ports", 1, func(comment *Comment) {
+		comment.Timeout = Timeout{State: TimeoutExpired}
+	}))
+	assert.Len(t, client.comments, 3)
+	assert.Equal(t, 1, client.edits)
+	body := client.comments[2].GetBody()
+	assert.Contains(t, body, "for port upx.")
+	assert.Contains(t, body, "Maintainers did not respond in time.")
+
+	// Unchanged comments are not edited
+	assert.NoError(t, Update(ctx, client, "macportsbot", "macports", "macports-ports", 1, func(comment *Comment) {
+		comment.AddMaintainers(map[string][]string{"l2dy": {"upx"}})
+	}))
+	assert.Equal(t, 1, client.edits)
+}
@@ -0,0 +1,100 @@
+package trac
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client updates Trac tickets.
+type Client interface {
+	// UpdateTicket adds a comment to a ticket, and resolves it as fixed if
+	// resolve is set and it is not closed yet.
+	UpdateTicket(ctx context.Context, ticket int, comment string, resolve bool) error
+}
+
+type xmlrpcClient struct {
+	endpoint       string
+	user, password string
+	httpClient     *http.Client
+}
+
+// NewClient returns a Client of the XML-RPC API of the Trac instance at
+// baseURL, authenticating as user.
+func NewClient(baseURL, user, password string) Client {
+	return &xmlrpcClient{
+		endpoint:   strings.TrimRight(baseURL, "/") + "/login/rpc",
+		user:       user,
+		password:   password,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (client *xmlrpcClient) call(ctx context.Context, method string, params ...interface{}) (interface{}, error) {
+	body, err := encodeCall(method, params...)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, client.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/xml")
+	req.SetBasicAuth(client.user, client.password)
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("trac: " + method + ": " + resp.Status)
+	}
+	return decodeResponse(data)
+}
+
+// UpdateTicket reads the ticket first, as Trac rejects updates without the
+// timestamp of the last change, which detects concurrent changes.
+func (client *xmlrpcClient) UpdateTicket(ctx context.Context, ticket int, comment string, resolve bool) error {
+	result, err := client.call(ctx, "ticket.get", ticket)
+	if err != nil {
+		return err
+	}
+	// [id, time_created, time_changed, attributes]
+	fields, ok := result.([]interface{})
+	if !ok || len(fields) != 4 {
+		return errors.New("trac: unexpected ticket.get result for #" + strconv.Itoa(ticket))
+	}
+	current, ok := fields[3].(map[string]interface{})
+	if !ok {
+		return errors.New("trac: unexpected ticket.get result for #" + strconv.Itoa(ticket))
+	}
+	attributes := map[string]interface{}{"action": "leave"}
+	if ts, ok := current["_ts"].(string); ok {
+		attributes["_ts"] = ts
+	}
+	if resolve && current["status"] != "closed" {
+		attributes["action"] = "resolve"
+		attributes["action_resolve_resolve_resolution"] = "fixed"
+	}
+	_, err = client.call(ctx, "ticket.update", ticket, comment, attributes, true)
+	return err
+}
+
+// DryRunClient logs ticket updates instead of making them.
+type DryRunClient struct{}
+
+func (DryRunClient) UpdateTicket(ctx context.Context, ticket int, comment string, resolve bool) error {
+	log.Println("dry run: Trac #"+strconv.Itoa(ticket)+" resolve="+strconv.FormatBool(resolve)+":", comment)
+	return nil
+}
@@ -0,0 +1,84 @@
+package trac
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tracStandIn serves the XML-RPC methods of Trac used by the client.
+type tracStandIn struct {
+	status string
+	calls  []*methodCall
+}
+
+func (standIn *tracStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != "macportsbot" || password != "secret" || r.URL.Path != "/login/rpc" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	call := &methodCall{}
+	if err := xml.Unmarshal(data, call); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	standIn.calls = append(standIn.calls, call)
+	w.Header().Set("Content-Type", "text/xml")
+	switch call.MethodName {
+	case "ticket.get":
+		w.Write([]byte(`<?xml version="1.0"?><methodResponse><params><param><value><array><data>
+<value><int>61234</int></value>
+<value><dateTime.iso8601>20201001T10:00:00</dateTime.iso8601></value>
+<value><dateTime.iso8601>20201002T10:00:00</dateTime.iso8601></value>
+<value><struct>
+<member><name>status</name><value><string>` + standIn.status + `</string></value></member>
+<member><name>_ts</name><value>1601632800000000</value></member>
+</struct></value>
+</data></array></value></param></params></methodResponse>`))
+	case "ticket.update":
+		w.Write([]byte(`<?xml version="1.0"?><methodResponse><params><param><value><array><data></data></array></value></param></params></methodResponse>`))
+	default:
+		w.Write([]byte(`<?xml version="1.0"?><methodResponse><fault><value><struct>
+<member><name>faultCode</name><value><int>1</int></value></member>
+<member><name>faultString</name><value><string>unknown method</string></value></member>
+</struct></value></fault></methodResponse>`))
+	}
+}
+
+func TestUpdateTicket(t *testing.T) {
+	standIn := &tracStandIn{status: "assigned"}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	client := NewClient(server.URL, "macportsbot", "secret")
+	ctx := context.Background()
+
+	assert.NoError(t, client.UpdateTicket(ctx, 61234, "Pull request: https://github.com/macports/macports-ports/pull/3", false))
+	assert.Len(t, standIn.calls, 2)
+	update := standIn.calls[1]
+	assert.Equal(t, "ticket.update", update.MethodName)
+	assert.Equal(t, 61234, update.Params[0].decode())
+	assert.Equal(t, "Pull request: https://github.com/macports/macports-ports/pull/3", update.Params[1].decode())
+	assert.Equal(t, map[string]interface{}{"action": "leave", "_ts": "1601632800000000"}, update.Params[2].decode())
+
+	standIn.calls = nil
+	assert.NoError(t, client.UpdateTicket(ctx, 61234, "Fixed", true))
+	assert.Equal(t, "resolve", standIn.calls[1].Params[2].decode().(map[string]interface{})["action"])
+	assert.Equal(t, "fixed", standIn.calls[1].Params[2].decode().(map[string]interface{})["action_resolve_resolve_resolution"])
+
+	// Closed tickets are only commented on
+	standIn.status = "closed"
+	standIn.calls = nil
+	assert.NoError(t, client.UpdateTicket(ctx, 61234, "Fixed", true))
+	assert.Equal(t, "leave", standIn.calls[1].Params[2].decode().(map[string]interface{})["action"])
+
+	_, err := client.(*xmlrpcClient).call(ctx, "ticket.delete", 61234)
+	assert.EqualError(t, err, "xmlrpc fault 1: unknown method")
+
+	assert.Error(t, NewClient(server.URL, "macportsbot", "wrong").UpdateTicket(ctx, 61234, "", false))
+}
@@ -0,0 +1,68 @@
+// Package trac finds references to Trac tickets in PRs and updates the
+// tickets through the Trac XML-RPC API.
+package trac
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Reference is a ticket referenced by a PR.
+type Reference struct {
+	Ticket int
+	// Whether the PR fixes the ticket, e.g. "Closes: <ticket URL>"
+	Close bool
+}
+
+var (
+	// Keywords before a reference, e.g. "See:" or "Closes"
+	keyword = `(?i:(see|close[sd]?|fix(?:e[sd])?|resolve[sd]?|ref(?:s|erences?)?|ticket|trac))`
+	// Bare ticket numbers are only references after a keyword that GitHub
+	// does not use for its own issues, as "Fixes #123" closes GitHub #123
+	bareReference  = regexp.MustCompile(`\b(?i:(see|ref(?:s|erences?)?|ticket|trac))\b:?\s+#(\d+)\b`)
+	closingKeyword = regexp.MustCompile(`^(?i:close[sd]?|fix(?:e[sd])?|resolve[sd]?)$`)
+)
+
+// Finder finds references to the tickets of a Trac instance.
+type Finder struct {
+	url *regexp.Regexp
+}
+
+// NewFinder returns a Finder for the Trac instance at baseURL, e.g.
+// "https://trac.macports.org".
+func NewFinder(baseURL string) *Finder {
+	host := strings.TrimRight(baseURL, "/")
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	return &Finder{
+		url: regexp.MustCompile(`(?:` + keyword + `\b:?\s+)?https?://` + regexp.QuoteMeta(host) + `/ticket/(\d+)\b`),
+	}
+}
+
+// Find returns the tickets referenced in texts, such as the body and the
+// commit messages of a PR, sorted by ticket. A ticket is closed if a
+// closing keyword is directly followed by its full URL, e.g. "Fixes:
+// https://trac.macports.org/ticket/12345".
+func (finder *Finder) Find(texts ...string) []Reference {
+	closes := make(map[int]bool)
+	for _, text := range texts {
+		for _, re := range []*regexp.Regexp{finder.url, bareReference} {
+			for _, match := range re.FindAllStringSubmatch(text, -1) {
+				ticket, err := strconv.Atoi(match[2])
+				if err != nil {
+					continue
+				}
+				closes[ticket] = closes[ticket] || (re == finder.url && closingKeyword.MatchString(match[1]))
+			}
+		}
+	}
+	references := make([]Reference, 0, len(closes))
+	for ticket, close := range closes {
+		references = append(references, Reference{Ticket: ticket, Close: close})
+	}
+	sort.Slice(references, func(i, j int) bool {
+		return references[i].Ticket < references[j].Ticket
+	})
+	return references
+}
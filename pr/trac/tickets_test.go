@@ -0,0 +1,27 @@
+package trac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFind(t *testing.T) {
+	finder := NewFinder("https://trac.macports.org/")
+	body := "upx: update to 3.96\n\n" +
+		"Closes: https://trac.macports.org/ticket/61234\n" +
+		"See: https://trac.macports.org/ticket/60001, http://trac.macports.org/ticket/60002\n" +
+		"Follow-up to #8000, see #59999 and fixes #61235.\n" +
+		"Closes a regression from https://trac.macports.org/ticket/58000\n" +
+		"Not a ticket: https://trac.example.org/ticket/1 or macports/macports-base#42\n"
+	commit := "upx: fix build\n\nFixes https://trac.macports.org/ticket/60001"
+	assert.Equal(t, []Reference{
+		{Ticket: 58000},
+		{Ticket: 59999},
+		{Ticket: 60001, Close: true},
+		{Ticket: 60002},
+		{Ticket: 61234, Close: true},
+	}, finder.Find(body, commit))
+
+	assert.Empty(t, finder.Find("No tickets, see #"))
+}
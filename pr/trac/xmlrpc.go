@@ -0,0 +1,167 @@
+package trac
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// The subset of XML-RPC used with the Trac API.
+
+type methodCall struct {
+	XMLName    xml.Name `xml:"methodCall"`
+	MethodName string   `xml:"methodName"`
+	Params     []value  `xml:"params>param>value"`
+}
+
+type methodResponse struct {
+	Params []value `xml:"params>param>value"`
+	Fault  *value  `xml:"fault>value"`
+}
+
+type value struct {
+	String   *string  `xml:"string"`
+	Int      *int     `xml:"int"`
+	I4       *int     `xml:"i4"`
+	Boolean  *int     `xml:"boolean"`
+	Double   *float64 `xml:"double"`
+	DateTime *string  `xml:"dateTime.iso8601"`
+	Base64   *string  `xml:"base64"`
+	Struct   *struct {
+		Members []member `xml:"member"`
+	} `xml:"struct"`
+	Array *struct {
+		Values []value `xml:"data>value"`
+	} `xml:"array"`
+	// Values without a type are strings
+	Text string `xml:",chardata"`
+}
+
+type member struct {
+	Name  string `xml:"name"`
+	Value value  `xml:"value"`
+}
+
+// decode returns v as a string, int, bool, float64, []interface{} or
+// map[string]interface{}. Dates and base64 are returned as strings.
+func (v *value) decode() interface{} {
+	switch {
+	case v.String != nil:
+		return *v.String
+	case v.Int != nil:
+		return *v.Int
+	case v.I4 != nil:
+		return *v.I4
+	case v.Boolean != nil:
+		return *v.Boolean == 1
+	case v.Double != nil:
+		return *v.Double
+	case v.DateTime != nil:
+		return *v.DateTime
+	case v.Base64 != nil:
+		return *v.Base64
+	case v.Struct != nil:
+		m := make(map[string]interface{}, len(v.Struct.Members))
+		for _, member := range v.Struct.Members {
+			m[member.Name] = member.Value.decode()
+		}
+		return m
+	case v.Array != nil:
+		a := make([]interface{}, len(v.Array.Values))
+		for i := range v.Array.Values {
+			a[i] = v.Array.Values[i].decode()
+		}
+		return a
+	default:
+		return v.Text
+	}
+}
+
+// encodeCall returns the XML-RPC request calling method with params, which
+// may be strings, ints, bools and map[string]interface{} of those.
+func encodeCall(method string, params ...interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + "<methodCall><methodName>")
+	xml.EscapeText(&buf, []byte(method))
+	buf.WriteString("</methodName><params>")
+	for _, param := range params {
+		buf.WriteString("<param>")
+		if err := encodeValue(&buf, param); err != nil {
+			return nil, err
+		}
+		buf.WriteString("</param>")
+	}
+	buf.WriteString("</params></methodCall>")
+	return buf.Bytes(), nil
+}
+
+func encodeValue(buf *bytes.Buffer, v interface{}) error {
+	buf.WriteString("<value>")
+	switch v := v.(type) {
+	case string:
+		buf.WriteString("<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>")
+	case int:
+		buf.WriteString("<int>" + strconv.Itoa(v) + "</int>")
+	case bool:
+		b := "0"
+		if v {
+			b = "1"
+		}
+		buf.WriteString("<boolean>" + b + "</boolean>")
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buf.WriteString("<struct>")
+		for _, name := range names {
+			buf.WriteString("<member><name>")
+			xml.EscapeText(buf, []byte(name))
+			buf.WriteString("</name>")
+			if err := encodeValue(buf, v[name]); err != nil {
+				return err
+			}
+			buf.WriteString("</member>")
+		}
+		buf.WriteString("</struct>")
+	default:
+		return errors.New("xmlrpc: unsupported parameter type")
+	}
+	buf.WriteString("</value>")
+	return nil
+}
+
+// Fault is an error returned by the XML-RPC server.
+type Fault struct {
+	Code   int
+	String string
+}
+
+func (fault *Fault) Error() string {
+	return "xmlrpc fault " + strconv.Itoa(fault.Code) + ": " + fault.String
+}
+
+// decodeResponse returns the result of an XML-RPC response, or its fault.
+func decodeResponse(data []byte) (interface{}, error) {
+	response := &methodResponse{}
+	if err := xml.Unmarshal(data, response); err != nil {
+		return nil, err
+	}
+	if response.Fault != nil {
+		fault := &Fault{}
+		if m, ok := response.Fault.decode().(map[string]interface{}); ok {
+			fault.Code, _ = m["faultCode"].(int)
+			fault.String, _ = m["faultString"].(string)
+		}
+		return nil, fault
+	}
+	if len(response.Params) != 1 {
+		return nil, errors.New("xmlrpc: expected one result")
+	}
+	return response.Params[0].decode(), nil
+}
@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/macports/mpbot-github/pr/db"
+)
+
+// preferencesCommand shows or changes the notification preferences of the
+// sender of a comment, given as "key=value" arguments, and replies to it.
+func (receiver *Receiver) preferencesCommand(ctx context.Context, owner, repo string, number int, sender, args string) error {
+	preferences, err := receiver.dbHelper.GetPreferences(ctx, []string{sender})
+	if err != nil {
+		return err
+	}
+	p := preferences[sender]
+	if p == nil {
+		p = db.DefaultPreferences(sender)
+	}
+
+	var reply string
+	if err := parsePreferences(p, strings.Fields(args), time.Now()); err != nil {
+		reply = receiver.mentionSymbol() + sender + ", " + err.Error() + ".\n\n" + receiver.preferencesUsage()
+	} else {
+		if strings.TrimSpace(args) != "" {
+			if err := receiver.dbHelper.SetPreferences(ctx, p); err != nil {
+				return err
+			}
+		}
+		yesNo := map[bool]string{true: "yes", false: "no"}
+		reply = "Notification preferences of " + receiver.mentionSymbol() + sender + ":\n" +
+			"- assign: " + yesNo[p.Assign] + "\n" +
+			"- openmaintainer: " + yesNo[p.OpenMaintainer] + "\n" +
+			"- group: " + strconv.Itoa(p.GroupAbove) + "\n" +
+			"- away: " + formatAway(p) + "\n\n" + receiver.preferencesUsage()
+	}
+	return receiver.githubClient.CreateComment(detach(ctx), owner, repo, number, &reply)
+}
+
+func (receiver *Receiver) preferencesUsage() string {
+	// Without "@", so that quoting the reply does not run the command again
+	return "Change them by mentioning " + receiver.config.GitHub.BotName + " followed by `preferences assign=no openmaintainer=no group=10 away=YYYY-MM-DD`:\n" +
+		"- assign: whether to be assigned to PRs in addition to being mentioned\n" +
+		"- openmaintainer: whether to be notified of PRs changing openmaintainer ports\n" +
+		"- group: mention the number of ports instead of listing them above this many ports, 0 to always list them\n" +
+		"- away: `YYYY-MM-DD` to be away until that day, `YYYY-MM-DD..YYYY-MM-DD` for a later period, or `no`; " +
+		"away maintainers are not assigned, and PRs only waiting for away maintainers time out right away\n"
+}
+
+// dateFormat is the format of away dates, which are in UTC.
+const dateFormat = "2006-01-02"
+
+func formatAway(p *db.Preferences) string {
+	switch {
+	case p.AwayUntil.IsZero():
+		return "no"
+	case p.AwayFrom.IsZero():
+		return "until " + p.AwayUntil.UTC().Format(dateFormat)
+	default:
+		return "from " + p.AwayFrom.UTC().Format(dateFormat) + " until " + p.AwayUntil.UTC().Format(dateFormat)
+	}
+}
+
+// parsePreferences applies "key=value" arguments to p, with away periods
+// checked against now.
+func parsePreferences(p *db.Preferences, args []string, now time.Time) error {
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("expected key=value, got `" + arg + "`")
+		}
+		key, value := strings.ToLower(parts[0]), parts[1]
+		switch key {
+		case "assign", "openmaintainer":
+			b, ok := map[string]bool{"yes": true, "true": true, "on": true, "no": false, "false": false, "off": false}[strings.ToLower(value)]
+			if !ok {
+				return errors.New(key + " must be yes or no")
+			}
+			if key == "assign" {
+				p.Assign = b
+			} else {
+				p.OpenMaintainer = b
+			}
+		case "group":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("group must be a number of ports")
+			}
+			p.GroupAbove = n
+		case "away":
+			from, until, err := parseAway(value, now)
+			if err != nil {
+				return err
+			}
+			p.AwayFrom, p.AwayUntil = from, until
+		default:
+			return errors.New("unknown preference `" + key + "`")
+		}
+	}
+	return nil
+}
+
+// parseAway parses an away period, returning zero times for "no".
+func parseAway(value string, now time.Time) (from, until time.Time, err error) {
+	if strings.EqualFold(value, "no") {
+		return time.Time{}, time.Time{}, nil
+	}
+	invalid := errors.New("away must be `YYYY-MM-DD`, `YYYY-MM-DD..YYYY-MM-DD` or `no`")
+	dates := strings.SplitN(value, "..", 2)
+	if len(dates) == 2 {
+		if from, err = time.Parse(dateFormat, dates[0]); err != nil {
+			return time.Time{}, time.Time{}, invalid
+		}
+	}
+	if until, err = time.Parse(dateFormat, dates[len(dates)-1]); err != nil {
+		return time.Time{}, time.Time{}, invalid
+	}
+	if !until.After(now) {
+		return time.Time{}, time.Time{}, errors.New("the away period must end in the future")
+	}
+	if !from.IsZero() && !until.After(from) {
+		return time.Time{}, time.Time{}, errors.New("the away period must end after it starts")
+	}
+	return from, until, nil
+}
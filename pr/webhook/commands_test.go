@@ -0,0 +1,183 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/macports/mpbot-github/pr/config"
+	"github.com/macports/mpbot-github/pr/db"
+)
+
+func TestPreferencesCommand(t *testing.T) {
+	stubClient := &stubGitHubClient{}
+	stubDB := &stubDBHelper{}
+	receiver := &Receiver{
+		config:       config.Default(),
+		githubClient: stubClient,
+		dbHelper:     stubDB,
+		testing:      true,
+	}
+	ctx := context.Background()
+	commentAs := func(sender, body string) error {
+		event := &github.IssueCommentEvent{
+			Action:  ptrOfStr("created"),
+			Issue:   &github.Issue{Number: ptrOfInt(3)},
+			Comment: &github.IssueComment{Body: ptrOfStr(body)},
+			Repo: &github.Repository{
+				Name:  ptrOfStr("macports-ports"),
+				Owner: &github.User{Login: ptrOfStr("macports")},
+			},
+			Sender: &github.User{Login: ptrOfStr(sender)},
+		}
+		payload, _ := json.Marshal(event)
+		return receiver.handleOtherPullRequestEvents(ctx, "issue_comment", payload)
+	}
+	comment := func(body string) error {
+		return commentAs("l2dy", body)
+	}
+
+	// Maintainers need not be members to set their preferences
+	assert.NoError(t, comment("@macportsbot preferences assign=no openmaintainer=off group=10"))
+	assert.Equal(t, &db.Preferences{Handle: "l2dy", Assign: false, OpenMaintainer: false, GroupAbove: 10}, stubDB.preferences["l2dy"])
+	assert.Contains(t, stubClient.newComment, "Notification preferences of @_l2dy:\n- assign: no\n- openmaintainer: no\n- group: 10\n")
+
+	// Without arguments, preferences are only shown
+	assert.NoError(t, comment("@macportsbot preferences"))
+	assert.Contains(t, stubClient.newComment, "- group: 10\n")
+
+	// Invalid preferences are not stored
+	assert.NoError(t, comment("@macportsbot preferences assign=maybe"))
+	assert.Contains(t, stubClient.newComment, "@_l2dy, assign must be yes or no.")
+	assert.NoError(t, comment("@macportsbot preferences colour=blue"))
+	assert.Contains(t, stubClient.newComment, "unknown preference `colour`")
+	assert.False(t, stubDB.preferences["l2dy"].Assign)
+
+	assert.NoError(t, comment("@macportsbot preferences away=2099-01-01"))
+	assert.Equal(t, time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC), stubDB.preferences["l2dy"].AwayUntil)
+	assert.Contains(t, stubClient.newComment, "- away: until 2099-01-01\n")
+	assert.NoError(t, comment("@macportsbot preferences away=no"))
+	assert.Contains(t, stubClient.newComment, "- away: no\n")
+
+	// Replies of the bot, or quoted by a user, do not run the command again
+	replies := stubClient.comments
+	reply := stubClient.newComment
+	assert.NoError(t, commentAs("macportsbot", reply))
+	assert.NoError(t, commentAs("macportsbot[bot]", "@macportsbot preferences"))
+	assert.NoError(t, comment("> "+reply))
+	assert.Equal(t, replies, stubClient.comments)
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	stubClient := &stubGitHubClient{}
+	stubDB := &stubDBHelper{}
+	receiver := &Receiver{
+		config:       config.Default(),
+		githubClient: stubClient,
+		dbHelper:     stubDB,
+		testing:      true,
+	}
+	ctx := context.Background()
+	opened := &github.PullRequestEvent{
+		Action: ptrOfStr("opened"),
+		Number: ptrOfInt(3),
+		PullRequest: &github.PullRequest{
+			Title: ptrOfStr("upx: update to 3.96"),
+			Body:  ptrOfStr(""),
+		},
+		Repo: &github.Repository{
+			Name:  ptrOfStr("macports-ports"),
+			Owner: &github.User{Login: ptrOfStr("macports")},
+		},
+		Sender: &github.User{Login: ptrOfStr("jverne")},
+	}
+
+	// Mentioned but not assigned
+	stubDB.SetPreferences(ctx, &db.Preferences{Handle: "l2dy", Assign: false, OpenMaintainer: true})
+	assert.NoError(t, receiver.processPullRequest(ctx, opened))
+	assert.Contains(t, stubClient.newComment, "@_l2dy for port upx.")
+	assert.Empty(t, stubClient.assignees)
+
+	// upx is openmaintainer
+	stubClient.issueComments = nil
+	stubDB.SetPreferences(ctx, &db.Preferences{Handle: "l2dy", Assign: true, OpenMaintainer: false})
+	assert.NoError(t, receiver.processPullRequest(ctx, opened))
+	assert.NotContains(t, stubClient.newComment, "@_l2dy")
+	assert.Empty(t, stubClient.assignees)
+	// Still waited for, as a maintainer of the port
+	assert.Equal(t, []string{"l2dy"}, stubDB.prs[3].Maintainers)
+
+	stubClient.issueComments = nil
+	stubDB.SetPreferences(ctx, db.DefaultPreferences("l2dy"))
+	assert.NoError(t, receiver.processPullRequest(ctx, opened))
+	assert.Contains(t, stubClient.newComment, "@_l2dy for port upx.")
+	assert.Equal(t, []string{"l2dy"}, stubClient.assignees)
+}
+
+func TestParseAway(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	date := func(day int) time.Time { return time.Date(2026, 11, day, 0, 0, 0, 0, time.UTC) }
+
+	from, until, err := parseAway("2026-11-01", now)
+	assert.NoError(t, err)
+	assert.True(t, from.IsZero())
+	assert.Equal(t, date(1), until)
+
+	from, until, err = parseAway("2026-11-01..2026-11-15", now)
+	assert.NoError(t, err)
+	assert.Equal(t, date(1), from)
+	assert.Equal(t, date(15), until)
+
+	from, until, err = parseAway("no", now)
+	assert.NoError(t, err)
+	assert.True(t, from.IsZero())
+	assert.True(t, until.IsZero())
+
+	for _, value := range []string{"2026-10-18", "2026-11-15..2026-11-01", "next week", "2026-11-01.."} {
+		_, _, err := parseAway(value, now)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestAwayMaintainers(t *testing.T) {
+	stubClient := &stubGitHubClient{}
+	stubDB := &stubDBHelper{}
+	receiver := &Receiver{
+		config:       config.Default(),
+		githubClient: stubClient,
+		dbHelper:     stubDB,
+		testing:      true,
+	}
+	ctx := context.Background()
+	until := time.Now().Add(7 * 24 * time.Hour).UTC()
+	stubDB.SetPreferences(ctx, &db.Preferences{Handle: "l2dy", Assign: true, OpenMaintainer: true, AwayUntil: until})
+
+	opened := &github.PullRequestEvent{
+		Action: ptrOfStr("opened"),
+		Number: ptrOfInt(3),
+		PullRequest: &github.PullRequest{
+			Title: ptrOfStr("upx: update to 3.96"),
+			Body:  ptrOfStr(""),
+		},
+		Repo: &github.Repository{
+			Name:  ptrOfStr("macports-ports"),
+			Owner: &github.User{Login: ptrOfStr("macports")},
+		},
+		Sender: &github.User{Login: ptrOfStr("jverne")},
+	}
+	assert.NoError(t, receiver.processPullRequest(ctx, opened))
+	assert.Contains(t, stubClient.newComment, "@_l2dy for port upx (away until "+until.Format("2006-01-02")+").")
+	assert.Empty(t, stubClient.assignees)
+	assert.Contains(t, stubClient.newComment, "All maintainers are away")
+
+	// Back from the away period
+	stubClient.issueComments = nil
+	stubDB.SetPreferences(ctx, db.DefaultPreferences("l2dy"))
+	assert.NoError(t, receiver.processPullRequest(ctx, opened))
+	assert.Contains(t, stubClient.newComment, "@_l2dy for port upx.")
+	assert.Contains(t, stubClient.newComment, "Waiting for maintainers to respond until")
+}
@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/macports/mpbot-github/pr/commits"
+	"github.com/macports/mpbot-github/pr/githubapi"
+	"github.com/macports/mpbot-github/pr/status"
+)
+
+const (
+	// maxCheckedCommits limits the commits whose files are looked up, one
+	// request each, to check their subjects against the ports they change.
+	maxCheckedCommits = 100
+	// maxCachedCommits bounds commitPortsCache, which is emptied when full
+	maxCachedCommits = 10000
+)
+
+// commitPortsCache keeps the ports changed by each commit, which never
+// change for a SHA, so that a push only looks up the files of new commits.
+type commitPortsCache struct {
+	ports map[string][]string
+	lock  sync.Mutex
+}
+
+func (cache *commitPortsCache) get(sha string) ([]string, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	ports, ok := cache.ports[sha]
+	return ports, ok
+}
+
+func (cache *commitPortsCache) add(sha string, ports []string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.ports == nil || len(cache.ports) >= maxCachedCommits {
+		cache.ports = make(map[string][]string)
+	}
+	cache.ports[sha] = ports
+}
+
+// previousCommitProblems returns the commit problems in the status comment of
+// a PR, which are kept when its commits cannot be listed.
+func (receiver *Receiver) previousCommitProblems(ctx context.Context, owner, repo string, number int) []commits.Problem {
+	comment, err := status.Get(ctx, receiver.githubClient, receiver.config.GitHub.BotName, owner, repo, number)
+	if err != nil {
+		log.Println(err)
+	}
+	if comment == nil {
+		return nil
+	}
+	return comment.Commits
+}
+
+// checkCommits returns the commits of a PR that do not follow the commit
+// message conventions. A PR of a single commit, besides merges, changes the
+// ports of the PR, prPorts, and the files of other commits are looked up.
+func (receiver *Receiver) checkCommits(ctx context.Context, owner, repo string, prCommits []*github.RepositoryCommit, prPorts []string) []commits.Problem {
+	checked := make([]*commits.Commit, 0, len(prCommits))
+	for _, prCommit := range prCommits {
+		checked = append(checked, &commits.Commit{
+			SHA:     prCommit.GetSHA(),
+			Message: prCommit.GetCommit().GetMessage(),
+			Parents: len(prCommit.Parents),
+		})
+	}
+	var single []*commits.Commit
+	for _, commit := range checked {
+		if commit.Parents <= 1 {
+			single = append(single, commit)
+		}
+	}
+	if len(single) == 1 {
+		for _, port := range prPorts {
+			single[0].Ports = appendIfUnique(single[0].Ports, port)
+		}
+		return commits.Check(checked)
+	}
+	for i, commit := range single {
+		if i >= maxCheckedCommits {
+			break
+		}
+		if ports, ok := receiver.commitPorts.get(commit.SHA); ok {
+			commit.Ports = ports
+			continue
+		}
+		files, err := receiver.githubClient.ListCommitFiles(ctx, owner, repo, commit.SHA)
+		if err != nil {
+			log.Println("Error listing files of commit " + commit.SHA + ": " + err.Error())
+			continue
+		}
+		for _, file := range files {
+			if port := githubapi.PortOfPath(file); port != "" {
+				commit.Ports = appendIfUnique(commit.Ports, port)
+			}
+		}
+		receiver.commitPorts.add(commit.SHA, commit.Ports)
+	}
+	return commits.Check(checked)
+}
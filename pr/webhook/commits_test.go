@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitMessages(t *testing.T) {
+	stubClient := &stubGitHubClient{
+		labels: make(map[int][]string),
+		commits: map[int][]*github.RepositoryCommit{1: {
+			{SHA: ptrOfStr("1111111aaa"), Commit: &github.Commit{Message: ptrOfStr("Update to 1.1")}, Parents: []github.Commit{{}}},
+			{SHA: ptrOfStr("2222222bbb"), Commit: &github.Commit{Message: ptrOfStr("Merge branch 'master' into z")}, Parents: []github.Commit{{}, {}}},
+		}},
+		commitFiles: make(map[string][]string),
+	}
+	stubDB := &stubDBHelper{}
+	receiver := newTestReceiver(stubClient, stubDB)
+	ctx := context.Background()
+	event := newPullRequestEvent("opened", 1, "z: update to 1.1")
+
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	assert.Contains(t, stubClient.newLabels, "needs: commit message fix")
+	comment, _ := stubClient.FindComment(ctx, "macports", "macports-ports", 1, "macportsbot", "<!-- mpbot-status")
+	assert.Contains(t, comment.GetBody(), "- 1111111 `Update to 1.1`: subject does not start with the port changed, e.g. `z: `\n")
+	assert.Contains(t, comment.GetBody(), "- 2222222 `Merge branch 'master' into z`: merge commit, rebase the branch instead\n")
+	// A single commit besides merges changes the ports of the PR
+	assert.Zero(t, stubClient.commitFileLookups)
+
+	// Commits that cannot be listed leave the problems and tickets alone
+	stubClient.labels[1] = stubClient.newLabels
+	stubClient.commitsErr = errNotFound
+	event.Action = ptrOfStr("synchronize")
+	event.PullRequest.Body = ptrOfStr("See https://trac.macports.org/ticket/12345")
+	stubClient.newLabels = nil
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	// Unchanged labels are not replaced
+	assert.Nil(t, stubClient.newLabels)
+	comment, _ = stubClient.FindComment(ctx, "macports", "macports-ports", 1, "macportsbot", "<!-- mpbot-status")
+	assert.Contains(t, comment.GetBody(), "- 2222222 `Merge branch 'master' into z`")
+	assert.Empty(t, stubDB.tickets[1])
+	stubClient.commitsErr = nil
+	event.PullRequest.Body = ptrOfStr("")
+
+	// The files of several commits are looked up once per commit
+	stubClient.commits[1] = []*github.RepositoryCommit{
+		{SHA: ptrOfStr("4444444ddd"), Commit: &github.Commit{Message: ptrOfStr("z: update to 1.1")}, Parents: []github.Commit{{}}},
+		{SHA: ptrOfStr("5555555eee"), Commit: &github.Commit{Message: ptrOfStr("fix the build")}, Parents: []github.Commit{{}}},
+	}
+	stubClient.commitFiles["4444444ddd"] = []string{"sysutils/z/Portfile"}
+	stubClient.commitFiles["5555555eee"] = []string{"sysutils/z/files/patch-build.diff"}
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	assert.Equal(t, 2, stubClient.commitFileLookups)
+	stubClient.labels[1] = stubClient.newLabels
+	comment, _ = stubClient.FindComment(ctx, "macports", "macports-ports", 1, "macportsbot", "<!-- mpbot-status")
+	assert.Contains(t, comment.GetBody(), "- 5555555 `fix the build`: subject does not start with the port changed, e.g. `z: `\n")
+
+	// A push fixing the commits removes the label and the problems
+	stubClient.commits[1] = []*github.RepositoryCommit{
+		{SHA: ptrOfStr("3333333ccc"), Commit: &github.Commit{Message: ptrOfStr("z: update to 1.1")}, Parents: []github.Commit{{}}},
+	}
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	assert.NotContains(t, stubClient.newLabels, "needs: commit message fix")
+	comment, _ = stubClient.FindComment(ctx, "macports", "macports-ports", 1, "macportsbot", "<!-- mpbot-status")
+	assert.NotContains(t, comment.GetBody(), "#### Commit messages")
+}
@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/macports/mpbot-github/pr/githubapi"
+)
+
+// handleDryRun lists the side effects recorded by a dry-run client, newest
+// first. They can be filtered with the owner, repo, number and method query
+// parameters and limited with limit.
+func (receiver *Receiver) handleDryRun(dryRun *githubapi.DryRunClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		number := 0
+		if query.Get("number") != "" {
+			var err error
+			number, err = strconv.Atoi(query.Get("number"))
+			if err != nil {
+				http.Error(w, "invalid number", http.StatusBadRequest)
+				return
+			}
+		}
+		limit := -1
+		if query.Get("limit") != "" {
+			var err error
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		effects := dryRun.SideEffects()
+		matched := make([]githubapi.SideEffect, 0)
+		for i := len(effects) - 1; i >= 0 && len(matched) != limit; i-- {
+			effect := effects[i]
+			if (query.Get("owner") != "" && effect.Owner != query.Get("owner")) ||
+				(query.Get("repo") != "" && effect.Repo != query.Get("repo")) ||
+				(number != 0 && effect.Number != number) ||
+				(query.Get("method") != "" && effect.Method != query.Get("method")) {
+				continue
+			}
+			matched = append(matched, effect)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(matched)
+	}
+}
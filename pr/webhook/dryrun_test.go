@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/macports/mpbot-github/pr/config"
+	"github.com/macports/mpbot-github/pr/githubapi"
+)
+
+func TestDryRun(t *testing.T) {
+	stubClient := &stubGitHubClient{}
+	receiver := &Receiver{
+		config:       config.Default(),
+		githubClient: githubapi.NewDryRunClient(stubClient, 10),
+		dbHelper:     &stubDBHelper{},
+		testing:      true,
+	}
+	handler := receiver.handler()
+
+	for _, number := range []int{1, 3} {
+		number := number
+		assert.NoError(t, receiver.processPullRequest(context.Background(), &github.PullRequestEvent{
+			Action: ptrOfStr("opened"),
+			Number: &number,
+			PullRequest: &github.PullRequest{
+				Title: ptrOfStr("update to 1.1"),
+				Body:  ptrOfStr(""),
+			},
+			Repo: &github.Repository{
+				Name:  ptrOfStr("macports-ports"),
+				Owner: &github.User{Login: ptrOfStr("macports")},
+			},
+			Sender: &github.User{Login: ptrOfStr("jverne")},
+		}))
+	}
+	assert.Empty(t, stubClient.newComment)
+	assert.Nil(t, stubClient.newLabels)
+
+	get := func(path string) (int, []githubapi.SideEffect) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var effects []githubapi.SideEffect
+		json.Unmarshal(rec.Body.Bytes(), &effects)
+		return rec.Code, effects
+	}
+
+	code, effects := get("/dryrun")
+	assert.Equal(t, http.StatusOK, code)
+	// Labels and status comment of PR 1, then assignee, labels and status
+	// comment of PR 3
+	if assert.Len(t, effects, 5) {
+		assert.Equal(t, "CreateComment", effects[0].Method)
+		assert.Equal(t, 3, effects[0].Number)
+		assert.Equal(t, 1, effects[4].Number)
+	}
+
+	_, effects = get("/dryrun?number=3&method=CreateComment")
+	if assert.Len(t, effects, 1) {
+		assert.Contains(t, effects[0].Body, "Notifying maintainers:\n@_l2dy for port upx.\n")
+	}
+	_, effects = get("/dryrun?limit=1")
+	assert.Len(t, effects, 1)
+	code, _ = get("/dryrun?limit=some")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Only served in dry-run mode, otherwise taken for a webhook delivery
+	receiver.githubClient = stubClient
+	handler = receiver.handler()
+	code, _ = get("/dryrun")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
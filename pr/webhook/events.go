@@ -0,0 +1,282 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/macports/mpbot-github/pr/db"
+	"github.com/macports/mpbot-github/pr/metrics"
+)
+
+const (
+	// Deliveries are given up after this many failed attempts
+	maxEventAttempts = 8
+	// Delay before the first retry, doubled on each further attempt
+	eventRetryBase = time.Minute
+	eventRetryMax  = 6 * time.Hour
+	// How often stored deliveries are checked for due retries
+	replayInterval = time.Minute
+	// How long shutdown waits for aborted changes to PRs to return, unless
+	// the receiver sets another timeout
+	abortTimeout = 5 * time.Second
+	// How far the time a /reprocess request was signed at may be from now
+	reprocessWindow = 5 * time.Minute
+)
+
+var (
+	errNoDB      = errors.New("no database available")
+	errQueueFull = errors.New("event queue full")
+	// Wrapped by the errors of handlers that panicked
+	errPanic = errors.New("panic")
+)
+
+// saveEvent persists a verified delivery before it is acknowledged.
+// It returns a nil event if the delivery has been seen before.
+func (receiver *Receiver) saveEvent(ctx context.Context, deliveryID, eventType string, payload []byte) (*db.Event, error) {
+	if receiver.dbHelper == nil {
+		return nil, errNoDB
+	}
+	inserted, err := receiver.dbHelper.SaveEvent(ctx, deliveryID, eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+	if !inserted {
+		return nil, nil
+	}
+	return &db.Event{
+		DeliveryID: deliveryID,
+		Type:       eventType,
+		Payload:    payload,
+	}, nil
+}
+
+// reprocessEvent forces a stored delivery to be processed again, even if it
+// has already been handled.
+func (receiver *Receiver) reprocessEvent(ctx context.Context, deliveryID string) error {
+	if receiver.dbHelper == nil {
+		return errNoDB
+	}
+	event, err := receiver.dbHelper.ResetEvent(ctx, deliveryID)
+	if err != nil {
+		return err
+	}
+	log.Println("Reprocessing delivery " + deliveryID)
+	if !receiver.dispatch(event) {
+		return errQueueFull
+	}
+	return nil
+}
+
+// acceptReprocess reports whether a signed /reprocess request was signed
+// recently and not accepted before, so that a captured request cannot be
+// replayed. Requests are remembered until their time is out of the window.
+func (receiver *Receiver) acceptReprocess(body []byte, signedAt time.Time) bool {
+	now := time.Now()
+	if signedAt.Before(now.Add(-reprocessWindow)) || signedAt.After(now.Add(reprocessWindow)) {
+		return false
+	}
+	sum := sha256.Sum256(body)
+	key := hex.EncodeToString(sum[:])
+
+	receiver.reprocessedLock.Lock()
+	defer receiver.reprocessedLock.Unlock()
+	for seenKey, seen := range receiver.reprocessed {
+		if now.Sub(seen) > 2*reprocessWindow {
+			delete(receiver.reprocessed, seenKey)
+		}
+	}
+	if _, ok := receiver.reprocessed[key]; ok {
+		return false
+	}
+	if receiver.reprocessed == nil {
+		receiver.reprocessed = make(map[string]time.Time)
+	}
+	receiver.reprocessed[key] = now
+	return true
+}
+
+// dispatch queues a stored delivery on the worker pool unless it is already
+// being processed. Events of the same PR are processed in the order they are
+// dispatched. It returns false if the queue stayed full, in which case the
+// delivery is left pending for replayEvents.
+func (receiver *Receiver) dispatch(event *db.Event) bool {
+	receiver.inflightLock.Lock()
+	if receiver.inflight == nil {
+		receiver.inflight = make(map[string]bool)
+	}
+	if receiver.inflight[event.DeliveryID] {
+		receiver.inflightLock.Unlock()
+		return true
+	}
+	receiver.inflight[event.DeliveryID] = true
+	receiver.inflightLock.Unlock()
+
+	done := func() {
+		receiver.inflightLock.Lock()
+		delete(receiver.inflight, event.DeliveryID)
+		receiver.inflightLock.Unlock()
+		receiver.wg.Done()
+	}
+
+	receiver.wg.Add(1)
+	ok := receiver.pool.submit(eventPRNumber(event.Payload), func() {
+		defer done()
+		receiver.processEvent(receiver.ctx, event)
+	})
+	if !ok {
+		log.Println("Queue full, delaying delivery " + event.DeliveryID)
+		done()
+	}
+	return ok
+}
+
+// processEvent claims a delivery, runs its handler and records the outcome,
+// scheduling a retry with exponential backoff on failure. Deliveries that are
+// no longer pending, e.g. because they were dispatched from an outdated list
+// of pending deliveries and processed meanwhile, are skipped. A delivery
+// interrupted by cancelling ctx is left pending, to be replayed on the next
+// start.
+func (receiver *Receiver) processEvent(ctx context.Context, event *db.Event) {
+	if ctx.Err() != nil {
+		log.Println("Shutting down, leaving delivery " + event.DeliveryID + " pending")
+		return
+	}
+	claimed, err := receiver.dbHelper.ClaimEvent(ctx, event.DeliveryID)
+	if err == sql.ErrNoRows {
+		log.Println("Skipping delivery " + event.DeliveryID + ", it is no longer pending")
+		return
+	}
+	if err != nil {
+		log.Println("Error claiming delivery " + event.DeliveryID + ", left pending: " + err.Error())
+		return
+	}
+	event = claimed
+
+	start := time.Now()
+	err = receiver.handleEvent(ctx, event.Type, event.Payload)
+	if err != nil && ctx.Err() != nil {
+		log.Println("Delivery " + event.DeliveryID + " interrupted by shutdown, left pending: " + err.Error())
+		metrics.EventProcessingSeconds.WithLabelValues(event.Type, "interrupted").Observe(time.Since(start).Seconds())
+		// Replayed on the next start without counting as an attempt
+		if err = receiver.dbHelper.SetEventRetry(detach(ctx), event.DeliveryID, event.Attempts, time.Now(), err.Error()); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// The outcome must be recorded even if shutdown started meanwhile
+	ctx = detach(ctx)
+	if err == nil {
+		metrics.EventProcessingSeconds.WithLabelValues(event.Type, db.EventDone).Observe(time.Since(start).Seconds())
+		if err = receiver.dbHelper.SetEventDone(ctx, event.DeliveryID); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	attempts := event.Attempts + 1
+	log.Println("Delivery " + event.DeliveryID + " failed (attempt " + fmt.Sprint(attempts) + "): " + err.Error())
+	// A panic would most likely happen again, after repeating the changes
+	// made before it
+	if attempts >= maxEventAttempts || errors.Is(err, errPanic) {
+		metrics.EventProcessingSeconds.WithLabelValues(event.Type, db.EventFailed).Observe(time.Since(start).Seconds())
+		err = receiver.dbHelper.SetEventFailed(ctx, event.DeliveryID, attempts, err.Error())
+	} else {
+		metrics.EventProcessingSeconds.WithLabelValues(event.Type, "retry").Observe(time.Since(start).Seconds())
+		err = receiver.dbHelper.SetEventRetry(ctx, event.DeliveryID, attempts, time.Now().Add(retryDelay(attempts)), err.Error())
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (receiver *Receiver) handleEvent(ctx context.Context, eventType string, body []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errPanic, r)
+		}
+	}()
+
+	switch eventType {
+	case "pull_request":
+		return receiver.handlePullRequest(ctx, body)
+	case "pull_request_review", "issue_comment":
+		return receiver.handleOtherPullRequestEvents(ctx, eventType, body)
+	}
+	return nil
+}
+
+func retryDelay(attempts int) time.Duration {
+	delay := eventRetryBase << uint(attempts-1)
+	if delay > eventRetryMax || delay <= 0 {
+		delay = eventRetryMax
+	}
+	return delay
+}
+
+// replayEvents dispatches pending deliveries left over from a previous run
+// and, periodically, those whose retry is due.
+func (receiver *Receiver) replayEvents() {
+	for {
+		if receiver.dbHelper != nil {
+			events, err := receiver.dbHelper.GetPendingEvents(receiver.ctx)
+			if err != nil {
+				log.Println(err)
+			}
+			for _, event := range events {
+				select {
+				case <-receiver.quit:
+					return
+				default:
+				}
+				if !receiver.dispatch(event) {
+					break
+				}
+			}
+		}
+
+		select {
+		case <-receiver.quit:
+			return
+		case <-time.After(replayInterval):
+		}
+	}
+}
+
+// abortKey is the context key of the context cancelled when shutdown stops
+// waiting even for changes to PRs in progress.
+type abortKey struct{}
+
+// detachedContext keeps the values of its parent but is not cancelled with
+// it, so that changes to a PR that have been started are not cut off
+// halfway. It is only cancelled when shutdown aborts them.
+type detachedContext struct {
+	context.Context
+	abort context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	abort, ok := ctx.Value(abortKey{}).(context.Context)
+	if !ok {
+		abort = context.Background()
+	}
+	return detachedContext{ctx, abort}
+}
+
+func (ctx detachedContext) Deadline() (time.Time, bool) {
+	return ctx.abort.Deadline()
+}
+
+func (ctx detachedContext) Done() <-chan struct{} {
+	return ctx.abort.Done()
+}
+
+func (ctx detachedContext) Err() error {
+	return ctx.abort.Err()
+}
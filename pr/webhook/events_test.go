@@ -0,0 +1,212 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/macports/mpbot-github/pr/config"
+	"github.com/macports/mpbot-github/pr/db"
+	"github.com/macports/mpbot-github/pr/metrics"
+)
+
+func TestProcessEvent(t *testing.T) {
+	stubDB := &stubDBHelper{}
+	receiver := &Receiver{
+		config:       config.Default(),
+		githubClient: &stubGitHubClient{},
+		dbHelper:     stubDB,
+		testing:      true,
+	}
+
+	// PR 4 is unknown to the stub client, so listing its files fails
+	failing := &db.Event{
+		DeliveryID: "failing",
+		Type:       "pull_request",
+		Payload:    []byte(`{"action":"opened","number":4,"repository":{"name":"macports-ports","owner":{"login":"macports"}}}`),
+	}
+	stubDB.SaveEvent(context.Background(), failing.DeliveryID, failing.Type, failing.Payload)
+	receiver.processEvent(context.Background(), failing)
+	assert.Equal(t, db.EventPending, stubDB.eventStatus["failing"])
+	assert.Equal(t, 1, stubDB.eventAttempts["failing"])
+
+	// The attempts are counted as stored, not as dispatched
+	stubDB.eventAttempts["failing"] = maxEventAttempts - 1
+	receiver.processEvent(context.Background(), failing)
+	assert.Equal(t, db.EventFailed, stubDB.eventStatus["failing"])
+	assert.Equal(t, maxEventAttempts, stubDB.eventAttempts["failing"])
+
+	// Panics are not retried, PR 1 lacks the sender
+	panicking := []byte(`{"action":"opened","number":1,"pull_request":{"title":"","body":""},` +
+		`"repository":{"name":"macports-ports","owner":{"login":"macports"}}}`)
+	stubDB.SaveEvent(context.Background(), "panicking", "pull_request", panicking)
+	receiver.processEvent(context.Background(), &db.Event{DeliveryID: "panicking", Type: "pull_request", Payload: panicking})
+	assert.Equal(t, db.EventFailed, stubDB.eventStatus["panicking"])
+	assert.Equal(t, 1, stubDB.eventAttempts["panicking"])
+
+	stubDB.SaveEvent(context.Background(), "ignored", "pull_request", []byte(`{`))
+	receiver.processEvent(context.Background(), &db.Event{DeliveryID: "ignored", Type: "pull_request", Payload: []byte(`{`)})
+	assert.Equal(t, db.EventDone, stubDB.eventStatus["ignored"])
+
+	// Deliveries no longer pending are not processed again
+	stubClient := receiver.githubClient.(*stubGitHubClient)
+	processed := &db.Event{DeliveryID: "processed", Type: "pull_request", Payload: []byte(`{"action":"opened","number":3,` +
+		`"pull_request":{"title":"","body":""},"repository":{"name":"macports-ports","owner":{"login":"macports"}},"sender":{"login":"jverne"}}`)}
+	stubDB.SaveEvent(context.Background(), processed.DeliveryID, processed.Type, processed.Payload)
+	receiver.processEvent(context.Background(), processed)
+	assert.Equal(t, db.EventDone, stubDB.eventStatus["processed"])
+	assert.Equal(t, 1, stubClient.comments)
+	receiver.processEvent(context.Background(), processed)
+	assert.Equal(t, 1, stubClient.comments)
+
+	// Deliveries interrupted by shutdown are left as they were
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	interrupted := &db.Event{DeliveryID: "interrupted", Type: failing.Type, Payload: failing.Payload}
+	receiver.processEvent(ctx, interrupted)
+	assert.Empty(t, stubDB.eventStatus["interrupted"])
+	assert.Zero(t, stubDB.eventAttempts["interrupted"])
+}
+
+func TestShutdown(t *testing.T) {
+	receiver := NewReceiver(context.Background(), config.Default(), &stubGitHubClient{}, &stubDBHelper{}, nil, nil)
+
+	// Finished events are waited for
+	finished := false
+	receiver.wg.Add(1)
+	receiver.pool.submit(1, func() {
+		defer receiver.wg.Done()
+		time.Sleep(10 * time.Millisecond)
+		finished = true
+	})
+	// Others are cancelled after the deadline
+	cancelled := false
+	receiver.wg.Add(1)
+	receiver.pool.submit(2, func() {
+		defer receiver.wg.Done()
+		<-receiver.ctx.Done()
+		cancelled = true
+	})
+
+	// Changes to PRs in progress are aborted after a second deadline
+	aborted := false
+	receiver.wg.Add(1)
+	receiver.pool.submit(3, func() {
+		defer receiver.wg.Done()
+		<-detach(receiver.ctx).Done()
+		aborted = true
+	})
+
+	start := time.Now()
+	receiver.Shutdown(50 * time.Millisecond)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	assert.True(t, finished)
+	assert.True(t, cancelled)
+	assert.True(t, aborted)
+
+	// No events are accepted afterwards
+	assert.False(t, receiver.pool.submit(1, func() {}))
+
+	// Events that do not return are given up on
+	receiver = NewReceiver(context.Background(), config.Default(), &stubGitHubClient{}, &stubDBHelper{}, nil, nil)
+	receiver.abortTimeout = 10 * time.Millisecond
+	stuck := make(chan struct{})
+	defer close(stuck)
+	receiver.wg.Add(1)
+	receiver.pool.submit(1, func() {
+		defer receiver.wg.Done()
+		<-stuck
+	})
+	start = time.Now()
+	receiver.Shutdown(10 * time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.False(t, receiver.pool.submit(2, func() {}))
+
+	// Detached contexts outside a receiver are never cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, detach(ctx).Done())
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, eventRetryBase, retryDelay(1))
+	assert.Equal(t, 4*eventRetryBase, retryDelay(3))
+	assert.Equal(t, eventRetryMax, retryDelay(20))
+	assert.Equal(t, eventRetryMax, retryDelay(100))
+}
+
+func TestDuplicateDelivery(t *testing.T) {
+	stubClient := &stubGitHubClient{}
+	receiver := &Receiver{
+		config:       config.Default(),
+		githubClient: stubClient,
+		dbHelper:     &stubDBHelper{},
+		pool:         newWorkerPool(1, 1),
+		ctx:          context.Background(),
+		testing:      true,
+	}
+	defer receiver.pool.stop()
+	handler := receiver.handler()
+
+	post := func(path, deliveryID, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+sign(sha256.New, []byte(receiver.config.GitHub.WebhookSecret), []byte(body)))
+		req.Header.Set("X-GitHub-Event", "pull_request")
+		if deliveryID != "" {
+			req.Header.Set("X-GitHub-Delivery", deliveryID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		receiver.wg.Wait()
+		return rec.Code
+	}
+
+	payload := `{"action":"opened","number":3,"pull_request":{"title":"","body":""},` +
+		`"repository":{"name":"macports-ports","owner":{"login":"macports"}},"sender":{"login":"jverne"}}`
+
+	// Unsigned deliveries do not choose the event label of metrics
+	invalid := testutil.ToFloat64(metrics.WebhookDeliveries.WithLabelValues(metrics.EventUnknown, "invalid"))
+	req := httptest.NewRequest("POST", "/", strings.NewReader(payload))
+	req.Header.Set("X-GitHub-Event", "forged")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, invalid+1, testutil.ToFloat64(metrics.WebhookDeliveries.WithLabelValues(metrics.EventUnknown, "invalid")))
+	assert.False(t, metrics.WebhookDeliveries.DeleteLabelValues("forged", "invalid"))
+
+	assert.Equal(t, http.StatusBadRequest, post("/", "", payload))
+	assert.Equal(t, 0, stubClient.comments)
+	assert.Equal(t, http.StatusNoContent, post("/", "a", payload))
+	assert.Equal(t, 1, stubClient.comments)
+	assert.Equal(t, http.StatusNoContent, post("/", "a", payload))
+	assert.Equal(t, 1, stubClient.comments)
+
+	reprocess := func(deliveryID string, signedAt time.Time) string {
+		return `{"delivery_id":"` + deliveryID + `","timestamp":` + strconv.FormatInt(signedAt.Unix(), 10) + `}`
+	}
+	now := time.Now()
+	assert.Equal(t, http.StatusNotFound, post("/reprocess", "", reprocess("b", now)))
+	assert.Equal(t, http.StatusBadRequest, post("/reprocess", "", `{}`))
+	assert.Equal(t, http.StatusBadRequest, post("/reprocess", "", `{"delivery_id":"a"}`))
+	stubClient.newLabels = nil
+	assert.Equal(t, http.StatusNoContent, post("/reprocess", "", reprocess("a", now)))
+	assert.NotNil(t, stubClient.newLabels)
+	// The status comment is edited, not added again
+	assert.Equal(t, 1, stubClient.comments)
+
+	// Requests cannot be replayed, nor used long after they were signed
+	stubClient.newLabels = nil
+	assert.Equal(t, http.StatusForbidden, post("/reprocess", "", reprocess("a", now)))
+	assert.Equal(t, http.StatusForbidden, post("/reprocess", "", reprocess("a", now.Add(-time.Hour))))
+	assert.Equal(t, http.StatusForbidden, post("/reprocess", "", reprocess("a", now.Add(time.Hour))))
+	assert.Nil(t, stubClient.newLabels)
+	assert.Equal(t, http.StatusNoContent, post("/reprocess", "", reprocess("a", now.Add(time.Second))))
+}
@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// Below this many remaining GitHub API requests the bot is not ready
+const minRateLimitRemaining = 100
+
+// dependencyStatus describes a problem with a dependency, if any
+type dependencyStatus struct {
+	name    string
+	problem string
+}
+
+// checkReadiness returns the status of each dependency of the bot and
+// whether all of them are usable.
+func (receiver *Receiver) checkReadiness(ctx context.Context) ([]dependencyStatus, bool) {
+	var results []dependencyStatus
+	ready := true
+	report := func(name, problem string) {
+		if problem != "" {
+			ready = false
+		}
+		results = append(results, dependencyStatus{name, problem})
+	}
+
+	if receiver.dbHelper == nil {
+		report("database", "not configured")
+	} else if err := receiver.dbHelper.Ping(ctx); err != nil {
+		report("database", err.Error())
+	} else {
+		report("database", "")
+	}
+
+	if rate, err := receiver.githubClient.GetRateLimit(ctx); err != nil {
+		report("github", err.Error())
+	} else if rate.Remaining < minRateLimitRemaining {
+		report("github", "rate limit low, "+strconv.Itoa(rate.Remaining)+" of "+strconv.Itoa(rate.Limit)+
+			" requests remaining until "+rate.Reset.String())
+	} else {
+		report("github", "")
+	}
+
+	receiver.membersLock.RLock()
+	members := receiver.members
+	receiver.membersLock.RUnlock()
+	if len(members) == 0 {
+		report("members", "org members not loaded yet")
+	} else {
+		report("members", "")
+	}
+
+	return results, ready
+}
+
+func (receiver *Receiver) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+func (receiver *Receiver) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	results, ready := receiver.checkReadiness(r.Context())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, result := range results {
+		status := "ok"
+		if result.problem != "" {
+			status = result.problem
+		}
+		w.Write([]byte(result.name + ": " + status + "\n"))
+	}
+}
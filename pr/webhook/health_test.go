@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/macports/mpbot-github/pr/config"
+)
+
+func TestReadyz(t *testing.T) {
+	stubClient := &stubGitHubClient{}
+	receiver := &Receiver{
+		config:       config.Default(),
+		githubClient: stubClient,
+	}
+	handler := receiver.handler()
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "database: not configured\ngithub: 401 Bad credentials\nmembers: org members not loaded yet\n", body)
+
+	stubDB := &stubDBHelper{pingErr: errors.New("PR_DB: connection refused")}
+	receiver.dbHelper = stubDB
+	receiver.members = map[string]map[string]bool{"macports": {"l2dy": true}}
+	stubClient.rate = &github.Rate{Limit: 5000, Remaining: 10}
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "database: PR_DB: connection refused\n")
+	assert.Contains(t, body, "github: rate limit low, 10 of 5000 requests remaining")
+	assert.Contains(t, body, "members: ok\n")
+
+	stubDB.pingErr = nil
+	stubClient.rate.Remaining = 4000
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "database: ok\ngithub: ok\nmembers: ok\n", body)
+}
@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a delivery may wait for room in a full queue
+const enqueueTimeout = 5 * time.Second
+
+// workerPool runs jobs on a fixed number of workers. Jobs with the same key
+// always go to the same worker, so they run one at a time in the order they
+// were submitted.
+type workerPool struct {
+	// Accessed atomically, keep first for 64-bit alignment
+	depth   int64
+	queues  []chan func()
+	timeout time.Duration
+	wg      sync.WaitGroup
+	// Held for reading while submitting, so that queues are not closed
+	// meanwhile
+	lock    sync.RWMutex
+	stopped bool
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	pool := &workerPool{
+		queues:  make([]chan func(), workers),
+		timeout: enqueueTimeout,
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan func(), queueSize)
+		pool.wg.Add(1)
+		go pool.work(pool.queues[i])
+	}
+	return pool
+}
+
+func (pool *workerPool) work(queue chan func()) {
+	defer pool.wg.Done()
+	for job := range queue {
+		atomic.AddInt64(&pool.depth, -1)
+		job()
+	}
+}
+
+// submit queues job on the worker for key. It blocks while that worker's
+// queue is full and gives up after the pool's timeout, returning false. It
+// also returns false once the pool is closed.
+func (pool *workerPool) submit(key int, job func()) bool {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+	if pool.stopped {
+		return false
+	}
+	if key < 0 {
+		key = -key
+	}
+	queue := pool.queues[key%len(pool.queues)]
+	atomic.AddInt64(&pool.depth, 1)
+	select {
+	case queue <- job:
+		return true
+	case <-time.After(pool.timeout):
+		atomic.AddInt64(&pool.depth, -1)
+		return false
+	}
+}
+
+// queueDepth returns the number of jobs waiting for a worker.
+func (pool *workerPool) queueDepth() int {
+	return int(atomic.LoadInt64(&pool.depth))
+}
+
+// close refuses further jobs, and lets the workers exit once the jobs queued
+// have run, without waiting for them.
+func (pool *workerPool) close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.stopped {
+		return
+	}
+	pool.stopped = true
+	for _, queue := range pool.queues {
+		close(queue)
+	}
+}
+
+// stop closes the pool and waits for queued jobs to finish.
+func (pool *workerPool) stop() {
+	pool.close()
+	pool.wg.Wait()
+}
+
+// eventPRNumber returns the number of the PR a webhook payload is about,
+// used to serialize events of the same PR.
+func eventPRNumber(payload []byte) int {
+	var event struct {
+		Number      int `json:"number"`
+		PullRequest struct {
+			Number int `json:"number"`
+		} `json:"pull_request"`
+		Issue struct {
+			Number int `json:"number"`
+		} `json:"issue"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return 0
+	}
+	switch {
+	case event.Number != 0:
+		return event.Number
+	case event.PullRequest.Number != 0:
+		return event.PullRequest.Number
+	}
+	return event.Issue.Number
+}
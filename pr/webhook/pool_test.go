@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	pool := newWorkerPool(4, 16)
+	var lock sync.Mutex
+	got := make(map[int][]int)
+	for i := 0; i < 10; i++ {
+		for _, key := range []int{1, 2, 5} {
+			key, i := key, i
+			assert.True(t, pool.submit(key, func() {
+				lock.Lock()
+				got[key] = append(got[key], i)
+				lock.Unlock()
+			}))
+		}
+	}
+	pool.stop()
+	for _, key := range []int{1, 2, 5} {
+		assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, got[key])
+	}
+	assert.Equal(t, 0, pool.queueDepth())
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	pool := newWorkerPool(2, 1)
+	pool.timeout = 10 * time.Millisecond
+	block := make(chan struct{})
+	started := make(chan struct{})
+
+	assert.True(t, pool.submit(1, func() {
+		close(started)
+		<-block
+	}))
+	<-started
+	assert.True(t, pool.submit(3, func() {}))
+	assert.Equal(t, 1, pool.queueDepth())
+	// Worker of odd keys is busy and its queue is full
+	assert.False(t, pool.submit(5, func() {}))
+	assert.Equal(t, 1, pool.queueDepth())
+	// Even keys use the other worker
+	assert.True(t, pool.submit(2, func() {}))
+
+	close(block)
+	pool.stop()
+	assert.Equal(t, 0, pool.queueDepth())
+}
+
+func TestEventPRNumber(t *testing.T) {
+	assert.Equal(t, 1, eventPRNumber([]byte(`{"action":"opened","number":1,"pull_request":{"number":1}}`)))
+	assert.Equal(t, 2, eventPRNumber([]byte(`{"action":"submitted","pull_request":{"number":2}}`)))
+	assert.Equal(t, 3, eventPRNumber([]byte(`{"action":"created","issue":{"number":3}}`)))
+	assert.Equal(t, 0, eventPRNumber([]byte(`{`)))
+}
@@ -1,77 +1,158 @@
 package webhook
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"log"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/v28/github"
+	"github.com/macports/mpbot-github/pr/commits"
+	"github.com/macports/mpbot-github/pr/db"
+	"github.com/macports/mpbot-github/pr/githubapi"
+	"github.com/macports/mpbot-github/pr/portfile"
+	"github.com/macports/mpbot-github/pr/rules"
+	"github.com/macports/mpbot-github/pr/status"
 )
 
-var cveRegexp = regexp.MustCompile(`CVE-\d{4}-\d+`)
-
-func (receiver *Receiver) handlePullRequest(body []byte) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println(r)
-		}
-
-		if !receiver.testing {
-			receiver.wg.Done()
-		}
-	}()
-
+func (receiver *Receiver) handlePullRequest(ctx context.Context, body []byte) error {
 	event := &github.PullRequestEvent{}
 	err := json.Unmarshal(body, event)
 	if err != nil {
+		// Retrying would not help
 		log.Println(err)
-		return
+		return nil
 	}
 
-	receiver.processPullRequest(event)
+	return receiver.processPullRequest(ctx, event)
 }
 
-func (receiver *Receiver) processPullRequest(event *github.PullRequestEvent) {
-	number := *event.Number
-	owner := *event.Repo.Owner.Login
-	repo := *event.Repo.Name
-
-	log.Println("PR #" + strconv.Itoa(number) + " " + *event.Action)
-
-	ports, files, err := receiver.githubClient.ListChangedPortsAndFiles(owner, repo, number)
-	if err != nil {
-		log.Println(err)
-		return
-	}
+const (
+	// Ports whose dependents are looked up, whether or not the lookup
+	// succeeds, as PRs rebuilding dependents may change hundreds of ports
+	maxImpactPorts = 20
+	// Dependents listed per port in the status comment
+	maxDependentExamples = 5
+)
 
-	handles := make(map[string][]string)
+// portsSummary describes the maintainers of the ports changed by a PR.
+type portsSummary struct {
+	// Ports of each maintainer to notify, excluding the PR sender
+	handles map[string][]string
+	// Ports changed that are openmaintainer
+	openPorts map[string]bool
+	// Parsed Portfile diffs of the ports changed, if available
+	portfiles map[string]*portfile.Diff
+	// Existing ports similar to each new port
+	duplicates map[string][]*db.Port
+	// Ports depending on each port changed, for the first maxImpactPorts
+	dependents map[string]*db.Dependents
+	// Ports removed, renamed or moved
+	operations map[string]*status.PortOperation
 	// If unrecognized port was added
-	isSubmission := false
-	isAllSubmission := true
+	isSubmission    bool
+	isAllSubmission bool
 	// If all ports changed are openmaintainer or nomaintainer
-	isOpenmaintainer := true
+	isOpenmaintainer bool
 	// If all ports changed have no maintainers
-	isNomaintainer := true
+	isNomaintainer bool
 	// If PR sender is maintainer of all ports changed (exclude minor changes and nomaintainer)
-	isMaintainer := true
+	isMaintainer bool
+}
+
+// maintainers returns the handles to notify, sorted.
+func (summary *portsSummary) maintainers() []string {
+	maintainers := make([]string, 0, len(summary.handles))
+	for handle := range summary.handles {
+		maintainers = append(maintainers, handle)
+	}
+	sort.Strings(maintainers)
+	return maintainers
+}
+
+// requiresApproval reports whether the PR waits for a maintainer.
+func (summary *portsSummary) requiresApproval() bool {
+	return !summary.isNomaintainer && !summary.isAllSubmission && !summary.isMaintainer
+}
+
+func (receiver *Receiver) summarizePorts(ctx context.Context, ports []string, files []*github.CommitFile, sender string, minorChangeLines int) *portsSummary {
+	summary := &portsSummary{
+		handles:          make(map[string][]string),
+		openPorts:        make(map[string]bool),
+		portfiles:        make(map[string]*portfile.Diff),
+		duplicates:       make(map[string][]*db.Port),
+		dependents:       make(map[string]*db.Dependents),
+		operations:       make(map[string]*status.PortOperation),
+		isAllSubmission:  true,
+		isOpenmaintainer: true,
+		isNomaintainer:   true,
+		isMaintainer:     true,
+	}
+	// Ports whose Portfile the PR adds, possibly under a new name or
+	// category
+	addedPorts := make(map[string]bool)
+	for _, file := range files {
+		if strings.HasSuffix(file.GetFilename(), "/Portfile") && (file.GetStatus() == "added" || file.GetStatus() == "renamed") {
+			addedPorts[githubapi.PortOfPath(file.GetFilename())] = true
+		}
+	}
+	// New names of renamed ports, which are not submissions
+	renamedTo := make(map[string]bool)
+	// Ports whose dependents were looked up
+	impactLookups := make(map[string]bool)
+	for i, port := range ports {
+		// The patch of a removed Portfile only removes options
+		if strings.HasSuffix(files[i].GetFilename(), "/Portfile") && files[i].GetPatch() != "" && files[i].GetStatus() != "removed" {
+			summary.portfiles[port] = portfile.ParseDiff(files[i].GetPatch())
+		}
+		if operation := portOperation(port, files[i], summary.portfiles[port], addedPorts); operation != nil {
+			summary.operations[port] = operation
+			if operation.Kind == status.OperationRename {
+				renamedTo[operation.To] = true
+			}
+		}
+	}
 	// If PR sender is maintainer of one of the ports changed
 	isOneMaintainer := false
 	for i, port := range ports {
-		portMaintainer, err := receiver.dbHelper.GetPortMaintainer(port)
+		if renamedTo[port] {
+			continue
+		}
+		added := !strings.Contains(*files[i].Filename, "/files/") && *files[i].Status == "added"
+		portMaintainer, err := receiver.dbHelper.GetPortMaintainer(ctx, port)
 		if err != nil {
-			// TODO: warn about submission of duplicate ports in different category
-			if err.Error() == "port not found" && !strings.Contains(*files[i].Filename, "/files/") && *files[i].Status == "added" {
-				isSubmission = true
+			if err.Error() == "port not found" && added {
+				summary.isSubmission = true
+				receiver.findDuplicates(ctx, port, files[i], files, summary)
 				continue
 			}
 			log.Println("Error getting maintainer for port " + port + ": " + err.Error())
 			continue
 		}
-		isAllSubmission = false
-		isNomaintainer = isNomaintainer && portMaintainer.NoMaintainer
-		isOpenmaintainer = isOpenmaintainer && (portMaintainer.OpenMaintainer || portMaintainer.NoMaintainer)
+		// A Portfile added for a known name is a duplicate in another
+		// category
+		if added && strings.HasSuffix(files[i].GetFilename(), "/Portfile") {
+			receiver.findDuplicates(ctx, port, files[i], files, summary)
+		}
+		summary.isAllSubmission = false
+		if !impactLookups[port] && len(impactLookups) < maxImpactPorts {
+			impactLookups[port] = true
+			dependents, err := receiver.dbHelper.GetDependents(ctx, port)
+			if err != nil {
+				log.Println("Error getting dependents of port " + port + ": " + err.Error())
+			} else {
+				summary.dependents[port] = dependents
+			}
+		}
+		summary.isNomaintainer = summary.isNomaintainer && portMaintainer.NoMaintainer
+		summary.isOpenmaintainer = summary.isOpenmaintainer && (portMaintainer.OpenMaintainer || portMaintainer.NoMaintainer)
+		if portMaintainer.OpenMaintainer {
+			summary.openPorts[port] = true
+		}
 		if portMaintainer.NoMaintainer {
 			continue
 		}
@@ -79,141 +160,646 @@ func (receiver *Receiver) processPullRequest(event *github.PullRequestEvent) {
 		isPortMaintainer := false
 		for _, maintainer := range allMaintainers {
 			if maintainer.GithubHandle != "" {
-				if maintainer.GithubHandle == *event.Sender.Login {
+				if maintainer.GithubHandle == sender {
 					isPortMaintainer = true
 					isOneMaintainer = true
 				} else {
-					handles[maintainer.GithubHandle] = append(handles[maintainer.GithubHandle], port)
+					summary.handles[maintainer.GithubHandle] = append(summary.handles[maintainer.GithubHandle], port)
 				}
 			}
 		}
 		// No maintainer label if not maintainer of one of the ports
 		// exclude minor changes like increase revision of dependents
-		if *files[i].Changes > 2 && !isPortMaintainer {
-			isMaintainer = false
+		if !isMinorChange(files[i], summary.portfiles[port], minorChangeLines) && !isPortMaintainer {
+			summary.isMaintainer = false
 		}
 	}
-	isMaintainer = isOneMaintainer && isMaintainer
-	if isAllSubmission {
-		isNomaintainer = false
-		isOpenmaintainer = false
+	summary.isMaintainer = isOneMaintainer && summary.isMaintainer
+	receiver.findRemainingDependents(ctx, summary)
+	if summary.isAllSubmission {
+		summary.isNomaintainer = false
+		summary.isOpenmaintainer = false
 	}
+	return summary
+}
 
-	maintainers := make([]string, len(handles))
-	{
-		i := 0
-		for k := range handles {
-			maintainers[i] = k
-			i++
+// findDuplicates records the existing ports similar to port, added by file,
+// other than itself and ports moved away by files.
+func (receiver *Receiver) findDuplicates(ctx context.Context, port string, file *github.CommitFile, files []*github.CommitFile, summary *portsSummary) {
+	similar, err := receiver.dbHelper.FindSimilarPorts(ctx, port)
+	if err != nil {
+		log.Println("Error finding ports similar to " + port + ": " + err.Error())
+		return
+	}
+	var duplicates []*db.Port
+similarLoop:
+	for _, existing := range similar {
+		path := existing.Path + "/Portfile"
+		if path == file.GetFilename() {
+			continue
+		}
+		for _, other := range files {
+			if other.GetStatus() == "removed" && other.GetFilename() == path {
+				continue similarLoop
+			}
 		}
+		duplicates = append(duplicates, existing)
 	}
+	if len(duplicates) > 0 {
+		summary.duplicates[port] = duplicates
+	}
+}
 
-	switch *event.Action {
-	case "opened":
-		receiver.dbHelper.NewPR(number, maintainers)
-		// Notify maintainers
-		mentionSymbol := "@_"
-		if receiver.production {
-			mentionSymbol = "@"
-		}
-		if len(handles) > 0 && !strings.Contains(*event.PullRequest.Body, "[skip notification]") {
-			body := "Notifying maintainers:\n"
-			for handle, ports := range handles {
-				body += mentionSymbol + handle + " for port " + strings.Join(ports, ", ") + ".\n"
-				err = receiver.githubClient.AddAssignees(owner, repo, number, []string{handle})
-				if err != nil {
-					log.Println(err)
-				}
-			}
-			err = receiver.githubClient.CreateComment(owner, repo, number, &body)
+// portOperation returns how a change removes, renames or moves port, or nil
+// if it does not. A port replaced by another is only renamed if the PR adds
+// the other, see addedPorts, and removed in favour of it otherwise. Moves
+// keep the name, so they need no stub.
+func portOperation(port string, file *github.CommitFile, diff *portfile.Diff, addedPorts map[string]bool) *status.PortOperation {
+	if !strings.HasSuffix(file.GetFilename(), "/Portfile") {
+		return nil
+	}
+	switch {
+	case file.GetStatus() == "removed":
+		return &status.PortOperation{Port: port, Kind: status.OperationRemoval}
+	case diff != nil && diff.ReplacedBy != "" && addedPorts[diff.ReplacedBy]:
+		return &status.PortOperation{Port: port, Kind: status.OperationRename, To: diff.ReplacedBy, Stub: true}
+	case diff != nil && diff.ReplacedBy != "":
+		return &status.PortOperation{Port: port, Kind: status.OperationRemoval, To: diff.ReplacedBy}
+	case diff != nil && diff.Obsolete:
+		return &status.PortOperation{Port: port, Kind: status.OperationRemoval}
+	case file.GetStatus() == "renamed":
+		newPort := githubapi.PortOfPath(file.GetFilename())
+		if newPort != port {
+			return &status.PortOperation{Port: port, Kind: status.OperationRename, To: newPort}
+		}
+		from := strings.Split(file.GetPreviousFilename(), "/")[0]
+		to := strings.Split(file.GetFilename(), "/")[0]
+		if from != to {
+			return &status.PortOperation{Port: port, Kind: status.OperationMove, From: from, To: to}
+		}
+	}
+	return nil
+}
+
+// findRemainingDependents records the ports still depending on each port
+// removed or on its subports, other than those removed along with them.
+func (receiver *Receiver) findRemainingDependents(ctx context.Context, summary *portsSummary) {
+	dependents := make(map[string]*db.Dependents)
+	// Ports and subports removed
+	removed := make(map[string]bool)
+	for port, operation := range summary.operations {
+		if operation.Kind != status.OperationRemoval {
+			continue
+		}
+		removed[port] = true
+		portDependents := summary.dependents[port]
+		if portDependents == nil {
+			var err error
+			portDependents, err = receiver.dbHelper.GetDependents(ctx, port)
 			if err != nil {
-				log.Println(err)
+				log.Println("Error getting dependents of port " + port + ": " + err.Error())
+				continue
+			}
+		}
+		dependents[port] = portDependents
+		for _, subport := range portDependents.Subports {
+			removed[subport] = true
+		}
+	}
+	for port, portDependents := range dependents {
+		operation := summary.operations[port]
+		operation.DependentCount, operation.Dependents = 0, nil
+		for _, dependent := range portDependents.Direct {
+			if removed[dependent] {
+				continue
+			}
+			operation.DependentCount++
+			if len(operation.Dependents) < maxDependentExamples {
+				operation.Dependents = append(operation.Dependents, dependent)
 			}
 		}
+	}
+}
+
+// operationsReport lists the ports removed, renamed or moved by summary for
+// the status comment, in port order.
+func operationsReport(ports []string, summary *portsSummary) []status.PortOperation {
+	var report []status.PortOperation
+	for _, port := range ports {
+		if operation := summary.operations[port]; operation != nil {
+			report = append(report, *operation)
+		}
+	}
+	return report
+}
+
+// isMinorChange reports whether a port changes so little that its
+// maintainers need not approve, which is a revbump if its Portfile diff is
+// available and a change of at most minorChangeLines lines otherwise.
+func isMinorChange(file *github.CommitFile, diff *portfile.Diff, minorChangeLines int) bool {
+	if diff != nil {
+		return diff.Kind() == portfile.KindRevbump
+	}
+	return file.GetChanges() <= minorChangeLines
+}
 
-		// Modify labels
-		labels, err := receiver.githubClient.ListLabels(owner, repo, number)
+// portChanges describes the Portfile changes of summary for the status
+// comment, in port order.
+func portChanges(ports []string, summary *portsSummary) []status.PortChange {
+	var changes []status.PortChange
+	for _, port := range ports {
+		diff := summary.portfiles[port]
+		if diff == nil {
+			continue
+		}
+		for _, subport := range diff.SubportNames() {
+			changes = append(changes, status.PortChange{
+				Port:    port,
+				Subport: subport,
+				Kind:    diff.Kind(),
+				Changes: diff.Subports[subport].Describe(),
+			})
+		}
+	}
+	return changes
+}
+
+// impactReport counts the dependents of the ports of summary for the status
+// comment, in port order, leaving out ports without dependents.
+func impactReport(ports []string, summary *portsSummary) []status.PortDependents {
+	var report []status.PortDependents
+	for _, port := range ports {
+		dependents := summary.dependents[port]
+		if dependents == nil || len(dependents.Transitive) == 0 {
+			continue
+		}
+		examples := dependents.Direct
+		if len(examples) > maxDependentExamples {
+			examples = examples[:maxDependentExamples]
+		}
+		report = append(report, status.PortDependents{
+			Port:       port,
+			Direct:     len(dependents.Direct),
+			Transitive: len(dependents.Transitive),
+			Examples:   examples,
+		})
+	}
+	return report
+}
+
+// maintainerStatuses returns the rules.Status* values that apply to summary.
+func maintainerStatuses(summary *portsSummary) []string {
+	var statuses []string
+	if summary.isMaintainer {
+		statuses = append(statuses, rules.StatusMaintainer)
+	}
+	if summary.isNomaintainer {
+		statuses = append(statuses, rules.StatusNoMaintainer)
+	} else if summary.isOpenmaintainer {
+		statuses = append(statuses, rules.StatusOpenMaintainer)
+	} else if !summary.isAllSubmission && !summary.isMaintainer {
+		statuses = append(statuses, rules.StatusRequiresApproval)
+	}
+	return statuses
+}
+
+// labelFacts describes a PR for the label rules.
+func (receiver *Receiver) labelFacts(event *github.PullRequestEvent, files []*github.CommitFile, summary *portsSummary) *rules.Facts {
+	facts := &rules.Facts{
+		Action:             *event.Action,
+		Title:              event.PullRequest.GetTitle(),
+		Body:               event.PullRequest.GetBody(),
+		Member:             receiver.isMember(*event.Repo.Owner.Login, *event.Sender.Login),
+		MaintainerStatuses: maintainerStatuses(summary),
+		Submission:         summary.isSubmission,
+		Duplicate:          len(summary.duplicates) > 0,
+	}
+	for _, operation := range summary.operations {
+		facts.Removal = facts.Removal || operation.Kind == status.OperationRemoval
+		facts.Rename = facts.Rename || operation.Kind != status.OperationRemoval
+	}
+	for _, diff := range summary.portfiles {
+		facts.PortfileKinds = appendIfUnique(facts.PortfileKinds, diff.Kind())
+	}
+	for _, dependents := range summary.dependents {
+		if len(dependents.Transitive) > facts.Dependents {
+			facts.Dependents = len(dependents.Transitive)
+		}
+	}
+	for _, file := range files {
+		facts.Paths = append(facts.Paths, file.GetFilename())
+		facts.Changes += file.GetChanges()
+		if parts := strings.Split(file.GetFilename(), "/"); len(parts) > 2 {
+			facts.Categories = appendIfUnique(facts.Categories, parts[0])
+		}
+	}
+	return facts
+}
+
+// labelRules returns the current label rules.
+func (receiver *Receiver) labelRules() *rules.RuleSet {
+	if receiver.rules == nil {
+		return rules.Default(receiver.config.Labels)
+	}
+	return receiver.rules.RuleSet()
+}
+
+// notification describes the maintainers mentioned in the status comment.
+type notification struct {
+	// Ports of each maintainer mentioned
+	handles map[string][]string
+	// See db.Preferences.GroupAbove
+	groupAbove map[string]int
+	// Maintainers mentioned who are away, and until when
+	away map[string]time.Time
+	// Whether the PR asked not to notify maintainers
+	skipped bool
+}
+
+// notifyMaintainers assigns the given maintainers of a PR as they prefer,
+// unless the PR asks not to or they are away, and returns how to mention
+// them.
+func (receiver *Receiver) notifyMaintainers(ctx context.Context, owner, repo string, number int, body string, handles map[string][]string, openPorts map[string]bool) *notification {
+	n := &notification{
+		handles:    make(map[string][]string),
+		groupAbove: make(map[string]int),
+		away:       make(map[string]time.Time),
+	}
+	if len(handles) == 0 {
+		return n
+	}
+	if strings.Contains(body, "[skip notification]") {
+		n.skipped = true
+		return n
+	}
+	allHandles := make([]string, 0, len(handles))
+	for handle := range handles {
+		allHandles = append(allHandles, handle)
+	}
+	preferences, err := receiver.dbHelper.GetPreferences(ctx, allHandles)
+	if err != nil {
+		log.Println(err)
+		preferences = make(map[string]*db.Preferences)
+	}
+	now := time.Now()
+	for handle, ports := range handles {
+		p := preferences[handle]
+		if p == nil {
+			p = db.DefaultPreferences(handle)
+		}
+		var notifiedPorts []string
+		for _, port := range ports {
+			if p.OpenMaintainer || !openPorts[port] {
+				notifiedPorts = append(notifiedPorts, port)
+			}
+		}
+		if len(notifiedPorts) == 0 {
+			continue
+		}
+		n.handles[handle] = notifiedPorts
+		if p.GroupAbove > 0 {
+			n.groupAbove[handle] = p.GroupAbove
+		}
+		if p.Away(now) {
+			n.away[handle] = p.AwayUntil
+			continue
+		}
+		if !p.Assign {
+			continue
+		}
+		err := receiver.githubClient.AddAssignees(ctx, owner, repo, number, []string{handle})
 		if err != nil {
 			log.Println(err)
-			return
 		}
-		newLabels := make([]string, 0, len(labels))
-		maintainerLabels := make([]string, 0)
-		typeLabels := make([]string, 0)
+	}
+	return n
+}
+
+// processPullRequest returns an error if it failed before modifying the PR,
+// in which case it is safe to retry. Once it starts modifying the PR, it is
+// no longer interrupted by cancelling ctx.
+func (receiver *Receiver) processPullRequest(ctx context.Context, event *github.PullRequestEvent) error {
+	number := *event.Number
+	owner := *event.Repo.Owner.Login
+	repo := *event.Repo.Name
+	prName := owner + "/" + repo + "#" + strconv.Itoa(number)
 
-		if isMaintainer {
-			maintainerLabels = append(maintainerLabels, "maintainer")
+	repoConfig := receiver.config.Repo(owner, repo)
+	if repoConfig == nil {
+		log.Println("Ignoring PR " + prName + " of unknown repository")
+		return nil
+	}
+
+	switch *event.Action {
+	case "opened", "synchronize", "reopened", "edited", "closed", "ready_for_review", "converted_to_draft":
+	default:
+		return nil
+	}
+	log.Println("PR " + prName + " " + *event.Action)
+
+	// Commits are checked when the ports changed may have changed, and
+	// searched for Trac tickets when they or the body may have
+	bodyChanged := event.Changes != nil && event.Changes.Body != nil
+	needCommits := bodyChanged
+	switch *event.Action {
+	case "opened", "synchronize", "reopened", "ready_for_review":
+		needCommits = true
+	}
+	var prCommits []*github.RepositoryCommit
+	commitsFailed := false
+	if needCommits {
+		var err error
+		prCommits, err = receiver.githubClient.ListCommits(ctx, owner, repo, number)
+		if err != nil {
+			// Without the commits, neither the commit checks nor the stored
+			// tickets are updated, they are kept until the next event
+			log.Println("Error listing commits of PR " + prName + ": " + err.Error())
+			commitsFailed = true
 		}
-		if isNomaintainer {
-			maintainerLabels = append(maintainerLabels, "maintainer: none")
-		} else if isOpenmaintainer {
-			maintainerLabels = append(maintainerLabels, "maintainer: open")
-		} else if !isAllSubmission && !isMaintainer {
-			// TODO: store in DB
-			maintainerLabels = append(maintainerLabels, "maintainer: requires approval")
+	}
+
+	if needCommits && !commitsFailed {
+		switch *event.Action {
+		case "opened", "synchronize", "reopened", "edited":
+			receiver.linkTickets(ctx, owner, repo, number, event.PullRequest.GetBody(), prCommits)
 		}
+	}
 
-		if !isNomaintainer && !isAllSubmission && !isMaintainer {
-			receiver.dbHelper.SetPRPendingReview(number, true)
+	switch *event.Action {
+	case "edited":
+		// Only the title and body are matched by the label rules
+		if event.Changes == nil || (event.Changes.Title == nil && event.Changes.Body == nil) {
+			return nil
+		}
+	case "closed":
+		return receiver.pullRequestClosed(ctx, event)
+	case "reopened":
+		if !repoConfig.PortMaintainers {
+			return receiver.pullRequestReopened(ctx, owner, repo, number)
+		}
+	case "synchronize":
+		if !repoConfig.PortMaintainers {
+			return nil
 		}
+	case "converted_to_draft":
+		return receiver.setDraft(ctx, owner, repo, number, true)
+	case "ready_for_review":
+		if !repoConfig.PortMaintainers {
+			return receiver.setDraft(ctx, owner, repo, number, false)
+		}
+	}
+	// Drafts are labelled, but maintainers are only notified and waited for
+	// once they are ready for review
+	isDraft := event.PullRequest.GetDraft()
 
-		// Collect existing labels (PR sender could add labels when creating a PR)
-		for _, label := range labels {
-			if strings.HasPrefix(label, "maintainer") {
-				continue
+	var ports []string
+	var files []*github.CommitFile
+	var problems []commits.Problem
+	if repoConfig.PortMaintainers {
+		var err error
+		ports, files, err = receiver.githubClient.ListChangedPortsAndFiles(ctx, owner, repo, number)
+		if err != nil {
+			return err
+		}
+		if commitsFailed {
+			problems = receiver.previousCommitProblems(ctx, owner, repo, number)
+		} else {
+			problems = receiver.checkCommits(ctx, owner, repo, prCommits, ports)
+		}
+	}
+
+	ruleSet := receiver.labelRules()
+	summary := receiver.summarizePorts(ctx, ports, files, *event.Sender.Login, ruleSet.MinorChangeLines)
+
+	labels, err := receiver.githubClient.ListLabels(ctx, owner, repo, number)
+	if err != nil {
+		return err
+	}
+	facts := receiver.labelFacts(event, files, summary)
+	facts.CommitProblems = len(problems) > 0
+	newLabels := ruleSet.Apply(labels, facts)
+	reasons := ruleSet.Explain(facts)
+
+	switch *event.Action {
+	case "opened":
+		// Maintainers may be incomplete if lookups were cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ctx = detach(ctx)
+
+		var notified *notification
+		if isDraft {
+			if err := receiver.dbHelper.NewPR(ctx, owner, repo, number, nil); err != nil {
+				log.Println(err)
 			}
-			if strings.HasPrefix(label, "type: ") {
-				typeLabels = append(typeLabels, label)
-			} else {
-				newLabels = append(newLabels, label)
+			if err := receiver.dbHelper.SetPRDraft(ctx, owner, repo, number, true); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if err := receiver.dbHelper.NewPR(ctx, owner, repo, number, summary.maintainers()); err != nil {
+				log.Println(err)
 			}
+			notified = receiver.notifyMaintainers(ctx, owner, repo, number, event.PullRequest.GetBody(), summary.handles, summary.openPorts)
+		}
+
+		if summary.requiresApproval() && !isDraft {
+			receiver.dbHelper.SetPRPendingReview(ctx, owner, repo, number, true)
+		}
+
+		err = receiver.githubClient.ReplaceLabels(ctx, owner, repo, number, newLabels)
+		if err != nil {
+			log.Println(err)
 		}
 
-		// Determine type labels
-		// TODO: read PR body to determine type
-		if isSubmission {
-			typeLabels = appendIfUnique(typeLabels, "type: submission")
+		receiver.dbHelper.SetPRProcessed(ctx, owner, repo, number, true)
+
+		pr, _ := receiver.dbHelper.GetPR(ctx, owner, repo, number)
+		var askChecksums, askDuplicates []string
+		receiver.updateStatus(ctx, owner, repo, number, func(comment *status.Comment) {
+			setNotified(comment, notified)
+			comment.Ports = portChanges(ports, summary)
+			comment.ChangedPorts = ports
+			comment.Dependents = impactReport(ports, summary)
+			comment.Operations = operationsReport(ports, summary)
+			comment.Commits = problems
+			askChecksums = comment.AddAsked(status.AskedChecksum, checksumPorts(ports, summary))
+			askDuplicates = comment.AddAsked(status.AskedDuplicate, duplicatePorts(ports, summary))
+			comment.SetLabels(newLabels, reasons)
+			receiver.setTimeoutStatus(comment, pr)
+		})
+		receiver.askAboutChecksums(ctx, owner, repo, number, *event.Sender.Login, askChecksums)
+		receiver.warnAboutDuplicates(ctx, event, summary, askDuplicates)
+	case "synchronize", "reopened", "ready_for_review":
+		reopened := *event.Action == "reopened"
+		pr, err := receiver.dbHelper.GetPR(ctx, owner, repo, number)
+		if err != nil && err != sql.ErrNoRows {
+			return err
 		}
-		if strings.Contains(strings.ToLower(*event.PullRequest.Title), ": update") || strings.HasPrefix(strings.ToLower(*event.PullRequest.Title), "update") {
-			typeLabels = appendIfUnique(typeLabels, "type: update")
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		if cveRegexp.FindString(*event.PullRequest.Title) != "" || cveRegexp.FindString(*event.PullRequest.Body) != "" {
-			typeLabels = appendIfUnique(typeLabels, "type: security fix")
+		ctx = detach(ctx)
+
+		if reopened && pr != nil {
+			if err := receiver.dbHelper.SetPRClosed(ctx, owner, repo, number, time.Time{}, time.Time{}); err != nil {
+				log.Println(err)
+			}
 		}
-		typesFromBody := []string{"bugfix", "enhancement", "security fix", "update"}
-		for _, t := range typesFromBody {
-			if strings.Contains(*event.PullRequest.Body, "[x] "+t) {
-				typeLabels = appendIfUnique(typeLabels, "type: "+t)
+		if pr != nil && pr.Draft != isDraft {
+			// Resumes the maintainer timeout clock
+			if err := receiver.dbHelper.SetPRDraft(ctx, owner, repo, number, isDraft); err != nil {
+				log.Println(err)
 			}
 		}
 
-		if len(ports) > 0 {
-			newLabels = append(newLabels, maintainerLabels...)
+		var notified *notification
+		if isDraft {
+			if pr == nil {
+				if err := receiver.dbHelper.NewPR(ctx, owner, repo, number, nil); err != nil {
+					log.Println(err)
+				}
+				if err := receiver.dbHelper.SetPRDraft(ctx, owner, repo, number, true); err != nil {
+					log.Println(err)
+				}
+			}
+		} else {
+			notified = receiver.updateMaintainers(ctx, owner, repo, number, event, pr, summary, reopened)
+			receiver.mentionMaintainers(ctx, owner, repo, number, notified)
 		}
-		newLabels = append(newLabels, typeLabels...)
 
-		receiver.membersLock.RLock()
-		members := receiver.members
-		receiver.membersLock.RUnlock()
-		if members != nil {
-			_, exist := (*members)[*event.Sender.Login]
-			if exist {
-				newLabels = appendIfUnique(newLabels, "by: member")
+		if !sameLabels(labels, newLabels) {
+			err = receiver.githubClient.ReplaceLabels(ctx, owner, repo, number, newLabels)
+			if err != nil {
+				log.Println(err)
 			}
 		}
 
-		err = receiver.githubClient.ReplaceLabels(owner, repo, number, newLabels)
+		pr, _ = receiver.dbHelper.GetPR(ctx, owner, repo, number)
+		var askChecksums, askDuplicates []string
+		receiver.updateStatus(ctx, owner, repo, number, func(comment *status.Comment) {
+			setNotified(comment, notified)
+			comment.Ports = portChanges(ports, summary)
+			comment.ChangedPorts = ports
+			comment.Dependents = impactReport(ports, summary)
+			comment.Operations = operationsReport(ports, summary)
+			comment.Commits = problems
+			askChecksums = comment.AddAsked(status.AskedChecksum, checksumPorts(ports, summary))
+			askDuplicates = comment.AddAsked(status.AskedDuplicate, duplicatePorts(ports, summary))
+			comment.SetLabels(newLabels, reasons)
+			receiver.setTimeoutStatus(comment, pr)
+		})
+		receiver.askAboutChecksums(ctx, owner, repo, number, *event.Sender.Login, askChecksums)
+		receiver.warnAboutDuplicates(ctx, event, summary, askDuplicates)
+	case "edited":
+		if sameLabels(labels, newLabels) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ctx = detach(ctx)
+		err = receiver.githubClient.ReplaceLabels(ctx, owner, repo, number, newLabels)
 		if err != nil {
 			log.Println(err)
 		}
-
-		receiver.dbHelper.SetPRProcessed(number, true)
-		//	fallthrough
-		//case "synchronize":
+		receiver.updateStatus(ctx, owner, repo, number, func(comment *status.Comment) {
+			comment.SetLabels(newLabels, reasons)
+		})
 	}
 	if !receiver.testing {
-		log.Println("PR #" + strconv.Itoa(number) + " processed")
+		log.Println("PR " + prName + " processed")
+	}
+	return nil
+}
+
+// updateMaintainers notifies the maintainers of ports a PR that is ready for
+// review newly changes, and waits for them.
+func (receiver *Receiver) updateMaintainers(ctx context.Context, owner, repo string, number int, event *github.PullRequestEvent, pr *db.PullRequest, summary *portsSummary, reopened bool) *notification {
+	// Only notify maintainers of ports that were not changed before: new
+	// maintainers of all their ports, the others of the ports a push adds
+	known := make(map[string]bool)
+	if pr != nil {
+		for _, handle := range pr.Maintainers {
+			known[handle] = true
+		}
+	}
+	previousPorts := receiver.previousPorts(ctx, owner, repo, number)
+	newHandles := make(map[string][]string)
+	for handle, ports := range summary.handles {
+		if !known[handle] {
+			newHandles[handle] = ports
+			continue
+		}
+		if previousPorts == nil {
+			// Unknown, e.g. in a status comment of an older version
+			continue
+		}
+		for _, port := range ports {
+			if !previousPorts[port] {
+				newHandles[handle] = append(newHandles[handle], port)
+			}
+		}
+	}
+	notified := receiver.notifyMaintainers(ctx, owner, repo, number, event.PullRequest.GetBody(), newHandles, summary.openPorts)
+
+	// Maintainers of ports no longer changed stay notified
+	maintainers := summary.maintainers()
+	if pr != nil {
+		for _, handle := range pr.Maintainers {
+			if handle != "" && summary.handles[handle] == nil {
+				maintainers = append(maintainers, handle)
+			}
+		}
+	}
+	var err error
+	if pr == nil {
+		err = receiver.dbHelper.NewPR(ctx, owner, repo, number, maintainers)
+	} else {
+		err = receiver.dbHelper.SetPRMaintainers(ctx, owner, repo, number, maintainers)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	// A reopened PR waits for its maintainers again
+	if (len(newHandles) > 0 || reopened) && summary.requiresApproval() {
+		receiver.dbHelper.SetPRPendingReview(ctx, owner, repo, number, true)
+	}
+	return notified
+}
+
+// previousPorts returns the ports a PR changed when its status comment was
+// last updated, or nil if they are unknown.
+func (receiver *Receiver) previousPorts(ctx context.Context, owner, repo string, number int) map[string]bool {
+	comment, err := status.Get(ctx, receiver.githubClient, receiver.config.GitHub.BotName, owner, repo, number)
+	if err != nil {
+		log.Println(err)
+	}
+	if comment == nil || comment.ChangedPorts == nil {
+		return nil
+	}
+	ports := make(map[string]bool, len(comment.ChangedPorts))
+	for _, port := range comment.ChangedPorts {
+		ports[port] = true
+	}
+	return ports
+}
+
+// sameLabels reports whether a and b contain the same labels.
+func sameLabels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, label := range a {
+		set[label] = true
+	}
+	for _, label := range b {
+		if !set[label] {
+			return false
+		}
 	}
+	return true
 }
 
 // TODO: use map to dedup
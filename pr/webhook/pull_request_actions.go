@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/macports/mpbot-github/pr/status"
+)
+
+// pullRequestClosed records when a tracked PR was closed or merged, which
+// also stops waiting for its maintainers.
+func (receiver *Receiver) pullRequestClosed(ctx context.Context, event *github.PullRequestEvent) error {
+	closedAt := event.PullRequest.GetClosedAt()
+	if closedAt.IsZero() {
+		closedAt = time.Now()
+	}
+	var mergedAt time.Time
+	if event.PullRequest.GetMerged() {
+		mergedAt = event.PullRequest.GetMergedAt()
+		if mergedAt.IsZero() {
+			mergedAt = closedAt
+		}
+	}
+	err := receiver.dbHelper.SetPRClosed(ctx, *event.Repo.Owner.Login, *event.Repo.Name, *event.Number, closedAt, mergedAt)
+	if err != nil {
+		return err
+	}
+	if !mergedAt.IsZero() {
+		receiver.updateMergedTickets(detach(ctx), event)
+	}
+	return nil
+}
+
+// pullRequestReopened tracks a reopened PR of a repository without port
+// maintainers again. See processPullRequest for the others.
+func (receiver *Receiver) pullRequestReopened(ctx context.Context, owner, repo string, number int) error {
+	_, err := receiver.dbHelper.GetPR(ctx, owner, repo, number)
+	if err == sql.ErrNoRows {
+		return receiver.dbHelper.NewPR(ctx, owner, repo, number, nil)
+	}
+	if err != nil {
+		return err
+	}
+	return receiver.dbHelper.SetPRClosed(ctx, owner, repo, number, time.Time{}, time.Time{})
+}
+
+// setDraft pauses or resumes the maintainer timeout of a tracked PR.
+func (receiver *Receiver) setDraft(ctx context.Context, owner, repo string, number int, draft bool) error {
+	err := receiver.dbHelper.SetPRDraft(ctx, owner, repo, number, draft)
+	if err == sql.ErrNoRows {
+		// Not tracked by the bot
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ctx = detach(ctx)
+	pr, err := receiver.dbHelper.GetPR(ctx, owner, repo, number)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	receiver.updateStatus(ctx, owner, repo, number, func(comment *status.Comment) {
+		receiver.setTimeoutStatus(comment, pr)
+	})
+	return nil
+}
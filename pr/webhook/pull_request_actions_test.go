@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPullRequestActions(t *testing.T) {
+	stubClient := &stubGitHubClient{
+		labels: map[int][]string{3: {"maintainer: open", "help wanted"}},
+	}
+	stubDB := &stubDBHelper{}
+	receiver := newTestReceiver(stubClient, stubDB)
+	ctx := context.Background()
+	stubDB.NewPR(ctx, "macports", "macports-ports", 3, []string{"l2dy"})
+	stubDB.SetPRPendingReview(ctx, "macports", "macports-ports", 3, true)
+
+	newEvent := func(action string) *github.PullRequestEvent {
+		event := newPullRequestEvent(action, 3, "upx: update to 3.96")
+		event.PullRequest.Body = ptrOfStr("- [x] enhancement")
+		return event
+	}
+
+	// Edits of the title or body add type labels
+	edited := newEvent("edited")
+	edited.Changes = &github.EditChange{}
+	edited.Changes.Title = &struct {
+		From *string `json:"from,omitempty"`
+	}{From: ptrOfStr("upx: fix build")}
+	assert.NoError(t, receiver.processPullRequest(ctx, edited))
+	assert.ElementsMatch(t, []string{"maintainer: open", "help wanted", "type: update", "type: enhancement"}, stubClient.newLabels)
+
+	// Other edits are ignored
+	stubClient.newLabels = nil
+	edited.Changes = &github.EditChange{}
+	assert.NoError(t, receiver.processPullRequest(ctx, edited))
+	assert.Nil(t, stubClient.newLabels)
+
+	// Merging is recorded and stops the maintainer timeout
+	mergedAt := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	closed := newEvent("closed")
+	closed.PullRequest.ClosedAt = &mergedAt
+	closed.PullRequest.MergedAt = &mergedAt
+	closed.PullRequest.Merged = github.Bool(true)
+	assert.NoError(t, receiver.processPullRequest(ctx, closed))
+	assert.Equal(t, mergedAt, stubDB.prs[3].ClosedAt)
+	assert.Equal(t, mergedAt, stubDB.prs[3].MergedAt)
+	assert.False(t, stubDB.prs[3].PendingReview)
+
+	// Reopening tracks the PR again without notifying maintainers twice
+	assert.NoError(t, receiver.processPullRequest(ctx, newEvent("reopened")))
+	assert.True(t, stubDB.prs[3].ClosedAt.IsZero())
+	assert.True(t, stubDB.prs[3].MergedAt.IsZero())
+	assert.True(t, stubDB.prs[3].PendingReview)
+	assert.NotContains(t, stubClient.newComment, "@_l2dy")
+	assert.Contains(t, stubClient.newComment, "Waiting for maintainers to respond until")
+	assert.Equal(t, 1, stubClient.comments)
+
+	// A PR becoming ready for review is tracked and its maintainers notified,
+	// even if the bot missed it being opened
+	delete(stubDB.prs, 3)
+	assert.NoError(t, receiver.processPullRequest(ctx, newEvent("ready_for_review")))
+	assert.Equal(t, []string{"l2dy"}, stubDB.prs[3].Maintainers)
+	assert.False(t, stubDB.prs[3].Draft)
+	assert.True(t, stubDB.prs[3].PendingReview)
+	assert.Contains(t, stubClient.newComment, "Notifying maintainers:\n@_l2dy for port upx.\n")
+}
+
+func TestDraft(t *testing.T) {
+	stubClient := &stubGitHubClient{}
+	stubDB := &stubDBHelper{}
+	receiver := newTestReceiver(stubClient, stubDB)
+	ctx := context.Background()
+	newEvent := func(action string, draft bool) *github.PullRequestEvent {
+		event := newPullRequestEvent(action, 3, "upx: update to 3.96")
+		event.PullRequest.Draft = github.Bool(draft)
+		return event
+	}
+
+	// Drafts are labelled without notifying maintainers
+	assert.NoError(t, receiver.processPullRequest(ctx, newEvent("opened", true)))
+	assert.NotContains(t, stubClient.newComment, "Notifying maintainers")
+	assert.ElementsMatch(t, []string{"maintainer: open", "type: update"}, stubClient.newLabels)
+	assert.True(t, stubDB.prs[3].Draft)
+	assert.False(t, stubDB.prs[3].PendingReview)
+	assert.Empty(t, stubDB.prs[3].Maintainers)
+
+	// Pushes to drafts do not notify either
+	assert.NoError(t, receiver.processPullRequest(ctx, newEvent("synchronize", true)))
+	assert.NotContains(t, stubClient.newComment, "Notifying maintainers")
+	assert.False(t, stubDB.prs[3].PendingReview)
+
+	// Maintainers are notified and waited for once ready for review
+	stubClient.labels = map[int][]string{3: stubClient.newLabels}
+	assert.NoError(t, receiver.processPullRequest(ctx, newEvent("ready_for_review", false)))
+	assert.Contains(t, stubClient.newComment, "Notifying maintainers:\n@_l2dy for port upx.\n")
+	assert.Contains(t, stubClient.newComment, "Waiting for maintainers to respond until")
+	assert.False(t, stubDB.prs[3].Draft)
+	assert.True(t, stubDB.prs[3].PendingReview)
+	assert.Equal(t, []string{"l2dy"}, stubDB.prs[3].Maintainers)
+	// Edits of the status comment do not notify, so they are mentioned anew
+	assert.Equal(t, 2, stubClient.comments)
+	assert.Contains(t, stubClient.issueComments[3][1].GetBody(), "@_l2dy for port upx.\n")
+
+	// Converting back to a draft pauses the timeout, without notifying again
+	// when ready
+	assert.NoError(t, receiver.processPullRequest(ctx, newEvent("converted_to_draft", true)))
+	assert.True(t, stubDB.prs[3].Draft)
+	assert.Contains(t, stubClient.newComment, "Paused while the PR is a draft.")
+	assert.NoError(t, receiver.processPullRequest(ctx, newEvent("ready_for_review", false)))
+	assert.False(t, stubDB.prs[3].Draft)
+	assert.Contains(t, stubClient.newComment, "Waiting for maintainers to respond until")
+	assert.Equal(t, 2, stubClient.comments)
+
+	// Untracked PRs are ignored
+	untracked := newEvent("converted_to_draft", true)
+	untracked.Number = ptrOfInt(6)
+	assert.NoError(t, receiver.processPullRequest(ctx, untracked))
+}
@@ -1,25 +1,20 @@
 package webhook
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"log"
 	"regexp"
 	"strconv"
 
 	"github.com/google/go-github/v28/github"
+	"github.com/macports/mpbot-github/pr/githubapi"
+	"github.com/macports/mpbot-github/pr/status"
 )
 
-func (receiver *Receiver) handleOtherPullRequestEvents(eventType string, body []byte) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println(r)
-		}
-
-		if !receiver.testing {
-			receiver.wg.Done()
-		}
-	}()
-
+func (receiver *Receiver) handleOtherPullRequestEvents(ctx context.Context, eventType string, body []byte) error {
+	var owner, repo string
 	var number int
 	var sender string
 
@@ -29,9 +24,11 @@ func (receiver *Receiver) handleOtherPullRequestEvents(eventType string, body []
 		err := json.Unmarshal(body, event)
 		if err != nil {
 			log.Println(err)
-			return
+			return nil
 		}
 
+		owner = *event.Repo.Owner.Login
+		repo = *event.Repo.Name
 		number = *event.PullRequest.Number
 		sender = *event.Sender.Login
 	case "issue_comment":
@@ -39,31 +36,40 @@ func (receiver *Receiver) handleOtherPullRequestEvents(eventType string, body []
 		err := json.Unmarshal(body, event)
 		if err != nil {
 			log.Println(err)
-			return
+			return nil
 		}
 
-		receiver.membersLock.RLock()
-		members := receiver.members
-		receiver.membersLock.RUnlock()
-		if members != nil {
-			_, isMember := (*members)[*event.Sender.Login]
-			if isMember {
-				body := *event.Comment.Body
-				if botMentioned, _ := regexp.MatchString(`@macportsbot\s`, body); botMentioned { // TODO: read bot user from ENV
-					if doRetry, _ := regexp.MatchString(`@macportsbot\s+retry`, body); doRetry { // TODO: test compile patterns
-						pr, err := receiver.githubClient.GetPullRequest(*event.Repo.Owner.Login, *event.Repo.Name, *event.Issue.Number)
-						if err != nil {
-							log.Println(err)
-							return
-						}
-						fakeEvent := &github.PullRequestEvent{
-							Action:      ptrOfStr("opened"),
-							Number:      event.Issue.Number,
-							Repo:        event.Repo,
-							Sender:      event.Issue.User,
-							PullRequest: pr,
-						}
-						receiver.processPullRequest(fakeEvent)
+		// The bot's own replies never run commands
+		if receiver.isBot(event.GetSender().GetLogin()) {
+			return nil
+		}
+		owner = *event.Repo.Owner.Login
+		repo = *event.Repo.Name
+		botMention := "@" + regexp.QuoteMeta(receiver.config.GitHub.BotName)
+		if event.GetAction() == "created" {
+			// Anyone may set their own preferences
+			command := regexp.MustCompile(botMention + `\s+preferences\b(.*)`).FindStringSubmatch(*event.Comment.Body)
+			if command != nil {
+				return receiver.preferencesCommand(ctx, owner, repo, *event.Issue.Number, *event.Sender.Login, command[1])
+			}
+		}
+		if receiver.isMember(owner, *event.Sender.Login) {
+			body := *event.Comment.Body
+			if botMentioned, _ := regexp.MatchString(botMention+`\s`, body); botMentioned {
+				if doRetry, _ := regexp.MatchString(botMention+`\s+retry`, body); doRetry {
+					pr, err := receiver.githubClient.GetPullRequest(ctx, owner, repo, *event.Issue.Number)
+					if err != nil {
+						return err
+					}
+					fakeEvent := &github.PullRequestEvent{
+						Action:      ptrOfStr("opened"),
+						Number:      event.Issue.Number,
+						Repo:        event.Repo,
+						Sender:      event.Issue.User,
+						PullRequest: pr,
+					}
+					if err := receiver.processPullRequest(ctx, fakeEvent); err != nil {
+						return err
 					}
 				}
 			}
@@ -72,19 +78,22 @@ func (receiver *Receiver) handleOtherPullRequestEvents(eventType string, body []
 		number = *event.Issue.Number
 		sender = *event.Sender.Login
 	default:
-		return
+		return nil
 	}
 
-	pr, err := receiver.dbHelper.GetPR(number)
+	pr, err := receiver.dbHelper.GetPR(ctx, owner, repo, number)
+	if err == sql.ErrNoRows {
+		// Not tracked by the bot
+		return nil
+	}
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	if !pr.Processed {
-		return
+		return nil
 	}
 	if !pr.PendingReview {
-		return
+		return nil
 	}
 	isOneMaintainer := false
 	for _, maintainer := range pr.Maintainers {
@@ -93,7 +102,18 @@ func (receiver *Receiver) handleOtherPullRequestEvents(eventType string, body []
 		}
 	}
 	if isOneMaintainer {
-		log.Println("Maintainer responded in PR #" + strconv.Itoa(pr.Number))
-		receiver.dbHelper.SetPRPendingReview(number, false)
+		log.Println("Maintainer responded in PR " + owner + "/" + repo + "#" + strconv.Itoa(pr.Number))
+		if err := receiver.dbHelper.SetPRPendingReview(ctx, owner, repo, number, false); err != nil {
+			return err
+		}
+		receiver.updateStatus(detach(ctx), owner, repo, number, func(comment *status.Comment) {
+			comment.Timeout = status.Timeout{State: status.TimeoutResponded, Responder: sender}
+		})
 	}
+	return nil
+}
+
+// isBot reports whether login is the bot's, as a user or as a GitHub App.
+func (receiver *Receiver) isBot(login string) bool {
+	return githubapi.IsLogin(login, receiver.config.GitHub.BotName)
 }
@@ -1,23 +1,29 @@
 package webhook
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/google/go-github/v28/github"
+	"github.com/macports/mpbot-github/pr/config"
 	"github.com/macports/mpbot-github/pr/db"
+	"github.com/macports/mpbot-github/pr/githubapi"
+	"github.com/macports/mpbot-github/pr/portfile"
+	"github.com/macports/mpbot-github/pr/status"
 )
 
 var errNotFound = errors.New("404")
 
-func TestCVERegexp(t *testing.T) {
-	assert.Equal(t, "CVE-2017-0001", cveRegexp.FindString("Fixes CVE-2017-0001."))
-	assert.Equal(t, "", cveRegexp.FindString("CVE-pending."))
-}
-
 type PullRequestEventTest struct {
 	number  int
 	sender  string
@@ -30,10 +36,11 @@ type PullRequestEventTest struct {
 func TestHandlePullRequest(t *testing.T) {
 	stubClient := stubGitHubClient{}
 	receiver := &Receiver{
+		config:       config.Default(),
 		githubClient: &stubClient,
 		dbHelper:     &stubDBHelper{},
-		members: &map[string]bool{
-			"l2dy": true,
+		members: map[string]map[string]bool{
+			"macports": {"l2dy": true},
 		},
 		testing: true,
 	}
@@ -64,14 +71,18 @@ func TestHandlePullRequest(t *testing.T) {
 		{number: 1, sender: "l2dy", title: "z: update to 1.1", labels: []string{"maintainer: none", "type: update", "by: member"}},
 		{number: 1, sender: "jverne", title: "z: update to 1.1", body: "[x] enhancement", labels: []string{"maintainer: none", "type: update", "type: enhancement"}},
 		{number: 1, sender: "jverne", title: "z: update to 1.1", body: "Fixes CVE-0000-0.", labels: []string{"maintainer: none", "type: update", "type: security fix"}},
-		{number: 2, sender: "jverne", title: "upx-devel: new port", labels: []string{"type: submission"}},
+		{number: 2, sender: "jverne", title: "upx-devel: new port", comment: "- upx-devel: [archivers/upx](https://github.com/macports/macports-ports/blob/master/archivers/upx/Portfile)\n", labels: []string{"type: submission", "needs review: duplicate"}},
 		{number: 3, sender: "l2dy", title: "upx: update to 1.1", labels: []string{"maintainer", "maintainer: open", "type: update", "by: member"}},
 		{number: 3, sender: "jverne", title: "upx: update to 1.1", comment: "Notifying maintainers:\n@_l2dy for port upx.\n", labels: []string{"maintainer: open", "type: update"}},
 		{number: 3, sender: "jverne", title: "upx: update to 1.1", body: "<!-- [skip notification] -->", labels: []string{"maintainer: open", "type: update"}},
+		// Labelled from the Portfile diff
+		{number: 6, sender: "jverne", title: "upx: new version", comment: "- upx, update: version 3.95 → 3.96\n", labels: []string{"maintainer: open", "type: update"}},
+		{number: 7, sender: "jverne", title: "upx: rebuild", comment: "- upx, revbump: revision 0 → 1\n", labels: []string{"maintainer: open", "type: revbump"}},
 	}
 	for _, prt := range prTests {
 		stubClient.newComment = ""
 		stubClient.newLabels = nil
+		stubClient.issueComments = nil
 		event.Number = &prt.number
 		event.Sender.Login = &prt.sender
 		event.PullRequest.Title = &prt.title
@@ -80,26 +91,321 @@ func TestHandlePullRequest(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		receiver.handlePullRequest(eventBody)
-		assert.Equal(t, prt.comment, stubClient.newComment)
+		receiver.handlePullRequest(context.Background(), eventBody)
+		if prt.comment != "" {
+			assert.Contains(t, stubClient.newComment, prt.comment)
+		} else {
+			assert.NotContains(t, stubClient.newComment, "Notifying maintainers")
+		}
 		assert.Subset(t, stubClient.newLabels, prt.labels)
 		assert.Subset(t, prt.labels, stubClient.newLabels)
 	}
+
+	// Repositories missing from the config are ignored
+	stubClient.newLabels = nil
+	event.Repo.Name = ptrOfStr("macports-base")
+	eventBody, _ := json.Marshal(event)
+	assert.NoError(t, receiver.handlePullRequest(context.Background(), eventBody))
+	assert.Nil(t, stubClient.newLabels)
+}
+
+func TestIsMinorChange(t *testing.T) {
+	file := &github.CommitFile{Filename: ptrOfStr("archivers/upx/Portfile"), Changes: ptrOfInt(8)}
+	assert.False(t, isMinorChange(file, nil, 2))
+	assert.True(t, isMinorChange(file, nil, 8))
+
+	// A revbump is minor however many lines change, unlike other changes
+	revbump := portfile.ParseDiff("@@ -1,3 +1,3 @@\n-revision 0\n+revision 1\n")
+	assert.True(t, isMinorChange(file, revbump, 2))
+	update := portfile.ParseDiff("@@ -1,3 +1,3 @@\n-version 1.0\n+version 1.1\n")
+	assert.False(t, isMinorChange(file, update, 8))
+}
+
+func TestChecksumChange(t *testing.T) {
+	patch, err := ioutil.ReadFile("../portfile/testdata/checksum.diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stubClient := &stubGitHubClient{files: map[int][]*github.CommitFile{8: {{
+		Filename: ptrOfStr("archivers/upx/Portfile"),
+		Status:   ptrOfStr("modified"),
+		Changes:  ptrOfInt(4),
+		Patch:    ptrOfStr(string(patch)),
+	}}}}
+	receiver := newTestReceiver(stubClient, &stubDBHelper{})
+	event := newPullRequestEvent("opened", 8, "upx: fix checksums")
+	event.PullRequest.Body = nil
+
+	assert.NoError(t, receiver.processPullRequest(context.Background(), event))
+	assert.Contains(t, stubClient.newLabels, "needs review: checksum")
+	assert.Equal(t, 2, stubClient.comments)
+	assert.Contains(t, stubClient.newComment, "@_jverne, the checksums of port upx change without a change of version or revision.")
+	status, _ := stubClient.FindComment(context.Background(), "macports", "macports-ports", 8, "macportsbot", "<!-- mpbot-status")
+	assert.Contains(t, status.GetBody(), "- upx, checksum: checksums\n")
+	assert.Contains(t, status.GetBody(), "- `needs review: checksum`: the checksums change without the version or revision\n")
+
+	// Only asked once
+	event.Action = ptrOfStr("synchronize")
+	assert.NoError(t, receiver.processPullRequest(context.Background(), event))
+	assert.Equal(t, 2, stubClient.comments)
+}
+
+func TestDependents(t *testing.T) {
+	stubClient := &stubGitHubClient{}
+	stubDB := &stubDBHelper{}
+	receiver := newTestReceiver(stubClient, stubDB)
+	event := newPullRequestEvent("opened", 1, "z: update to 1.1")
+
+	assert.NoError(t, receiver.processPullRequest(context.Background(), event))
+	status, _ := stubClient.FindComment(context.Background(), "macports", "macports-ports", 1, "macportsbot", "<!-- mpbot-status")
+	assert.Contains(t, status.GetBody(), "#### Dependents\n- z: 6 direct, 7 in total, e.g. a, b, c, d, e, …\n")
+	// Fewer than the default threshold
+	assert.NotContains(t, stubClient.newLabels, "impact: high")
+
+	// As many as the threshold
+	many := &db.Dependents{Subports: []string{"z"}}
+	for i := 0; i < 100; i++ {
+		many.Transitive = append(many.Transitive, "z-"+strconv.Itoa(i))
+	}
+	many.Direct = many.Transitive[:1]
+	stubDB.dependents = map[string]*db.Dependents{"z": many}
+	assert.NoError(t, receiver.processPullRequest(context.Background(), event))
+	assert.Contains(t, stubClient.newLabels, "impact: high")
+	stubDB.dependents = nil
+
+	summary := receiver.summarizePorts(context.Background(), []string{"z", "upx"}, []*github.CommitFile{
+		{Filename: ptrOfStr("sysutils/z/Portfile"), Status: ptrOfStr("modified")},
+		{Filename: ptrOfStr("archivers/upx/Portfile"), Status: ptrOfStr("modified")},
+	}, "jverne", 2)
+	assert.Len(t, impactReport([]string{"z", "upx"}, summary), 1)
+	assert.Equal(t, 7, receiver.labelFacts(event, nil, summary).Dependents)
+
+	// Failed lookups count towards the limit too
+	stubDB.dependentLookups = 0
+	var ports []string
+	var files []*github.CommitFile
+	for i := 0; i < 2*maxImpactPorts; i++ {
+		port := "z-" + strconv.Itoa(i)
+		ports = append(ports, port, port)
+		files = append(files,
+			&github.CommitFile{Filename: ptrOfStr("devel/" + port + "/Portfile"), Status: ptrOfStr("modified")},
+			&github.CommitFile{Filename: ptrOfStr("devel/" + port + "/files/patch-a.diff"), Status: ptrOfStr("modified")})
+	}
+	summary = receiver.summarizePorts(context.Background(), ports, files, "jverne", 2)
+	assert.Empty(t, summary.dependents)
+	assert.Equal(t, maxImpactPorts, stubDB.dependentLookups)
+}
+
+func TestDuplicates(t *testing.T) {
+	receiver := &Receiver{config: config.Default(), dbHelper: &stubDBHelper{}}
+	summarize := func(files ...*github.CommitFile) *portsSummary {
+		ports := make([]string, len(files))
+		for i, file := range files {
+			ports[i] = githubapi.PortOfPath(file.GetFilename())
+		}
+		return receiver.summarizePorts(context.Background(), ports, files, "jverne", 2)
+	}
+
+	// A known name added in another category
+	summary := summarize(&github.CommitFile{Filename: ptrOfStr("sysutils/upx/Portfile"), Status: ptrOfStr("added")})
+	assert.Equal(t, []*db.Port{{Name: "upx", Path: "archivers/upx"}}, summary.duplicates["upx"])
+
+	// Not a duplicate of itself, or of a port moved away
+	summary = summarize(&github.CommitFile{Filename: ptrOfStr("archivers/upx/Portfile"), Status: ptrOfStr("added")})
+	assert.Empty(t, summary.duplicates)
+	summary = summarize(
+		&github.CommitFile{Filename: ptrOfStr("archivers/upx/Portfile"), Status: ptrOfStr("removed")},
+		&github.CommitFile{Filename: ptrOfStr("sysutils/upx/Portfile"), Status: ptrOfStr("added")},
+	)
+	assert.Empty(t, summary.duplicates)
+}
+
+func TestRemovalsAndRenames(t *testing.T) {
+	stubClient := &stubGitHubClient{files: map[int][]*github.CommitFile{
+		9: {{
+			Filename: ptrOfStr("sysutils/z/Portfile"),
+			Status:   ptrOfStr("removed"),
+			Changes:  ptrOfInt(30),
+			Patch:    ptrOfStr("@@ -1,3 +0,0 @@\n-PortSystem 1.0\n-name z\n-version 1.0\n"),
+		}},
+		10: {{
+			Filename:         ptrOfStr("archivers/upx-ucl/Portfile"),
+			PreviousFilename: ptrOfStr("archivers/upx/Portfile"),
+			Status:           ptrOfStr("renamed"),
+			Changes:          ptrOfInt(2),
+			Patch:            ptrOfStr("@@ -1,3 +1,3 @@\n PortSystem 1.0\n-name upx\n+name upx-ucl\n"),
+		}},
+	}}
+	receiver := newTestReceiver(stubClient, &stubDBHelper{})
+
+	assert.NoError(t, receiver.processPullRequest(context.Background(), newPullRequestEvent("opened", 9, "z: remove")))
+	assert.Contains(t, stubClient.newLabels, "type: removal")
+	assert.NotContains(t, stubClient.newLabels, "type: update")
+	status, _ := stubClient.FindComment(context.Background(), "macports", "macports-ports", 9, "macportsbot", "<!-- mpbot-status")
+	assert.Contains(t, status.GetBody(), "- z: removed, but a, b, c, d, e and 1 more still depend on it.\n")
+
+	assert.NoError(t, receiver.processPullRequest(context.Background(), newPullRequestEvent("opened", 10, "upx: rename to upx-ucl")))
+	assert.Contains(t, stubClient.newLabels, "type: rename")
+	status, _ = stubClient.FindComment(context.Background(), "macports", "macports-ports", 10, "macportsbot", "<!-- mpbot-status")
+	assert.Contains(t, status.GetBody(), "- upx: renamed to upx-ucl without a stub")
+}
+
+func TestPortOperation(t *testing.T) {
+	stub := &github.CommitFile{Filename: ptrOfStr("archivers/upx-devel/Portfile"), Status: ptrOfStr("modified")}
+	added := map[string]bool{"upx-next": true}
+	assert.Equal(t, &status.PortOperation{Port: "upx-devel", Kind: status.OperationRename, To: "upx-next", Stub: true},
+		portOperation("upx-devel", stub, &portfile.Diff{ReplacedBy: "upx-next", Obsolete: true}, added))
+	// Replaced by a port the PR does not add
+	assert.Equal(t, &status.PortOperation{Port: "upx-devel", Kind: status.OperationRemoval, To: "upx"},
+		portOperation("upx-devel", stub, &portfile.Diff{ReplacedBy: "upx", Obsolete: true}, added))
+	// Obsolete stubs without a replacement remove the port
+	assert.Equal(t, &status.PortOperation{Port: "upx-devel", Kind: status.OperationRemoval},
+		portOperation("upx-devel", stub, &portfile.Diff{Obsolete: true}, added))
+	assert.Nil(t, portOperation("upx-devel", stub, &portfile.Diff{}, added))
+
+	moved := &github.CommitFile{
+		Filename:         ptrOfStr("sysutils/upx/Portfile"),
+		PreviousFilename: ptrOfStr("archivers/upx/Portfile"),
+		Status:           ptrOfStr("renamed"),
+	}
+	assert.Equal(t, &status.PortOperation{Port: "upx", Kind: status.OperationMove, From: "archivers", To: "sysutils"},
+		portOperation("upx", moved, nil, nil))
+	patch := &github.CommitFile{Filename: ptrOfStr("archivers/upx/files/patch-a.diff"), Status: ptrOfStr("removed")}
+	assert.Nil(t, portOperation("upx", patch, nil, nil))
+}
+
+func TestRemainingDependents(t *testing.T) {
+	receiver := &Receiver{config: config.Default(), dbHelper: &stubDBHelper{
+		dependents: map[string]*db.Dependents{
+			"upx":     {Subports: []string{"upx", "upx-nrv"}, Direct: []string{"lzip", "upx-old-doc"}},
+			"upx-old": {Subports: []string{"upx-old", "upx-old-doc"}},
+		},
+	}}
+	summary := receiver.summarizePorts(context.Background(), []string{"upx", "upx-old"}, []*github.CommitFile{
+		{Filename: ptrOfStr("archivers/upx/Portfile"), Status: ptrOfStr("removed")},
+		{Filename: ptrOfStr("archivers/upx-old/Portfile"), Status: ptrOfStr("removed")},
+	}, "jverne", 2)
+	// Subports of other ports removed no longer depend on them
+	assert.Equal(t, 1, summary.operations["upx"].DependentCount)
+	assert.Equal(t, []string{"lzip"}, summary.operations["upx"].Dependents)
+	assert.Zero(t, summary.operations["upx-old"].DependentCount)
+}
+
+func TestSynchronize(t *testing.T) {
+	stubClient := &stubGitHubClient{
+		labels: map[int][]string{5: {"maintainer: none", "type: update", "help wanted"}},
+		files: map[int][]*github.CommitFile{5: {
+			{Filename: ptrOfStr("sysutils/z/Portfile"), Status: ptrOfStr("modified"), Changes: ptrOfInt(6)},
+			{Filename: ptrOfStr("archivers/upx/Portfile"), Status: ptrOfStr("modified"), Changes: ptrOfInt(2)},
+		}},
+	}
+	stubDB := &stubDBHelper{preferences: map[string]*db.Preferences{
+		"l2dy": {Handle: "l2dy", Assign: false, OpenMaintainer: true},
+	}}
+	receiver := newTestReceiver(stubClient, stubDB)
+	// Opened changing only z, which has no maintainer
+	stubDB.NewPR(context.Background(), "macports", "macports-ports", 5, nil)
+	event := newPullRequestEvent("synchronize", 5, "z, upx: update")
+	// GitHub sends null for an empty description
+	event.PullRequest.Body = nil
+
+	// A push also changing upx notifies its maintainer
+	assert.NoError(t, receiver.processPullRequest(context.Background(), event))
+	assert.Contains(t, stubClient.newComment, "Notifying maintainers:\n@_l2dy for port upx.\n")
+	assert.ElementsMatch(t, []string{"type: update", "help wanted", "maintainer: open"}, stubClient.newLabels)
+	assert.Equal(t, []string{"l2dy"}, stubDB.prs[5].Maintainers)
+	// Maintainers not assigned learn of the PR through a new comment
+	assert.Empty(t, stubClient.assignees)
+	assert.Equal(t, 2, stubClient.comments)
+	assert.Contains(t, stubClient.issueComments[5][1].GetBody(), "@_l2dy for port upx.\n")
+
+	// Further pushes leave notified maintainers and unchanged labels alone
+	stubClient.newComment = ""
+	stubClient.newLabels = nil
+	stubClient.labels[5] = []string{"type: update", "maintainer: open", "help wanted"}
+	assert.NoError(t, receiver.processPullRequest(context.Background(), event))
+	assert.Empty(t, stubClient.newComment)
+	assert.Nil(t, stubClient.newLabels)
+	assert.Equal(t, []string{"l2dy"}, stubDB.prs[5].Maintainers)
+	assert.Equal(t, 2, stubClient.comments)
+
+	// A push changing another port of a notified maintainer notifies them
+	// of that port, and waits for them again
+	stubDB.prs[5].PendingReview = false
+	stubClient.files[5] = append(stubClient.files[5],
+		&github.CommitFile{Filename: ptrOfStr("archivers/lzip/Portfile"), Status: ptrOfStr("modified"), Changes: ptrOfInt(2)})
+	assert.NoError(t, receiver.processPullRequest(context.Background(), event))
+	assert.Equal(t, 3, stubClient.comments)
+	assert.Contains(t, stubClient.issueComments[5][2].GetBody(), "@_l2dy for port lzip.\n")
+	status, _ := stubClient.FindComment(context.Background(), "macports", "macports-ports", 5, "macportsbot", "<!-- mpbot-status")
+	assert.Contains(t, status.GetBody(), "Notifying maintainers:\n@_l2dy for port upx, lzip.\n")
+	assert.True(t, stubDB.prs[5].PendingReview)
+}
+
+// newTestReceiver returns a receiver processing events with the stubs.
+func newTestReceiver(client *stubGitHubClient, dbHelper *stubDBHelper) *Receiver {
+	return &Receiver{
+		config:       config.Default(),
+		githubClient: client,
+		dbHelper:     dbHelper,
+		testing:      true,
+	}
+}
+
+// newPullRequestEvent returns an event of a PR by jverne to
+// macports/macports-ports.
+func newPullRequestEvent(action string, number int, title string) *github.PullRequestEvent {
+	return &github.PullRequestEvent{
+		Action: ptrOfStr(action),
+		Number: ptrOfInt(number),
+		PullRequest: &github.PullRequest{
+			Title: ptrOfStr(title),
+			Body:  ptrOfStr(""),
+		},
+		Repo: &github.Repository{
+			Name:  ptrOfStr("macports-ports"),
+			Owner: &github.User{Login: ptrOfStr("macports")},
+		},
+		Sender: &github.User{Login: ptrOfStr("jverne")},
+	}
 }
 
 type stubGitHubClient struct {
 	newComment string
 	newLabels  []string
+	labels     map[int][]string
+	// Files changed by PR, besides the fixtures of ListChangedPortsAndFiles
+	files map[int][]*github.CommitFile
+	// Comments created
+	comments      int
+	issueComments map[int][]*github.IssueComment
+	assignees     []string
+	commits       map[int][]*github.RepositoryCommit
+	commitsErr    error
+	commitFiles   map[string][]string
+	// Calls of ListCommitFiles
+	commitFileLookups int
+	rate              *github.Rate
 }
 
-func (stub *stubGitHubClient) GetPullRequest(owner, repo string, number int) (*github.PullRequest, error) {
+func (stub *stubGitHubClient) GetPullRequest(ctx context.Context, owner, repo string, number int) (*github.PullRequest, error) {
 	return nil, errNotFound
 }
 
-func (stub *stubGitHubClient) ListChangedPortsAndFiles(owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error) {
+func (stub *stubGitHubClient) ListChangedPortsAndFiles(ctx context.Context, owner, repo string, number int) (ports []string, commitFiles []*github.CommitFile, err error) {
 	if owner != "macports" || repo != "macports-ports" {
 		return nil, nil, errNotFound
 	}
+	if files, ok := stub.files[number]; ok {
+		for _, file := range files {
+			path := file.GetFilename()
+			if file.GetStatus() == "renamed" {
+				path = file.GetPreviousFilename()
+			}
+			ports = append(ports, githubapi.PortOfPath(path))
+		}
+		return ports, files, nil
+	}
 	switch number {
 	case 1:
 		return []string{"z"},
@@ -128,49 +434,132 @@ func (stub *stubGitHubClient) ListChangedPortsAndFiles(owner, repo string, numbe
 					Changes:  ptrOfInt(6),
 				},
 			}, nil
+	case 6:
+		return []string{"upx"},
+			[]*github.CommitFile{
+				{
+					Filename: ptrOfStr("archivers/upx/Portfile"),
+					Status:   ptrOfStr("modified"),
+					Changes:  ptrOfInt(2),
+					Patch:    ptrOfStr("@@ -4,7 +4,7 @@\n PortGroup github 1.0\n-github.setup upx upx 3.95 v\n+github.setup upx upx 3.96 v\n categories archivers\n"),
+				},
+			}, nil
+	case 7:
+		return []string{"upx"},
+			[]*github.CommitFile{
+				{
+					Filename: ptrOfStr("archivers/upx/Portfile"),
+					Status:   ptrOfStr("modified"),
+					Changes:  ptrOfInt(2),
+					Patch:    ptrOfStr("@@ -4,7 +4,7 @@\n version 3.95\n-revision 0\n+revision 1\n categories archivers\n"),
+				},
+			}, nil
 	default:
 		return nil, nil, errNotFound
 	}
 }
 
-func (stub *stubGitHubClient) CreateComment(owner, repo string, number int, body *string) error {
+func (stub *stubGitHubClient) CreateComment(ctx context.Context, owner, repo string, number int, body *string) error {
 	stub.newComment = *body
+	stub.comments++
+	if stub.issueComments == nil {
+		stub.issueComments = make(map[int][]*github.IssueComment)
+	}
+	stub.issueComments[number] = append(stub.issueComments[number], &github.IssueComment{
+		ID:   github.Int64(int64(stub.comments)),
+		Body: github.String(*body),
+		User: &github.User{Login: github.String("macportsbot")},
+	})
 	return nil
 }
 
-func (client *stubGitHubClient) AddAssignees(owner, repo string, number int, assignees []string) error {
+func (stub *stubGitHubClient) FindComment(ctx context.Context, owner, repo string, number int, author, marker string) (*github.IssueComment, error) {
+	for _, comment := range stub.issueComments[number] {
+		if githubapi.IsLogin(comment.GetUser().GetLogin(), author) && strings.Contains(comment.GetBody(), marker) {
+			return comment, nil
+		}
+	}
+	return nil, nil
+}
+
+func (stub *stubGitHubClient) EditComment(ctx context.Context, owner, repo string, id int64, body *string) error {
+	for _, comments := range stub.issueComments {
+		for _, comment := range comments {
+			if comment.GetID() == id {
+				comment.Body = github.String(*body)
+				stub.newComment = *body
+				return nil
+			}
+		}
+	}
+	return errNotFound
+}
+
+func (stub *stubGitHubClient) AddAssignees(ctx context.Context, owner, repo string, number int, assignees []string) error {
+	stub.assignees = append(stub.assignees, assignees...)
 	return nil
 }
 
-func (stub *stubGitHubClient) ReplaceLabels(owner, repo string, number int, labels []string) error {
+func (stub *stubGitHubClient) ReplaceLabels(ctx context.Context, owner, repo string, number int, labels []string) error {
 	stub.newLabels = labels
 	return nil
 }
 
-func (stub *stubGitHubClient) ListLabels(owner, repo string, number int) ([]string, error) {
+func (stub *stubGitHubClient) ListCommits(ctx context.Context, owner, repo string, number int) ([]*github.RepositoryCommit, error) {
+	if stub.commitsErr != nil {
+		return nil, stub.commitsErr
+	}
+	return stub.commits[number], nil
+}
+
+func (stub *stubGitHubClient) ListCommitFiles(ctx context.Context, owner, repo, sha string) ([]string, error) {
+	stub.commitFileLookups++
+	return stub.commitFiles[sha], nil
+}
+
+func (stub *stubGitHubClient) ListLabels(ctx context.Context, owner, repo string, number int) ([]string, error) {
 	if owner != "macports" || repo != "macports-ports" {
 		return nil, errNotFound
 	}
-	return nil, nil
+	return stub.labels[number], nil
 }
 
-func (stub *stubGitHubClient) ListOrgMembers(org string) ([]*github.User, error) {
+func (stub *stubGitHubClient) ListOrgMembers(ctx context.Context, org string) ([]*github.User, error) {
 	return []*github.User{
 		{Login: ptrOfStr("l2dy")},
 	}, nil
 }
 
-type stubDBHelper struct{}
+func (stub *stubGitHubClient) GetRateLimit(ctx context.Context) (*github.Rate, error) {
+	if stub.rate == nil {
+		return nil, errors.New("401 Bad credentials")
+	}
+	return stub.rate, nil
+}
+
+type stubDBHelper struct {
+	pingErr       error
+	prs           map[int]*db.PullRequest
+	eventStatus   map[string]string
+	eventAttempts map[string]int
+	eventPayloads map[string][]byte
+	preferences   map[string]*db.Preferences
+	tickets       map[int][]*db.Ticket
+	// Dependents by port, replacing those of z and the others below
+	dependents map[string]*db.Dependents
+	// Calls of GetDependents
+	dependentLookups int
+}
 
-func (stub *stubDBHelper) GetGitHubHandle(email string) (string, error) {
+func (stub *stubDBHelper) GetGitHubHandle(ctx context.Context, email string) (string, error) {
 	if email == "l2dy@macports.org" {
 		return "l2dy", nil
 	}
 	return "", errNotFound
 }
 
-func (stub *stubDBHelper) GetPortMaintainer(port string) (*db.PortMaintainer, error) {
-	if port == "upx" {
+func (stub *stubDBHelper) GetPortMaintainer(ctx context.Context, port string) (*db.PortMaintainer, error) {
+	if port == "upx" || port == "lzip" {
 		return &db.PortMaintainer{
 			Primary: &db.Maintainer{
 				GithubHandle: "l2dy",
@@ -180,7 +569,8 @@ func (stub *stubDBHelper) GetPortMaintainer(port string) (*db.PortMaintainer, er
 			OpenMaintainer: true,
 		}, nil
 	}
-	if port == "z" {
+	// z and the ports rebuilt for it
+	if port == "z" || strings.HasPrefix(port, "z-") {
 		return &db.PortMaintainer{
 			Primary:        nil,
 			NoMaintainer:   true,
@@ -190,19 +580,210 @@ func (stub *stubDBHelper) GetPortMaintainer(port string) (*db.PortMaintainer, er
 	return nil, errors.New("port not found")
 }
 
-func (stub *stubDBHelper) NewPR(number int, maintainers []string) error {
+func (stub *stubDBHelper) FindSimilarPorts(ctx context.Context, name string) ([]*db.Port, error) {
+	if strings.EqualFold(strings.TrimSuffix(name, "-devel"), "upx") {
+		return []*db.Port{{Name: "upx", Path: "archivers/upx"}}, nil
+	}
+	return nil, nil
+}
+
+func (stub *stubDBHelper) GetDependents(ctx context.Context, port string) (*db.Dependents, error) {
+	stub.dependentLookups++
+	if dependents, ok := stub.dependents[port]; ok {
+		return dependents, nil
+	}
+	if strings.HasPrefix(port, "z-") {
+		return nil, errors.New("canceling statement due to statement timeout")
+	}
+	if port == "z" {
+		return &db.Dependents{
+			Subports:   []string{"z"},
+			Direct:     []string{"a", "b", "c", "d", "e", "f"},
+			Transitive: []string{"a", "b", "c", "d", "e", "f", "g"},
+		}, nil
+	}
+	return &db.Dependents{Subports: []string{port}}, nil
+}
+
+func (stub *stubDBHelper) NewPR(ctx context.Context, owner, repo string, number int, maintainers []string) error {
+	if stub.prs == nil {
+		stub.prs = make(map[int]*db.PullRequest)
+	}
+	stub.prs[number] = &db.PullRequest{Owner: owner, Repo: repo, Number: number, Maintainers: maintainers}
 	return nil
 }
-func (stub *stubDBHelper) GetPR(number int) (*db.PullRequest, error) {
+func (stub *stubDBHelper) GetPR(ctx context.Context, owner, repo string, number int) (*db.PullRequest, error) {
+	if pr, ok := stub.prs[number]; ok {
+		return pr, nil
+	}
+	return nil, sql.ErrNoRows
+}
+func (stub *stubDBHelper) GetTimeoutPRs(ctx context.Context, owner, repo string, timeout time.Duration) ([]*db.PullRequest, error) {
 	return nil, nil
 }
-func (stub *stubDBHelper) GetTimeoutPRs() ([]*db.PullRequest, error) {
+func (stub *stubDBHelper) SetPRProcessed(ctx context.Context, owner, repo string, number int, processed bool) error {
+	return nil
+}
+
+func (stub *stubDBHelper) SetPRMaintainers(ctx context.Context, owner, repo string, number int, maintainers []string) error {
+	stub.prs[number].Maintainers = maintainers
+	return nil
+}
+
+func (stub *stubDBHelper) SetPRClosed(ctx context.Context, owner, repo string, number int, closedAt, mergedAt time.Time) error {
+	if pr, ok := stub.prs[number]; ok {
+		pr.ClosedAt = closedAt
+		pr.MergedAt = mergedAt
+		pr.PendingReview = pr.PendingReview && closedAt.IsZero()
+	}
+	return nil
+}
+
+func (stub *stubDBHelper) SetPRDraft(ctx context.Context, owner, repo string, number int, draft bool) error {
+	pr, ok := stub.prs[number]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	pr.Draft = draft
+	return nil
+}
+
+func (stub *stubDBHelper) SetPRPendingReview(ctx context.Context, owner, repo string, number int, pendingReview bool) error {
+	if pr, ok := stub.prs[number]; ok {
+		pr.PendingReview = pendingReview
+		if pendingReview {
+			pr.PendingSince = time.Now()
+		}
+	}
+	return nil
+}
+
+func (stub *stubDBHelper) GetPreferences(ctx context.Context, handles []string) (map[string]*db.Preferences, error) {
+	preferences := make(map[string]*db.Preferences)
+	for _, handle := range handles {
+		if p, ok := stub.preferences[handle]; ok {
+			copied := *p
+			preferences[handle] = &copied
+		} else {
+			preferences[handle] = db.DefaultPreferences(handle)
+		}
+	}
+	return preferences, nil
+}
+
+func (stub *stubDBHelper) ReplacePRTickets(ctx context.Context, owner, repo string, number int, tickets []*db.Ticket) error {
+	if stub.tickets == nil {
+		stub.tickets = make(map[int][]*db.Ticket)
+	}
+	var replaced []*db.Ticket
+	for _, ticket := range tickets {
+		copied := *ticket
+		for _, stored := range stub.tickets[number] {
+			if stored.Number == ticket.Number {
+				copied.Linked, copied.Merged = stored.Linked, stored.Merged
+			}
+		}
+		replaced = append(replaced, &copied)
+	}
+	stub.tickets[number] = replaced
+	return nil
+}
+
+func (stub *stubDBHelper) GetPRTickets(ctx context.Context, owner, repo string, number int) ([]*db.Ticket, error) {
+	var tickets []*db.Ticket
+	for _, ticket := range stub.tickets[number] {
+		copied := *ticket
+		tickets = append(tickets, &copied)
+	}
+	sort.Slice(tickets, func(i, j int) bool { return tickets[i].Number < tickets[j].Number })
+	return tickets, nil
+}
+
+func (stub *stubDBHelper) SetPRTicket(ctx context.Context, owner, repo string, number int, ticket *db.Ticket) error {
+	for _, stored := range stub.tickets[number] {
+		if stored.Number == ticket.Number {
+			stored.Linked = ticket.Linked
+			stored.Merged = ticket.Merged
+		}
+	}
+	return nil
+}
+
+func (stub *stubDBHelper) SetPreferences(ctx context.Context, preferences *db.Preferences) error {
+	if stub.preferences == nil {
+		stub.preferences = make(map[string]*db.Preferences)
+	}
+	stub.preferences[preferences.Handle] = preferences
+	return nil
+}
+
+func (stub *stubDBHelper) Ping(ctx context.Context) error {
+	return stub.pingErr
+}
+
+func (stub *stubDBHelper) CountPendingReviewPRs(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (stub *stubDBHelper) SaveEvent(ctx context.Context, deliveryID, eventType string, payload []byte) (bool, error) {
+	if _, exist := stub.eventStatus[deliveryID]; exist {
+		return false, nil
+	}
+	stub.setEvent(deliveryID, db.EventPending, 0)
+	stub.eventPayloads[deliveryID] = payload
+	return true, nil
+}
+
+func (stub *stubDBHelper) ResetEvent(ctx context.Context, deliveryID string) (*db.Event, error) {
+	if _, exist := stub.eventStatus[deliveryID]; !exist {
+		return nil, sql.ErrNoRows
+	}
+	stub.setEvent(deliveryID, db.EventPending, 0)
+	return &db.Event{
+		DeliveryID: deliveryID,
+		Type:       "pull_request",
+		Payload:    stub.eventPayloads[deliveryID],
+	}, nil
+}
+
+func (stub *stubDBHelper) ClaimEvent(ctx context.Context, deliveryID string) (*db.Event, error) {
+	if stub.eventStatus[deliveryID] != db.EventPending {
+		return nil, sql.ErrNoRows
+	}
+	stub.setEvent(deliveryID, db.EventRunning, stub.eventAttempts[deliveryID])
+	return &db.Event{
+		DeliveryID: deliveryID,
+		Type:       "pull_request",
+		Payload:    stub.eventPayloads[deliveryID],
+		Attempts:   stub.eventAttempts[deliveryID],
+	}, nil
+}
+
+func (stub *stubDBHelper) GetPendingEvents(ctx context.Context) ([]*db.Event, error) {
 	return nil, nil
 }
-func (stub *stubDBHelper) SetPRProcessed(number int, processed bool) error {
+
+func (stub *stubDBHelper) SetEventDone(ctx context.Context, deliveryID string) error {
+	stub.setEvent(deliveryID, db.EventDone, stub.eventAttempts[deliveryID])
+	return nil
+}
+
+func (stub *stubDBHelper) SetEventRetry(ctx context.Context, deliveryID string, attempts int, nextAttempt time.Time, lastError string) error {
+	stub.setEvent(deliveryID, db.EventPending, attempts)
 	return nil
 }
 
-func (stub *stubDBHelper) SetPRPendingReview(number int, pendingReview bool) error {
+func (stub *stubDBHelper) SetEventFailed(ctx context.Context, deliveryID string, attempts int, lastError string) error {
+	stub.setEvent(deliveryID, db.EventFailed, attempts)
 	return nil
 }
+
+func (stub *stubDBHelper) setEvent(deliveryID, status string, attempts int) {
+	if stub.eventStatus == nil {
+		stub.eventStatus = make(map[string]string)
+		stub.eventAttempts = make(map[string]int)
+		stub.eventPayloads = make(map[string][]byte)
+	}
+	stub.eventStatus[deliveryID] = status
+	stub.eventAttempts[deliveryID] = attempts
+}
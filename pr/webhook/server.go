@@ -6,11 +6,15 @@ import (
 	"crypto/hmac"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
+	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"hash"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -19,80 +23,194 @@ import (
 	"time"
 
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/macports/mpbot-github/pr/config"
 	"github.com/macports/mpbot-github/pr/db"
 	"github.com/macports/mpbot-github/pr/githubapi"
+	"github.com/macports/mpbot-github/pr/metrics"
+	"github.com/macports/mpbot-github/pr/rules"
+	"github.com/macports/mpbot-github/pr/trac"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Receiver struct {
-	server           *http.Server
-	hookSecret       []byte
-	production       bool
-	testing          bool
-	httpClient       *retryablehttp.Client
-	githubClient     githubapi.Client
-	dbHelper         db.DBHelper
-	wg               sync.WaitGroup
-	members          *map[string]bool
+	server *http.Server
+	// Cancelled when the shutdown deadline is exceeded
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Cancels detached changes to PRs when they outlast a second deadline
+	abort context.CancelFunc
+	// How long shutdown waits for aborted changes to return
+	abortTimeout time.Duration
+	config       *config.Config
+	testing      bool
+	httpClient   *retryablehttp.Client
+	githubClient githubapi.Client
+	dbHelper     db.DBHelper
+	// Label rules, the defaults for the configured labels if nil
+	rules *rules.Source
+	// Updates referenced Trac tickets, nil to only record them
+	trac         trac.Client
+	wg           sync.WaitGroup
+	pool         *workerPool
+	quit         chan struct{}
+	inflight     map[string]bool
+	inflightLock sync.Mutex
+	// When each /reprocess request accepted recently was received
+	reprocessed     map[string]time.Time
+	reprocessedLock sync.Mutex
+	// Members of each org owning a served repository
+	members          map[string]map[string]bool
+	membersUpdated   time.Time
 	membersLock      sync.RWMutex
 	travisPubKey     *rsa.PublicKey
 	travisPubKeyLock sync.RWMutex
+	commitPorts      commitPortsCache
 }
 
-func NewReceiver(listenAddr string, hookSecret []byte, botSecret string, production bool, dbHelper db.DBHelper) *Receiver {
+func NewReceiver(ctx context.Context, cfg *config.Config, githubClient githubapi.Client, dbHelper db.DBHelper, labelRules *rules.Source, tracClient trac.Client) *Receiver {
+	abortCtx, abort := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, abortKey{}, abortCtx))
 	return &Receiver{
-		server:       &http.Server{Addr: listenAddr},
-		hookSecret:   hookSecret,
-		production:   production,
+		server:       &http.Server{Addr: cfg.ListenAddr},
+		ctx:          ctx,
+		cancel:       cancel,
+		abort:        abort,
+		abortTimeout: abortTimeout,
+		config:       cfg,
 		httpClient:   retryablehttp.NewClient(),
-		githubClient: githubapi.NewClient(botSecret),
+		githubClient: githubClient,
 		dbHelper:     dbHelper,
+		rules:        labelRules,
+		trac:         tracClient,
+		quit:         make(chan struct{}),
+		pool:         newWorkerPool(cfg.Workers, cfg.QueueSize),
 	}
 }
 
 func (receiver *Receiver) Start() {
+	go receiver.updateMembers()
+	receiver.updateTravisPubKey()
+
+	receiver.wg.Add(1)
+	go func() {
+		defer receiver.wg.Done()
+		receiver.replayEvents()
+	}()
+
+	receiver.registerMetrics()
+
+	receiver.server.Handler = receiver.handler()
+	receiver.server.ListenAndServe()
+}
+
+func (receiver *Receiver) handler() http.Handler {
 	mux := http.NewServeMux()
 
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", receiver.handleHealthz)
+	mux.HandleFunc("/readyz", receiver.handleReadyz)
+	if dryRun, ok := receiver.githubClient.(*githubapi.DryRunClient); ok {
+		mux.HandleFunc("/dryrun", receiver.handleDryRun(dryRun))
+	}
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		sigStr := r.Header.Get("X-Hub-Signature")
-		if len(sigStr) != 45 || !strings.HasPrefix(sigStr, "sha1=") {
+		eventType := r.Header.Get("X-GitHub-Event")
+
+		body, ok := receiver.readSignedBody(r)
+		if !ok {
+			metrics.SignatureFailures.Inc()
+			metrics.WebhookDeliveries.WithLabelValues(metrics.EventUnknown, "invalid").Inc()
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		sig, err := hex.DecodeString(sigStr[5:])
-		if err != nil {
+		switch eventType {
+		case "":
+			metrics.WebhookDeliveries.WithLabelValues(metrics.EventUnknown, "invalid").Inc()
 			w.WriteHeader(http.StatusBadRequest)
 			return
+		case "pull_request", "pull_request_review", "issue_comment":
+		default:
+			metrics.WebhookDeliveries.WithLabelValues(metrics.EventUnknown, "ignored").Inc()
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 
-		receiver.wg.Add(1)
+		deliveryID := r.Header.Get("X-GitHub-Delivery")
+		if deliveryID == "" {
+			metrics.WebhookDeliveries.WithLabelValues(eventType, "invalid").Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-		body, err := ioutil.ReadAll(r.Body)
+		// Only acknowledge deliveries that can be replayed after a crash
+		event, err := receiver.saveEvent(r.Context(), deliveryID, eventType, body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			receiver.wg.Done()
+			log.Println(err)
+			metrics.WebhookDeliveries.WithLabelValues(eventType, "error").Inc()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if event == nil {
+			log.Println("Skipping duplicate delivery " + deliveryID)
+			metrics.WebhookDeliveries.WithLabelValues(eventType, "duplicate").Inc()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !receiver.dispatch(event) {
+			// Saved, so it will still be processed once the queue drains
+			metrics.WebhookDeliveries.WithLabelValues(eventType, "queue_full").Inc()
+			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
-		if !receiver.checkMAC(body, sig) {
+		metrics.WebhookDeliveries.WithLabelValues(eventType, "accepted").Inc()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Force a stored delivery to be processed again. The request is signed
+	// with the webhook secret like a GitHub delivery, and includes the time
+	// it was signed at so that it cannot be replayed later.
+	mux.HandleFunc("/reprocess", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, ok := receiver.readSignedBody(r)
+		if !ok {
 			w.WriteHeader(http.StatusBadRequest)
-			receiver.wg.Done()
 			return
 		}
 
-		eventType := r.Header.Get("X-GitHub-Event")
-		switch eventType {
-		case "":
+		var request struct {
+			DeliveryID string `json:"delivery_id"`
+			// Unix time the request was signed at
+			Timestamp int64 `json:"timestamp"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil || request.DeliveryID == "" || request.Timestamp == 0 {
 			w.WriteHeader(http.StatusBadRequest)
-			receiver.wg.Done()
 			return
-		case "pull_request":
-			go receiver.handlePullRequest(body)
-		case "pull_request_review", "issue_comment":
-			go receiver.handleOtherPullRequestEvents(eventType, body)
-		default:
-			w.WriteHeader(http.StatusNoContent)
-			receiver.wg.Done()
+		}
+		if !receiver.acceptReprocess(body, time.Unix(request.Timestamp, 0)) {
+			log.Println("Rejecting stale or replayed reprocess request for " + request.DeliveryID)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		err := receiver.reprocessEvent(r.Context(), request.DeliveryID)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errQueueFull {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
@@ -105,17 +223,17 @@ func (receiver *Receiver) Start() {
 		sig, err := base64.StdEncoding.DecodeString(sigStr)
 		if err != nil {
 			log.Println(err)
+			metrics.SignatureFailures.Inc()
+			metrics.WebhookDeliveries.WithLabelValues("travis", "invalid").Inc()
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		receiver.wg.Add(1)
-
 		body := []byte(r.FormValue("payload"))
 
 		if len(body) == 0 {
+			metrics.WebhookDeliveries.WithLabelValues("travis", "invalid").Inc()
 			w.WriteHeader(http.StatusBadRequest)
-			receiver.wg.Done()
 			return
 		}
 
@@ -125,8 +243,9 @@ func (receiver *Receiver) Start() {
 		receiver.travisPubKeyLock.RUnlock()
 		if err != nil {
 			log.Println(err)
+			metrics.SignatureFailures.Inc()
+			metrics.WebhookDeliveries.WithLabelValues("travis", "invalid").Inc()
 			w.WriteHeader(http.StatusBadRequest)
-			receiver.wg.Done()
 			return
 		}
 
@@ -135,26 +254,135 @@ func (receiver *Receiver) Start() {
 		err = json.Unmarshal(body, &payload)
 		if err != nil {
 			log.Println(err)
+			metrics.WebhookDeliveries.WithLabelValues("travis", "invalid").Inc()
 			w.WriteHeader(http.StatusBadRequest)
-			receiver.wg.Done()
 			return
 		}
 
-		go receiver.handleTravisWebhook(payload)
+		receiver.wg.Add(1)
+		ok := receiver.pool.submit(payload.PullRequestNumber, func() {
+			defer receiver.wg.Done()
+			receiver.handleTravisWebhook(receiver.ctx, payload)
+		})
+		if !ok {
+			receiver.wg.Done()
+			metrics.WebhookDeliveries.WithLabelValues("travis", "queue_full").Inc()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 
+		metrics.WebhookDeliveries.WithLabelValues("travis", "accepted").Inc()
 		w.WriteHeader(http.StatusNoContent)
 	})
 
-	go receiver.updateMembers()
-	receiver.updateTravisPubKey()
+	return mux
+}
 
-	receiver.server.Handler = mux
-	receiver.server.ListenAndServe()
+// registerMetrics registers collectors that read the receiver's state on
+// every scrape.
+func (receiver *Receiver) registerMetrics() {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prbot_event_queue_depth",
+			Help: "Events waiting for a worker.",
+		}, func() float64 {
+			return float64(receiver.QueueDepth())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prbot_prs_pending_review",
+			Help: "PRs waiting for a maintainer response, -1 if unknown.",
+		}, func() float64 {
+			if receiver.dbHelper == nil {
+				return -1
+			}
+			count, err := receiver.dbHelper.CountPendingReviewPRs(receiver.ctx)
+			if err != nil {
+				return -1
+			}
+			return float64(count)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prbot_org_members_cache_age_seconds",
+			Help: "Time since the list of org members was last loaded, -1 if never loaded.",
+		}, func() float64 {
+			receiver.membersLock.RLock()
+			defer receiver.membersLock.RUnlock()
+			if receiver.membersUpdated.IsZero() {
+				return -1
+			}
+			return time.Since(receiver.membersUpdated).Seconds()
+		}),
+	}
+	for _, collector := range collectors {
+		if err := prometheus.Register(collector); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
-func (receiver *Receiver) Shutdown() {
-	receiver.server.Shutdown(context.Background())
-	receiver.wg.Wait()
+// readSignedBody reads the request body and reports whether it carries a
+// valid signature made with the webhook secret.
+func (receiver *Receiver) readSignedBody(r *http.Request) ([]byte, bool) {
+	hashFunc, sig, err := receiver.parseSignature(r.Header)
+	if err != nil {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, false
+	}
+
+	return body, receiver.checkMAC(hashFunc, body, sig)
+}
+
+// Shutdown stops accepting deliveries and waits for the events being
+// processed. Events still running after timeout are cancelled and left
+// pending, to be replayed on the next start. Events still changing a PR
+// after another timeout are aborted, and are given up on after abortTimeout.
+func (receiver *Receiver) Shutdown(timeout time.Duration) {
+	close(receiver.quit)
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), timeout)
+	defer cancelDeadline()
+	receiver.server.Shutdown(deadline)
+
+	done := make(chan struct{})
+	go func() {
+		receiver.wg.Wait()
+		close(done)
+	}()
+	finished := true
+	select {
+	case <-done:
+	case <-deadline.Done():
+		log.Println("Shutdown deadline exceeded, cancelling events in progress")
+		receiver.cancel()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			log.Println("Events still changing PRs, aborting them")
+			receiver.abort()
+			select {
+			case <-done:
+			case <-time.After(receiver.abortTimeout):
+				log.Println("Giving up on events still running")
+				finished = false
+			}
+		}
+	}
+	receiver.cancel()
+	receiver.abort()
+	if finished {
+		receiver.pool.stop()
+	} else {
+		// Stuck workers would block stopping the pool
+		receiver.pool.close()
+	}
+}
+
+// QueueDepth returns the number of events waiting for a worker.
+func (receiver *Receiver) QueueDepth() int {
+	return receiver.pool.queueDepth()
 }
 
 func (receiver *Receiver) updateTravisPubKey() {
@@ -179,34 +407,90 @@ func (receiver *Receiver) updateTravisPubKey() {
 }
 
 func (receiver *Receiver) updateMembers() {
-	for ; ; time.Sleep(24 * time.Hour) {
-		users, err := receiver.githubClient.ListOrgMembers("macports")
-		if err != nil {
+	for {
+		for _, org := range receiver.config.Owners() {
+			receiver.updateOrgMembers(org)
+		}
+
+		select {
+		case <-receiver.quit:
+			return
+		case <-time.After(time.Duration(receiver.config.MembersInterval)):
+		}
+	}
+}
+
+func (receiver *Receiver) updateOrgMembers(org string) {
+	users, err := receiver.githubClient.ListOrgMembers(receiver.ctx, org)
+	if err != nil {
+		log.Println("Failed to list members of " + org + ": " + err.Error())
+		return
+	}
+	members := make(map[string]bool)
+	for _, user := range users {
+		if user.Login == nil {
 			continue
 		}
-		members := make(map[string]bool)
-		for _, user := range users {
-			if user.Login == nil {
-				continue
-			}
-			login := *user.Login
-			if login == "" {
-				continue
-			}
-			members[login] = true
+		login := *user.Login
+		if login == "" {
+			continue
 		}
-		if len(members) > 0 {
-			log.Println("Updating list of members, got", len(members), "members")
-			receiver.membersLock.Lock()
-			receiver.members = &members
-			receiver.membersLock.Unlock()
+		members[login] = true
+	}
+	if len(members) > 0 {
+		log.Println("Updating list of members of "+org+", got", len(members), "members")
+		receiver.membersLock.Lock()
+		// Copy so that readers never see a map being modified
+		orgs := make(map[string]map[string]bool, len(receiver.members)+1)
+		for k, v := range receiver.members {
+			orgs[k] = v
 		}
+		orgs[org] = members
+		receiver.members = orgs
+		receiver.membersUpdated = time.Now()
+		receiver.membersLock.Unlock()
+	}
+}
+
+// isMember reports whether login is a member of org, as of the last update.
+func (receiver *Receiver) isMember(org, login string) bool {
+	receiver.membersLock.RLock()
+	defer receiver.membersLock.RUnlock()
+	return receiver.members[org][login]
+}
+
+var errInvalidSignature = errors.New("invalid webhook signature")
+
+// parseSignature returns the hash function and decoded MAC of a webhook
+// delivery. X-Hub-Signature-256 is preferred, X-Hub-Signature (HMAC-SHA1) is
+// only used when the former is absent and SHA-256 is not required.
+func (receiver *Receiver) parseSignature(header http.Header) (func() hash.Hash, []byte, error) {
+	if sigStr := header.Get("X-Hub-Signature-256"); sigStr != "" {
+		return decodeSignature(sigStr, "sha256=", sha256.New, sha256.Size)
+	}
+	if receiver.config.GitHub.RequireSHA256 {
+		return nil, nil, errInvalidSignature
+	}
+	if sigStr := header.Get("X-Hub-Signature"); sigStr != "" {
+		return decodeSignature(sigStr, "sha1=", sha1.New, sha1.Size)
+	}
+	return nil, nil, errInvalidSignature
+}
+
+func decodeSignature(sigStr, prefix string, hashFunc func() hash.Hash, size int) (func() hash.Hash, []byte, error) {
+	if len(sigStr) != len(prefix)+2*size || !strings.HasPrefix(sigStr, prefix) {
+		return nil, nil, errInvalidSignature
+	}
+	sig, err := hex.DecodeString(sigStr[len(prefix):])
+	if err != nil {
+		return nil, nil, errInvalidSignature
 	}
+	return hashFunc, sig, nil
 }
 
 // checkMAC reports whether messageMAC is a valid HMAC tag for message.
-func (receiver *Receiver) checkMAC(message, messageMAC []byte) bool {
-	mac := hmac.New(sha1.New, receiver.hookSecret)
+func (receiver *Receiver) checkMAC(hashFunc func() hash.Hash, message, messageMAC []byte) bool {
+	mac := hmac.New(hashFunc, []byte(receiver.config.GitHub.WebhookSecret))
 	mac.Write(message)
 	expectedMAC := mac.Sum(nil)
 	return hmac.Equal(messageMAC, expectedMAC)
@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/macports/mpbot-github/pr/config"
+)
+
+func sign(hashFunc func() hash.Hash, secret, body []byte) string {
+	mac := hmac.New(hashFunc, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type SignatureTest struct {
+	name          string
+	sha1          string
+	sha256        string
+	requireSHA256 bool
+	valid         bool
+}
+
+func TestSignature(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"action":"opened"}`)
+	sha1Sig := "sha1=" + sign(sha1.New, secret, body)
+	sha256Sig := "sha256=" + sign(sha256.New, secret, body)
+	badSHA256Sig := "sha256=" + sign(sha256.New, []byte("wrong"), body)
+
+	sigTests := []*SignatureTest{
+		{name: "sha256 only", sha256: sha256Sig, valid: true},
+		{name: "sha1 only", sha1: sha1Sig, valid: true},
+		{name: "both", sha1: sha1Sig, sha256: sha256Sig, valid: true},
+		{name: "sha256 required", sha256: sha256Sig, requireSHA256: true, valid: true},
+		{name: "sha1 rejected when sha256 required", sha1: sha1Sig, requireSHA256: true},
+		{name: "no fallback to sha1 on bad sha256", sha1: sha1Sig, sha256: badSHA256Sig},
+		{name: "no fallback to sha1 on malformed sha256", sha1: sha1Sig, sha256: "sha256=abc"},
+		{name: "sha1 value in sha256 header", sha256: sha1Sig},
+		{name: "sha256 value in sha1 header", sha1: sha256Sig},
+		{name: "non-hex sha256", sha256: "sha256=" + string(make([]byte, 64))},
+		{name: "wrong prefix", sha256: "sha512=" + sha256Sig[7:]},
+		{name: "missing"},
+	}
+	for _, st := range sigTests {
+		receiver := &Receiver{config: config.Default()}
+		receiver.config.GitHub.WebhookSecret = string(secret)
+		receiver.config.GitHub.RequireSHA256 = st.requireSHA256
+		header := http.Header{}
+		if st.sha1 != "" {
+			header.Set("X-Hub-Signature", st.sha1)
+		}
+		if st.sha256 != "" {
+			header.Set("X-Hub-Signature-256", st.sha256)
+		}
+		hashFunc, sig, err := receiver.parseSignature(header)
+		valid := err == nil && receiver.checkMAC(hashFunc, body, sig)
+		assert.Equal(t, st.valid, valid, st.name)
+	}
+}
@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/macports/mpbot-github/pr/db"
+	"github.com/macports/mpbot-github/pr/portfile"
+	"github.com/macports/mpbot-github/pr/status"
+)
+
+// updateStatus applies change to the status comment of a PR.
+func (receiver *Receiver) updateStatus(ctx context.Context, owner, repo string, number int, change func(*status.Comment)) {
+	err := status.Update(ctx, receiver.githubClient, receiver.config.GitHub.BotName, owner, repo, number, func(comment *status.Comment) {
+		comment.MentionSymbol = receiver.mentionSymbol()
+		change(comment)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// setNotified records the maintainers mentioned, or that the PR asked not to
+// notify them.
+func setNotified(comment *status.Comment, n *notification) {
+	if n == nil {
+		return
+	}
+	if n.skipped {
+		comment.NotificationSkipped = true
+		return
+	}
+	comment.AddMaintainers(n.handles)
+	for handle, until := range n.away {
+		if comment.Away == nil {
+			comment.Away = make(map[string]time.Time)
+		}
+		comment.Away[handle] = until
+	}
+	for handle, groupAbove := range n.groupAbove {
+		if comment.GroupAbove == nil {
+			comment.GroupAbove = make(map[string]int)
+		}
+		comment.GroupAbove[handle] = groupAbove
+	}
+}
+
+// mentionMaintainers mentions maintainers added to a PR after it was opened
+// in a new comment, as they are not notified of the edit of the status
+// comment, nor of an assignment if they prefer not to be assigned.
+func (receiver *Receiver) mentionMaintainers(ctx context.Context, owner, repo string, number int, n *notification) {
+	if n == nil || n.skipped || len(n.handles) == 0 {
+		return
+	}
+	mentions := &status.Comment{MentionSymbol: receiver.mentionSymbol()}
+	setNotified(mentions, n)
+	body := "Notifying maintainers of ports changed since the PR was opened:\n" + mentions.Mentions()
+	if err := receiver.githubClient.CreateComment(ctx, owner, repo, number, &body); err != nil {
+		log.Println(err)
+	}
+}
+
+// allAway reports whether all maintainers of a PR were away when notified
+// and still are at t.
+func allAway(comment *status.Comment, handles []string, t time.Time) bool {
+	away := false
+	for _, handle := range handles {
+		if handle == "" {
+			continue
+		}
+		if !t.Before(comment.Away[handle]) {
+			return false
+		}
+		away = true
+	}
+	return away
+}
+
+// checksumPorts returns the ports whose checksums change without their
+// version or revision, in port order.
+func checksumPorts(ports []string, summary *portsSummary) []string {
+	var checksumPorts []string
+	for _, port := range ports {
+		if diff := summary.portfiles[port]; diff != nil && diff.Kind() == portfile.KindChecksum {
+			checksumPorts = append(checksumPorts, port)
+		}
+	}
+	return checksumPorts
+}
+
+// askAboutChecksums asks the sender of a PR why the checksums of ports
+// change, as upstream may have replaced the distfiles or they may have been
+// tampered with.
+func (receiver *Receiver) askAboutChecksums(ctx context.Context, owner, repo string, number int, sender string, ports []string) {
+	if len(ports) == 0 {
+		return
+	}
+	noun := "port " + strings.Join(ports, ", ")
+	if len(ports) > 1 {
+		noun = "ports " + strings.Join(ports, ", ")
+	}
+	body := receiver.mentionSymbol() + sender + ", the checksums of " + noun +
+		" change without a change of version or revision. " +
+		"This happens when upstream replaces a release with different files, but may also mean that the files were tampered with. " +
+		"Please explain the change, e.g. with a link to an upstream announcement or a comparison of the old and new files.\n"
+	if err := receiver.githubClient.CreateComment(ctx, owner, repo, number, &body); err != nil {
+		log.Println(err)
+	}
+}
+
+// duplicatePorts returns the new ports similar to existing ones, in port
+// order.
+func duplicatePorts(ports []string, summary *portsSummary) []string {
+	var duplicatePorts []string
+	for _, port := range ports {
+		if summary.duplicates[port] != nil {
+			duplicatePorts = append(duplicatePorts, port)
+		}
+	}
+	return duplicatePorts
+}
+
+// warnAboutDuplicates warns the sender of a PR that new ports are similar to
+// existing ones, linking to their Portfiles.
+func (receiver *Receiver) warnAboutDuplicates(ctx context.Context, event *github.PullRequestEvent, summary *portsSummary, ports []string) {
+	if len(ports) == 0 {
+		return
+	}
+	owner := *event.Repo.Owner.Login
+	repo := *event.Repo.Name
+	branch := event.Repo.GetDefaultBranch()
+	if branch == "" {
+		branch = "master"
+	}
+	body := receiver.mentionSymbol() + *event.Sender.Login + ", these new ports are similar to existing ones:\n"
+	for _, port := range ports {
+		var links []string
+		for _, existing := range summary.duplicates[port] {
+			links = append(links, "["+existing.Path+"](https://github.com/"+owner+"/"+repo+"/blob/"+branch+"/"+existing.Path+"/Portfile)")
+		}
+		body += "- " + port + ": " + strings.Join(links, ", ") + "\n"
+	}
+	body += "\nPlease check whether the existing ports could be updated instead, or explain why a new port is needed.\n"
+	if err := receiver.githubClient.CreateComment(ctx, owner, repo, *event.Number, &body); err != nil {
+		log.Println(err)
+	}
+}
+
+func (receiver *Receiver) mentionSymbol() string {
+	if receiver.config.Production {
+		return "@"
+	}
+	return "@_"
+}
+
+// setTimeoutStatus shows whether a tracked PR waits for its maintainers.
+// Responses and timeouts are kept until the PR waits again. A PR whose
+// maintainers are all away times out at the next check instead.
+func (receiver *Receiver) setTimeoutStatus(comment *status.Comment, pr *db.PullRequest) {
+	if pr == nil {
+		return
+	}
+	switch {
+	case pr.PendingReview && pr.Draft:
+		comment.Timeout = status.Timeout{State: status.TimeoutPaused}
+	case pr.PendingReview:
+		timeout := time.Duration(receiver.config.MaintainerTimeout)
+		if repoConfig := receiver.config.Repo(pr.Owner, pr.Repo); repoConfig != nil {
+			timeout = receiver.config.Timeout(repoConfig)
+		}
+		comment.Timeout = status.Timeout{
+			State:    status.TimeoutWaiting,
+			Deadline: pr.PendingSince.Add(timeout),
+			Away:     allAway(comment, pr.Maintainers, time.Now()),
+		}
+	case comment.Timeout.State == status.TimeoutWaiting || comment.Timeout.State == status.TimeoutPaused:
+		comment.Timeout = status.Timeout{}
+	}
+}
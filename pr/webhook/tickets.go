@@ -0,0 +1,93 @@
+package webhook
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/macports/mpbot-github/pr/db"
+	"github.com/macports/mpbot-github/pr/trac"
+)
+
+func pullRequestURL(owner, repo string, number int) string {
+	return "https://github.com/" + owner + "/" + repo + "/pull/" + strconv.Itoa(number)
+}
+
+// linkTickets records the Trac tickets referenced by the body and the commit
+// messages of a PR, and links them back to the PR.
+func (receiver *Receiver) linkTickets(ctx context.Context, owner, repo string, number int, body string, prCommits []*github.RepositoryCommit) {
+	texts := []string{body}
+	for _, commit := range prCommits {
+		texts = append(texts, commit.GetCommit().GetMessage())
+	}
+	references := trac.NewFinder(receiver.config.Trac.URL).Find(texts...)
+	tickets := make([]*db.Ticket, 0, len(references))
+	for _, reference := range references {
+		tickets = append(tickets, &db.Ticket{Number: reference.Ticket, Close: reference.Close})
+	}
+	// References removed by an edit or a push are forgotten
+	if err := receiver.dbHelper.ReplacePRTickets(ctx, owner, repo, number, tickets); err != nil {
+		log.Println(err)
+		return
+	}
+	if receiver.trac == nil || len(tickets) == 0 {
+		return
+	}
+	stored, err := receiver.dbHelper.GetPRTickets(ctx, owner, repo, number)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, ticket := range stored {
+		if ticket.Linked {
+			continue
+		}
+		comment := "Pull request: " + pullRequestURL(owner, repo, number)
+		if err := receiver.trac.UpdateTicket(ctx, ticket.Number, comment, false); err != nil {
+			log.Println("Error linking Trac ticket #" + strconv.Itoa(ticket.Number) + ": " + err.Error())
+			continue
+		}
+		ticket.Linked = true
+		if err := receiver.dbHelper.SetPRTicket(ctx, owner, repo, number, ticket); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// updateMergedTickets comments on the Trac tickets referenced by a merged
+// PR, resolving those it fixes.
+func (receiver *Receiver) updateMergedTickets(ctx context.Context, event *github.PullRequestEvent) {
+	if receiver.trac == nil {
+		return
+	}
+	owner := *event.Repo.Owner.Login
+	repo := *event.Repo.Name
+	number := *event.Number
+	tickets, err := receiver.dbHelper.GetPRTickets(ctx, owner, repo, number)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	merged := pullRequestURL(owner, repo, number)
+	if sha := event.PullRequest.GetMergeCommitSHA(); sha != "" {
+		merged = "https://github.com/" + owner + "/" + repo + "/commit/" + sha + " (" + merged + ")"
+	}
+	for _, ticket := range tickets {
+		if ticket.Merged {
+			continue
+		}
+		comment := "Merged in " + merged + "."
+		if ticket.Close {
+			comment = "Fixed in " + merged + "."
+		}
+		if err := receiver.trac.UpdateTicket(ctx, ticket.Number, comment, ticket.Close); err != nil {
+			log.Println("Error updating Trac ticket #" + strconv.Itoa(ticket.Number) + ": " + err.Error())
+			continue
+		}
+		ticket.Merged = true
+		if err := receiver.dbHelper.SetPRTicket(ctx, owner, repo, number, ticket); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/macports/mpbot-github/pr/config"
+	"github.com/macports/mpbot-github/pr/db"
+)
+
+type ticketUpdate struct {
+	ticket  int
+	comment string
+	resolve bool
+}
+
+type stubTracClient struct {
+	updates []ticketUpdate
+}
+
+func (stub *stubTracClient) UpdateTicket(ctx context.Context, ticket int, comment string, resolve bool) error {
+	stub.updates = append(stub.updates, ticketUpdate{ticket, comment, resolve})
+	return nil
+}
+
+func TestTickets(t *testing.T) {
+	stubClient := &stubGitHubClient{
+		commits: map[int][]*github.RepositoryCommit{3: {
+			{Commit: &github.Commit{Message: ptrOfStr("upx: update to 3.96\n\nCloses: https://trac.macports.org/ticket/61234")}},
+		}},
+	}
+	stubDB := &stubDBHelper{}
+	stubTrac := &stubTracClient{}
+	receiver := &Receiver{
+		config:       config.Default(),
+		githubClient: stubClient,
+		dbHelper:     stubDB,
+		trac:         stubTrac,
+		testing:      true,
+	}
+	ctx := context.Background()
+	event := &github.PullRequestEvent{
+		Action: ptrOfStr("opened"),
+		Number: ptrOfInt(3),
+		PullRequest: &github.PullRequest{
+			Title: ptrOfStr("upx: update to 3.96"),
+			Body:  ptrOfStr("See #60001"),
+		},
+		Repo: &github.Repository{
+			Name:  ptrOfStr("macports-ports"),
+			Owner: &github.User{Login: ptrOfStr("macports")},
+		},
+		Sender: &github.User{Login: ptrOfStr("jverne")},
+	}
+
+	// Tickets of the body and commit messages are linked back once
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	assert.Equal(t, []*db.Ticket{
+		{Number: 60001, Linked: true},
+		{Number: 61234, Close: true, Linked: true},
+	}, stubDB.tickets[3])
+	assert.Equal(t, []ticketUpdate{
+		{60001, "Pull request: https://github.com/macports/macports-ports/pull/3", false},
+		{61234, "Pull request: https://github.com/macports/macports-ports/pull/3", false},
+	}, stubTrac.updates)
+	event.Action = ptrOfStr("synchronize")
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	assert.Len(t, stubTrac.updates, 2)
+
+	// Edits only matter if the body changed
+	event.Action = ptrOfStr("edited")
+	event.PullRequest.Body = ptrOfStr("See #60001, closes https://trac.macports.org/ticket/60002 and fixes #60003")
+	event.Changes = &github.EditChange{}
+	event.Changes.Body = &struct {
+		From *string `json:"from,omitempty"`
+	}{From: ptrOfStr("See #60001")}
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	assert.Len(t, stubTrac.updates, 3)
+	assert.True(t, stubDB.tickets[3][1].Close)
+
+	// Edits replace the references, including whether they close tickets
+	event.PullRequest.Body = ptrOfStr("See https://trac.macports.org/ticket/60002")
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	assert.Len(t, stubTrac.updates, 3)
+	assert.Equal(t, []*db.Ticket{
+		{Number: 60002, Linked: true},
+		{Number: 61234, Close: true, Linked: true},
+	}, stubDB.tickets[3])
+
+	// Fixed tickets are resolved on merge, others commented on
+	stubTrac.updates = nil
+	event.Action = ptrOfStr("closed")
+	event.PullRequest.Merged = github.Bool(true)
+	event.PullRequest.MergeCommitSHA = ptrOfStr("0123abc")
+	assert.NoError(t, receiver.processPullRequest(ctx, event))
+	merged := "https://github.com/macports/macports-ports/commit/0123abc (https://github.com/macports/macports-ports/pull/3)."
+	assert.Equal(t, []ticketUpdate{
+		{60002, "Merged in " + merged, false},
+		{61234, "Fixed in " + merged, true},
+	}, stubTrac.updates)
+}
@@ -2,6 +2,8 @@ package webhook
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"log"
@@ -12,6 +14,9 @@ import (
 
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	"github.com/macports/mpbot-github/ci/logger/constants"
+	"github.com/macports/mpbot-github/pr/metrics"
+	"github.com/macports/mpbot-github/pr/status"
+	"github.com/prometheus/common/expfmt"
 )
 
 type TravisWebhookPayload struct {
@@ -49,43 +54,55 @@ type TravisWebhookPayload struct {
 	} `json:"matrix"`
 }
 
-func (receiver *Receiver) handleTravisWebhook(payload TravisWebhookPayload) {
+func (receiver *Receiver) handleTravisWebhook(ctx context.Context, payload TravisWebhookPayload) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println(r)
 		}
-
-		if !receiver.testing {
-			receiver.wg.Done()
-		}
 	}()
 
 	if !payload.PullRequest {
 		return
 	}
 
-	if payload.Repository.OwnerName != "macports" && payload.Repository.OwnerName != "macports-staging" {
+	isKnownOwner := false
+	for _, owner := range receiver.config.Travis.Owners {
+		if payload.Repository.OwnerName == owner {
+			isKnownOwner = true
+		}
+	}
+	if !isKnownOwner {
 		return
 	}
 
 	log.Println("PR #" + strconv.Itoa(payload.PullRequestNumber) + " " + payload.ResultMessage + " on Travis CI")
 
-	comment := "[Travis Build #" + payload.Number + "](" + payload.BuildURL + ") " + payload.ResultMessage + ".\n\n"
-	timeOut := false
-	lintDone := false
+	build := &status.Build{
+		Number: payload.Number,
+		URL:    payload.BuildURL,
+		Result: payload.ResultMessage,
+	}
 
 	log.Println("Processing " + strconv.Itoa(len(payload.Matrix)) + " job(s)")
 
 	for _, job := range payload.Matrix {
+		jobStatus := &status.Job{
+			Number: job.Number,
+			Image:  job.Config.OsxImage,
+			State:  job.State,
+		}
+		build.Jobs = append(build.Jobs, jobStatus)
+
 		req, err := retryablehttp.NewRequest(
 			"GET",
-			"https://api.travis-ci.org/job/"+strconv.Itoa(job.ID)+"/log",
+			strings.TrimSuffix(receiver.config.Travis.APIURL, "/")+"/job/"+strconv.Itoa(job.ID)+"/log",
 			nil,
 		)
 		if err != nil {
 			continue
 		}
 
+		req = req.WithContext(ctx)
 		req.Header.Set("Travis-API-Version", "3")
 		req.Header.Set("Accept", "text/plain")
 
@@ -134,7 +151,7 @@ func (receiver *Receiver) handleTravisWebhook(payload TravisWebhookPayload) {
 					string(content),
 					"The job exceeded the maximum time limit for jobs, and has been terminated.",
 				) {
-					timeOut = true
+					jobStatus.TimedOut = true
 				}
 				break
 			}
@@ -145,13 +162,18 @@ func (receiver *Receiver) handleTravisWebhook(payload TravisWebhookPayload) {
 			if pName == "keep-alive" {
 				continue
 			}
+			if pName == constants.MetricsFieldName {
+				if err := recordCIMetrics(content); err != nil {
+					log.Println(err)
+				}
+				continue
+			}
 			if err != nil {
 				log.Println(err)
 				continue
 			}
-			if strings.HasPrefix(pName, "port-lint-output-") && len(content) > 0 && !lintDone {
-				comment += "<details><summary>Lint results</summary>\n\n```\n" + string(content) + "```\n</details>\n\n<br>\n\n"
-				lintDone = true
+			if strings.HasPrefix(pName, "port-lint-output-") && len(content) > 0 && jobStatus.Lint == "" {
+				jobStatus.SetLint(string(content))
 			}
 			if strings.HasSuffix(pName, "-pastebin") {
 				pastebinRegex := regexp.MustCompile(`^port-(.*?)(-dep)?-install-output-(success|fail)-pastebin$`)
@@ -159,29 +181,59 @@ func (receiver *Receiver) handleTravisWebhook(payload TravisWebhookPayload) {
 				if pbInfo == nil {
 					continue
 				}
-				comment += "Port " + pbInfo[1]
+				result := "Port " + pbInfo[1]
 				if pbInfo[2] == "-dep" {
-					comment += "'s dependencies"
+					result += "'s dependencies"
 				}
 				if pbInfo[3] == "fail" {
 					pbInfo[3] = "**" + pbInfo[3] + "**"
 				}
 				pasteLink := strings.SplitN(string(content), "\n", 2)
 				if len(pasteLink) > 0 {
-					comment += " " + pbInfo[3] + " on " + job.Config.OsxImage + ". [Log](" + pasteLink[0] + ")\n"
+					jobStatus.Ports = append(jobStatus.Ports, result+" "+pbInfo[3]+". [Log]("+pasteLink[0]+")")
 				}
 			}
 		}
 	}
 
-	if timeOut {
-		comment += "\nThe build timed out."
+	if ctx.Err() != nil {
+		log.Println("Shutting down, dropping Travis results of PR #" + strconv.Itoa(payload.PullRequestNumber))
+		return
 	}
-
-	receiver.githubClient.CreateComment(
+	receiver.updateStatus(ctx,
 		payload.Repository.OwnerName,
 		payload.Repository.Name,
 		payload.PullRequestNumber,
-		&comment,
+		func(comment *status.Comment) {
+			comment.CI = build
+		},
 	)
 }
+
+// recordCIMetrics aggregates the per-port build metrics pushed by the CI
+// runner into the bot's own collectors.
+func recordCIMetrics(content []byte) error {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	family, ok := families[constants.PortBuildSecondsMetric]
+	if !ok {
+		return nil
+	}
+	for _, m := range family.GetMetric() {
+		var stage, result string
+		for _, label := range m.GetLabel() {
+			switch label.GetName() {
+			case "stage":
+				stage = label.GetValue()
+			case "result":
+				result = label.GetValue()
+			}
+		}
+		metrics.CIPortBuilds.WithLabelValues(stage, result).Inc()
+		metrics.CIPortBuildSeconds.WithLabelValues(stage, result).Observe(m.GetGauge().GetValue())
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/macports/mpbot-github/pr/metrics"
+)
+
+func TestRecordCIMetrics(t *testing.T) {
+	content := []byte(`# TYPE mpbot_ci_port_build_seconds gauge
+mpbot_ci_port_build_seconds{port="upx",stage="install-dependencies",result="success"} 12.500
+mpbot_ci_port_build_seconds{port="upx",stage="install-port",result="fail"} 30.000
+mpbot_ci_port_build_seconds{port="upx-devel",stage="install-port",result="fail"} 31.000
+`)
+	assert.NoError(t, recordCIMetrics(content))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.CIPortBuilds.WithLabelValues("install-dependencies", "success")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.CIPortBuilds.WithLabelValues("install-port", "fail")))
+
+	assert.Error(t, recordCIMetrics([]byte("not metrics {")))
+}